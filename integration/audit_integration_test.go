@@ -0,0 +1,60 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/onmetal/cephlet/pkg/audit"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Audit journal", func() {
+	It("should list appended entries and trim expired days", func(ctx SpecContext) {
+		name := "onmetal.test.audit"
+		now := time.Now().UTC()
+		expired := now.Add(-48 * time.Hour)
+		DeferCleanup(func() {
+			for _, oid := range []string{name, name + "." + now.Format("2006-01-02"), name + "." + expired.Format("2006-01-02")} {
+				if err := ioctx.Delete(oid); err != nil {
+					Expect(err).To(MatchError(rados.ErrNotFound))
+				}
+			}
+		})
+
+		journal, err := audit.NewJournal(radosConn, cephPoolname, audit.JournalOptions{
+			Name:      name,
+			Retention: 24 * time.Hour,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(journal.Append(ctx, audit.Entry{Timestamp: expired, ID: "foo", Operation: audit.OperationCreate})).To(Succeed())
+		Expect(journal.Append(ctx, audit.Entry{Timestamp: now, ID: "foo", Operation: audit.OperationUpdate})).To(Succeed())
+		Expect(journal.Append(ctx, audit.Entry{Timestamp: now.Add(time.Millisecond), ID: "bar", Operation: audit.OperationCreate})).To(Succeed())
+
+		Expect(journal.List(ctx, audit.ListOptions{ID: "foo"})).To(HaveExactElements(
+			HaveField("Operation", audit.OperationCreate),
+			HaveField("Operation", audit.OperationUpdate),
+		))
+		Expect(journal.List(ctx, audit.ListOptions{Since: now.Add(-time.Minute)})).To(HaveLen(2))
+		Expect(journal.List(ctx, audit.ListOptions{Limit: 1})).To(HaveExactElements(HaveField("ID", "bar")))
+
+		By("trimming the expired day")
+		Expect(journal.Trim(ctx)).To(Equal(1))
+		Expect(journal.List(ctx, audit.ListOptions{})).To(HaveLen(2))
+	})
+})
@@ -43,6 +43,7 @@ const (
 
 var (
 	volumeClient oriv1alpha1.VolumeRuntimeClient
+	radosConn    *rados.Conn
 	ioctx        *rados.IOContext
 
 	cephMonitors        = os.Getenv("CEPH_MONITORS")
@@ -126,19 +127,19 @@ var _ = BeforeSuite(func() {
 	volumeClient = oriv1alpha1.NewVolumeRuntimeClient(gconn)
 	DeferCleanup(gconn.Close)
 
-	conn, err := rados.NewConn()
+	radosConn, err = rados.NewConn()
 	Expect(err).NotTo(HaveOccurred())
 
-	Expect(conn.ReadConfigFile(cephConfigFile)).ToNot(HaveOccurred())
+	Expect(radosConn.ReadConfigFile(cephConfigFile)).ToNot(HaveOccurred())
 
-	Expect(conn.Connect()).ToNot(HaveOccurred())
-	DeferCleanup(conn.Shutdown)
+	Expect(radosConn.Connect()).ToNot(HaveOccurred())
+	DeferCleanup(radosConn.Shutdown)
 
-	pools, err := conn.ListPools()
+	pools, err := radosConn.ListPools()
 	Expect(err).NotTo(HaveOccurred())
 	Expect(pools).To(ContainElement(opts.Ceph.Pool))
 
-	ioctx, err = conn.OpenIOContext(opts.Ceph.Pool)
+	ioctx, err = radosConn.OpenIOContext(opts.Ceph.Pool)
 	Expect(err).NotTo(HaveOccurred())
 	DeferCleanup(ioctx.Destroy)
 })
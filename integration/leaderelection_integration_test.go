@@ -0,0 +1,78 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"context"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/onmetal/cephlet/pkg/leaderelection"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Leader election", func() {
+	It("should hand over leadership once the leader stops", func(ctx SpecContext) {
+		lockObject := "onmetal.test.leader"
+		DeferCleanup(func() {
+			if err := ioctx.Delete(lockObject); err != nil {
+				Expect(err).To(MatchError(rados.ErrNotFound))
+			}
+		})
+
+		newElector := func(identity string) *leaderelection.Elector {
+			elector, err := leaderelection.New(radosConn, cephPoolname, leaderelection.Options{
+				LockObject:    lockObject,
+				Identity:      identity,
+				LeaseDuration: 3 * time.Second,
+				RenewDeadline: 2 * time.Second,
+				RetryPeriod:   100 * time.Millisecond,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return elector
+		}
+		first, second := newElector("first"), newElector("second")
+
+		run := func(elector *leaderelection.Elector) (context.CancelFunc, <-chan struct{}) {
+			ctx, cancel := context.WithCancel(ctx)
+			leading := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				Expect(elector.Run(ctx, func(ctx context.Context) {
+					close(leading)
+					<-ctx.Done()
+				})).To(Succeed())
+			}()
+			return cancel, leading
+		}
+
+		By("electing the first replica")
+		stopFirst, firstLeading := run(first)
+		Eventually(firstLeading).Should(BeClosed())
+		Expect(first.IsLeader()).To(BeTrue())
+
+		By("keeping the second replica waiting")
+		stopSecond, secondLeading := run(second)
+		DeferCleanup(stopSecond)
+		Consistently(secondLeading, 4*time.Second).ShouldNot(BeClosed())
+
+		By("electing the second replica once the first stops")
+		stopFirst()
+		Eventually(secondLeading).Should(BeClosed())
+		Eventually(first.IsLeader).Should(BeFalse())
+		Expect(second.IsLeader()).To(BeTrue())
+	})
+})
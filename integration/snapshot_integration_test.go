@@ -0,0 +1,88 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/controllers"
+	"github.com/onmetal/cephlet/pkg/omap"
+	"github.com/onmetal/cephlet/pkg/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/ptr"
+)
+
+var _ = Describe("Snapshot", func() {
+	It("should fail a snapshot with an invalid source and the images waiting on it", func(ctx SpecContext) {
+		snapshots, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Snapshot]{
+			OmapName:       omap.OmapNameOsImages,
+			NewFunc:        func() *api.Snapshot { return &api.Snapshot{} },
+			CreateStrategy: utils.SnapshotStrategy,
+			UpdateStrategy: utils.SnapshotStrategy,
+			Schema:         utils.SnapshotSchema,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		images, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName:       omap.OmapNameVolumes,
+			NewFunc:        func() *api.Image { return &api.Image{} },
+			CreateStrategy: utils.ImageStrategy,
+			UpdateStrategy: utils.ImageStrategy,
+			Schema:         utils.ImageSchema,
+			Indexers:       utils.ImageIndexers,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("creating a snapshot with an invalid source")
+		_, err = snapshots.Create(ctx, &api.Snapshot{
+			Metadata: api.Metadata{ID: "invalid-source"},
+			Source:   api.SnapshotSource{OnmetalImage: "Invalid Reference"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(snapshots.Delete, "invalid-source")
+
+		Eventually(ctx, func() (*api.Snapshot, error) {
+			return snapshots.Get(ctx, "invalid-source")
+		}).Should(SatisfyAll(
+			HaveField("Status.State", api.SnapshotStateFailed),
+			HaveField("Status.FailedAttempts", 1),
+			HaveField("Status.Conditions", ConsistOf(SatisfyAll(
+				HaveField("Type", api.SnapshotConditionReady),
+				HaveField("Status", api.ConditionFalse),
+				HaveField("Reason", controllers.ReasonInvalidImageReference),
+			))),
+		))
+
+		By("creating an image from the failed snapshot")
+		_, err = images.Create(ctx, &api.Image{
+			Metadata: api.Metadata{ID: "from-failed-snapshot"},
+			Spec: api.ImageSpec{
+				Size:        1024 * 1024,
+				SnapshotRef: ptr.To("invalid-source"),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(images.Delete, "from-failed-snapshot")
+
+		Eventually(ctx, func() (*api.Image, error) {
+			return images.Get(ctx, "from-failed-snapshot")
+		}).Should(SatisfyAll(
+			HaveField("Status.State", api.ImageStateError),
+			HaveField("Status.Conditions", ConsistOf(
+				HaveField("Reason", controllers.ReasonSnapshotFailed),
+			)),
+		))
+	})
+})
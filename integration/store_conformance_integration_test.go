@@ -0,0 +1,415 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/encryption"
+	"github.com/onmetal/cephlet/pkg/omap"
+	"github.com/onmetal/cephlet/pkg/schema"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/store/storetest"
+	"github.com/onmetal/cephlet/pkg/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var storeConformanceCounter atomic.Int64
+
+const testShards = 3
+
+// newTestOmapName returns a unique omap name and removes all objects of the
+// store using it when the spec is done.
+func newTestOmapName() string {
+	omapName := fmt.Sprintf("onmetal.test.store-conformance.%d", storeConformanceCounter.Add(1))
+	DeferCleanup(func() {
+		oids := []string{omapName, omapName + ".index"}
+		for shard := 0; shard < testShards; shard++ {
+			oids = append(oids, fmt.Sprintf("%s.shard-%d", omapName, shard), fmt.Sprintf("%s.index.shard-%d", omapName, shard))
+		}
+
+		for _, oid := range oids {
+			if err := ioctx.Delete(oid); err != nil {
+				Expect(err).To(MatchError(rados.ErrNotFound))
+			}
+		}
+	})
+	return omapName
+}
+
+var _ = storetest.DescribeStore("Omap store", func(ctx context.Context) store.Store[*api.Image] {
+	omapName := newTestOmapName()
+
+	s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+		OmapName:       omapName,
+		NewFunc:        storetest.NewFunc,
+		CreateStrategy: storetest.Strategy,
+		UpdateStrategy: storetest.Strategy,
+		Indexers:       storetest.Indexers,
+		WatchQueueSize: storetest.WatchQueueSize,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return s
+})
+
+var _ = storetest.DescribeStore("Sharded omap store", func(ctx context.Context) store.Store[*api.Image] {
+	s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+		OmapName:       newTestOmapName(),
+		Shards:         testShards,
+		NewFunc:        storetest.NewFunc,
+		CreateStrategy: storetest.Strategy,
+		UpdateStrategy: storetest.Strategy,
+		Indexers:       storetest.Indexers,
+		WatchQueueSize: storetest.WatchQueueSize,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return s
+})
+
+var _ = Describe("Omap store resharding", func() {
+	It("should move the entries of an unsharded store to shards", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		unsharded, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: omapName,
+			NewFunc:  storetest.NewFunc,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 10; i++ {
+			_, err := unsharded.Create(ctx, &api.Image{Metadata: api.Metadata{ID: strconv.Itoa(i)}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		sharded, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: omapName,
+			Shards:   testShards,
+			NewFunc:  storetest.NewFunc,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("reading and updating entries before resharding")
+		obj, err := sharded.Get(ctx, "0")
+		Expect(err).NotTo(HaveOccurred())
+		obj.Spec.Size = 2048
+		_, err = sharded.Update(ctx, obj)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sharded.Delete(ctx, "1")).To(Succeed())
+		Expect(sharded.List(ctx)).To(HaveLen(9))
+
+		By("rejecting the unsharded layout afterwards")
+		stale, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: omapName,
+			NewFunc:  storetest.NewFunc,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = stale.Get(ctx, "0")
+		Expect(err).To(HaveOccurred())
+
+		By("resharding")
+		Expect(sharded.Reshard(ctx)).To(Equal(8))
+		Expect(sharded.Reshard(ctx)).To(Equal(0))
+
+		head, err := ioctx.GetOmapValues(omapName, "", "", 100)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(head).To(BeEmpty())
+
+		objs, err := sharded.List(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs).To(HaveLen(9))
+		Expect(objs[0].Spec.Size).To(BeEquivalentTo(2048))
+	})
+})
+
+var _ = Describe("Omap store watch", func() {
+	It("should deliver events of other stores on the same omap object", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		newStore := func() *omap.Store[*api.Image] {
+			s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+				OmapName: omapName,
+				NewFunc:  storetest.NewFunc,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return s
+		}
+		watched, writer := newStore(), newStore()
+
+		w, err := watched.Watch(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(w.Stop)
+
+		By("creating an object through the other store")
+		_, err = writer.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "foo"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(w.Events()).Should(Receive(SatisfyAll(
+			HaveField("Type", store.WatchEventTypeCreated),
+			HaveField("Object.ID", "foo"),
+		)))
+	})
+
+	It("should let watches relist on notifications dropped by other stores", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		watched, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: omapName,
+			NewFunc:  storetest.NewFunc,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(watched.Close)
+
+		w, err := watched.Watch(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(w.Stop)
+
+		_, _, err = ioctx.NotifyWithTimeout(omapName, []byte(`{"source":"other","overflow":true}`), 5*time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(w.Overflow()).Should(Receive())
+	})
+
+	It("should stop notifying once closed", func(ctx SpecContext) {
+		s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: newTestOmapName(),
+			NewFunc:  storetest.NewFunc,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = s.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "foo"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		s.Close()
+		s.Close()
+	})
+})
+
+var _ = Describe("Omap store concurrent writes", func() {
+	It("should commit concurrent updates of different objects", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		const updates = 20
+		var wg sync.WaitGroup
+		for _, id := range []string{"foo", "bar"} {
+			// Each writer has its own store, like separate processes.
+			s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+				OmapName: omapName,
+				NewFunc:  storetest.NewFunc,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			obj, err := s.Create(ctx, &api.Image{Metadata: api.Metadata{ID: id}})
+			Expect(err).NotTo(HaveOccurred())
+
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := 1; i <= updates; i++ {
+					obj.Spec.Size = uint64(i)
+					_, err := s.Update(ctx, obj)
+					Expect(err).NotTo(HaveOccurred())
+				}
+			}()
+		}
+		wg.Wait()
+
+		s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: omapName,
+			NewFunc:  storetest.NewFunc,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		objs, err := s.List(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objs).To(ConsistOf(
+			HaveField("Spec.Size", BeEquivalentTo(updates)),
+			HaveField("Spec.Size", BeEquivalentTo(updates)),
+		))
+	})
+})
+
+var _ = Describe("Omap store index", func() {
+	It("should keep the index of an object updated concurrently by several stores", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		newStore := func() *omap.Store[*api.Image] {
+			s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+				OmapName: omapName,
+				NewFunc:  storetest.NewFunc,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(s.Close)
+			return s
+		}
+		stores := []*omap.Store[*api.Image]{newStore(), newStore()}
+
+		_, err := stores[0].Create(ctx, &api.Image{Metadata: api.Metadata{ID: "foo"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		var wg sync.WaitGroup
+		for i, s := range stores {
+			i, s := i, s
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for n := 0; n < 20; n++ {
+					Eventually(ctx, func() error {
+						obj, err := s.Get(ctx, "foo")
+						if err != nil {
+							return err
+						}
+						obj.Labels = map[string]string{"writer": strconv.Itoa(i), "n": strconv.Itoa(n)}
+						_, err = s.Update(ctx, obj)
+						return err
+					}).Should(Succeed())
+				}
+			}()
+		}
+		wg.Wait()
+
+		obj, err := stores[0].Get(ctx, "foo")
+		Expect(err).NotTo(HaveOccurred())
+		sel := labels.SelectorFromSet(obj.Labels)
+		Expect(stores[0].List(ctx, store.MatchingLabelSelector{Selector: sel})).To(ConsistOf(HaveField("ID", "foo")))
+	})
+})
+
+var _ = Describe("Omap store schema", func() {
+	It("should convert and migrate objects written with an older schema version", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName: omapName,
+			NewFunc:  storetest.NewFunc,
+			Schema:   utils.ImageSchema,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("writing an unversioned object")
+		Expect(ioctx.SetOmap(omapName, map[string][]byte{
+			"foo": []byte(`{"metadata":{"id":"foo","resourceVersion":1},"spec":{"size":1024}}`),
+		})).To(Succeed())
+
+		obj, err := s.Get(ctx, "foo")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.SchemaVersion).To(Equal(utils.ImageSchema.LatestVersion()))
+		Expect(obj.Spec.Size).To(BeEquivalentTo(1024))
+
+		By("migrating the store")
+		Expect(s.Migrate(ctx, true)).To(ConsistOf("foo"))
+		Expect(s.Migrate(ctx, false)).To(ConsistOf("foo"))
+		Expect(s.Migrate(ctx, false)).To(BeEmpty())
+
+		values, err := ioctx.GetOmapValues(omapName, "", "foo", 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(schema.Version(values["foo"])).To(Equal(utils.ImageSchema.LatestVersion()))
+	})
+})
+
+var _ = Describe("Omap store backup", func() {
+	It("should import exported entries and report conflicts", func(ctx SpecContext) {
+		newStore := func() *omap.Store[*api.Image] {
+			s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+				OmapName: newTestOmapName(),
+				NewFunc:  storetest.NewFunc,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return s
+		}
+		source, target := newStore(), newStore()
+
+		_, err := source.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "foo"}})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = source.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "bar"}})
+		Expect(err).NotTo(HaveOccurred())
+		current, err := target.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "foo"}})
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			current, err = target.Update(ctx, current)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		entries, err := source.Export(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+
+		By("reporting conflicts in a dry run")
+		Expect(target.Import(ctx, entries, omap.ImportOptions{DryRun: true})).To(ConsistOf("foo"))
+		Expect(target.List(ctx)).To(HaveLen(1))
+
+		By("rejecting conflicts unless overwriting")
+		_, err = target.Import(ctx, entries, omap.ImportOptions{})
+		Expect(err).To(MatchError(store.ErrAlreadyExists))
+		Expect(target.Import(ctx, entries, omap.ImportOptions{Overwrite: true})).To(ConsistOf("foo"))
+		Expect(target.List(ctx)).To(HaveLen(2))
+
+		By("advancing the resource version of overwritten entries")
+		Expect(target.Get(ctx, "foo")).To(HaveField("ResourceVersion", BeNumerically(">", current.ResourceVersion)))
+	})
+})
+
+var _ = Describe("Omap store sensitive fields", func() {
+	It("should seal sensitive fields and migrate plaintext ones", func(ctx SpecContext) {
+		omapName := newTestOmapName()
+
+		kekPath := filepath.Join(GinkgoT().TempDir(), "kek")
+		Expect(os.WriteFile(kekPath, []byte("abcjdkekakakakakakakkadfkkasfdks"), 0600)).To(Succeed())
+		encryptor, err := encryption.NewAesGcmEncryptor(kekPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		s, err := omap.New(radosConn, cephPoolname, omap.Options[*api.Image]{
+			OmapName:        omapName,
+			NewFunc:         storetest.NewFunc,
+			SensitiveFields: utils.ImageSensitiveFields,
+			Encryptor:       encryptor,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("writing a sealed object")
+		_, err = s.Create(ctx, &api.Image{
+			Metadata: api.Metadata{ID: "foo"},
+			Status:   api.ImageStatus{Access: &api.ImageAccess{UserKey: "secret"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		values, err := ioctx.GetOmapValues(omapName, "", "foo", 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(values["foo"])).NotTo(ContainSubstring("secret"))
+		Expect(s.Get(ctx, "foo")).To(HaveField("Status.Access.UserKey", "secret"))
+
+		By("reading and migrating a plaintext object")
+		Expect(ioctx.SetOmap(omapName, map[string][]byte{
+			"bar": []byte(`{"metadata":{"id":"bar","resourceVersion":1},"status":{"access":{"userKey":"secret"}}}`),
+		})).To(Succeed())
+		Expect(s.Get(ctx, "bar")).To(HaveField("Status.Access.UserKey", "secret"))
+
+		Expect(s.Migrate(ctx, false)).To(ConsistOf("bar"))
+		values, err = ioctx.GetOmapValues(omapName, "", "bar", 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(values["bar"])).NotTo(ContainSubstring("secret"))
+		Expect(s.Get(ctx, "bar")).To(HaveField("Status.Access.UserKey", "secret"))
+	})
+})
@@ -21,6 +21,7 @@ import (
 
 	"github.com/onmetal/cephlet/ori/volume/apiutils"
 	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/controllers"
 	"github.com/onmetal/cephlet/pkg/omap"
 	metav1alpha1 "github.com/onmetal/onmetal-api/ori/apis/meta/v1alpha1"
 	oriv1alpha1 "github.com/onmetal/onmetal-api/ori/apis/volume/v1alpha1"
@@ -222,4 +223,58 @@ var _ = Describe("Create Volume", func() {
 			)),
 		))
 	})
+
+	It("should report a volume with an invalid image reference as failed", func(ctx SpecContext) {
+		By("creating a volume")
+		createResp, err := volumeClient.CreateVolume(ctx, &oriv1alpha1.CreateVolumeRequest{
+			Volume: &oriv1alpha1.Volume{
+				Metadata: &metav1alpha1.ObjectMetadata{
+					Id: "foo",
+				},
+				Spec: &oriv1alpha1.VolumeSpec{
+					Class: "foo",
+					Image: "Invalid Reference",
+					Resources: &oriv1alpha1.VolumeResources{
+						StorageBytes: 1024 * 1024 * 1024,
+					},
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		DeferCleanup(volumeClient.DeleteVolume, &oriv1alpha1.DeleteVolumeRequest{
+			VolumeId: createResp.Volume.Metadata.Id,
+		})
+
+		By("ensuring the image is in the error state with a reason")
+		image := &api.Image{}
+		Eventually(ctx, func() *api.Image {
+			oMap, err := ioctx.GetOmapValues(omap.OmapNameVolumes, "", createResp.Volume.Metadata.Id, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(oMap).To(HaveKey(createResp.Volume.Metadata.Id))
+			Expect(json.Unmarshal(oMap[createResp.Volume.Metadata.Id], image)).NotTo(HaveOccurred())
+			return image
+		}).Should(SatisfyAll(
+			HaveField("Status.State", Equal(api.ImageStateError)),
+			HaveField("Status.Conditions", ConsistOf(SatisfyAll(
+				HaveField("Type", api.ImageConditionReady),
+				HaveField("Status", api.ConditionFalse),
+				HaveField("Reason", controllers.ReasonInvalidImageReference),
+				HaveField("Message", Not(BeEmpty())),
+				HaveField("LastTransitionTime", Not(BeZero())),
+			))),
+		))
+
+		By("ensuring the volume is reported as failed")
+		Eventually(func() *oriv1alpha1.VolumeStatus {
+			resp, err := volumeClient.ListVolumes(ctx, &oriv1alpha1.ListVolumesRequest{
+				Filter: &oriv1alpha1.VolumeFilter{
+					Id: createResp.Volume.Metadata.Id,
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Volumes).NotTo(BeEmpty())
+			return resp.Volumes[0].Status
+		}).Should(HaveField("State", Equal(oriv1alpha1.VolumeState_VOLUME_ERROR)))
+	})
 })
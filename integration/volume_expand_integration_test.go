@@ -142,6 +142,7 @@ var _ = Describe("Expand Volume", func() {
 		}).Should(SatisfyAll(
 			HaveField("Metadata.ID", Equal(createResp.Volume.Metadata.Id)),
 			HaveField("Metadata.Labels", HaveKeyWithValue(apiutils.ClassLabel, "foo")),
+			HaveField("Metadata.Generation", BeEquivalentTo(2)),
 			HaveField("Spec.Image", Equal("")),
 			HaveField("Spec.Size", Equal(uint64(2048*2048*2048))),
 			HaveField("Spec.Limits", SatisfyAll(
@@ -159,6 +160,7 @@ var _ = Describe("Expand Volume", func() {
 				HaveField("Type", api.EncryptionTypeUnencrypted),
 			)),
 			HaveField("Status.State", Equal(api.ImageStateAvailable)),
+			HaveField("Status.ObservedGeneration", BeEquivalentTo(2)),
 			HaveField("Status.Access", SatisfyAll(
 				HaveField("Monitors", cephMonitors),
 				HaveField("Handle", fmt.Sprintf("%s/%s", cephPoolname, "img_"+createResp.Volume.Metadata.Id)),
@@ -16,25 +16,35 @@ package app
 
 import (
 	"context"
+	"errors"
 	goflag "flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/ceph/go-ceph/rados"
 	"github.com/onmetal/cephlet/ori/volume/server"
 	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/audit"
 	"github.com/onmetal/cephlet/pkg/ceph"
 	"github.com/onmetal/cephlet/pkg/controllers"
 	"github.com/onmetal/cephlet/pkg/encryption"
 	"github.com/onmetal/cephlet/pkg/event"
+	"github.com/onmetal/cephlet/pkg/leaderelection"
 	"github.com/onmetal/cephlet/pkg/omap"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/store/cache"
 	"github.com/onmetal/cephlet/pkg/utils"
 	"github.com/onmetal/cephlet/pkg/vcr"
 	"github.com/onmetal/onmetal-api/broker/common"
 	ori "github.com/onmetal/onmetal-api/ori/apis/volume/v1alpha1"
 	"github.com/onmetal/onmetal-image/oci/remote"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"google.golang.org/grpc"
@@ -43,11 +53,76 @@ import (
 )
 
 type Options struct {
-	Address string
+	Address        string
+	MetricsAddress string
 
 	PathSupportedVolumeClasses string
 
-	Ceph CephOptions
+	Ceph           CephOptions
+	Store          StoreOptions
+	LeaderElection LeaderElectionOptions
+	Reconciler     ReconcilerOptions
+	OrphanSweeper  OrphanSweeperOptions
+	Audit          AuditOptions
+	URLSource      URLSourceOptions
+}
+
+type ReconcilerOptions struct {
+	ImageWorkers    int
+	SnapshotWorkers int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	QPS             float64
+	Burst           int
+	MaxRetries      int
+	DrainTimeout    time.Duration
+
+	SnapshotMaxAttempts         int
+	SnapshotFailedRetryInterval time.Duration
+	SnapshotProgressInterval    time.Duration
+	SnapshotCheckpointInterval  time.Duration
+}
+
+func (o *ReconcilerOptions) runnerOptions(workers int) controllers.RunnerOptions {
+	return controllers.RunnerOptions{
+		Workers:      workers,
+		BaseDelay:    o.BaseDelay,
+		MaxDelay:     o.MaxDelay,
+		QPS:          o.QPS,
+		Burst:        o.Burst,
+		MaxRetries:   o.MaxRetries,
+		DrainTimeout: o.DrainTimeout,
+	}
+}
+
+type AuditOptions struct {
+	Retention time.Duration
+}
+
+type URLSourceOptions struct {
+	AllowedHosts []string
+	AllowHTTP    bool
+}
+
+type OrphanSweeperOptions struct {
+	Interval    time.Duration
+	GracePeriod time.Duration
+	Delete      bool
+}
+
+type LeaderElectionOptions struct {
+	Enabled       bool
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+type StoreOptions struct {
+	WatchQueueSize int
+	ListPageSize   int64
+	Shards         int
+	Cache          bool
 }
 
 type CephOptions struct {
@@ -63,7 +138,10 @@ type CephOptions struct {
 	BurstFactor            int64
 	BurstDurationInSeconds int64
 
-	PopulatorBufferSize int64
+	PopulatorBufferSize     int64
+	PopulatorConcurrency    int
+	PopulatorSpoolDir       string
+	PopulatorSpoolSizeLimit int64
 
 	KeyEncryptionKeyPath string
 }
@@ -73,10 +151,32 @@ func (o *Options) Defaults() {
 	o.Ceph.BurstFactor = 10
 	o.Ceph.BurstDurationInSeconds = 15
 	o.Ceph.PopulatorBufferSize = 5 * 1024 * 1024
+	o.Ceph.PopulatorConcurrency = 4
+	o.Store.WatchQueueSize = store.DefaultWatchQueueSize
+	o.Store.ListPageSize = store.DefaultListPageSize
+	o.Store.Cache = true
+	o.LeaderElection.LeaseDuration = 15 * time.Second
+	o.LeaderElection.RenewDeadline = 10 * time.Second
+	o.LeaderElection.RetryPeriod = 2 * time.Second
+	o.Reconciler.ImageWorkers = 15
+	o.Reconciler.SnapshotWorkers = 15
+	o.Reconciler.BaseDelay = 5 * time.Millisecond
+	o.Reconciler.MaxDelay = 1000 * time.Second
+	o.Reconciler.QPS = 10
+	o.Reconciler.Burst = 100
+	o.Reconciler.DrainTimeout = 30 * time.Second
+	o.Reconciler.SnapshotMaxAttempts = 5
+	o.Reconciler.SnapshotFailedRetryInterval = 1 * time.Hour
+	o.Reconciler.SnapshotProgressInterval = 10 * time.Second
+	o.Reconciler.SnapshotCheckpointInterval = 30 * time.Second
+	o.OrphanSweeper.Interval = 10 * time.Minute
+	o.OrphanSweeper.GracePeriod = 24 * time.Hour
+	o.Audit.Retention = 30 * 24 * time.Hour
 }
 
 func (o *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&o.Address, "address", "/var/run/cephlet-volume.sock", "Address to listen on.")
+	fs.StringVar(&o.MetricsAddress, "metrics-address", o.MetricsAddress, "Address to serve metrics on. Metrics are not served if empty.")
 
 	fs.StringVar(&o.PathSupportedVolumeClasses, "supported-volume-classes", o.PathSupportedVolumeClasses, "File containing supported volume classes.")
 
@@ -84,15 +184,62 @@ func (o *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.Int64Var(&o.Ceph.BurstDurationInSeconds, "limits-burst-duration", o.Ceph.BurstDurationInSeconds, "Defines the burst duration in seconds.")
 
 	fs.Int64Var(&o.Ceph.PopulatorBufferSize, "populator-buffer-size", o.Ceph.PopulatorBufferSize, "Defines the buffer size (in bytes) which is used for downloading a image.")
+	fs.IntVar(&o.Ceph.PopulatorConcurrency, "populator-concurrency", o.Ceph.PopulatorConcurrency, "Defines the number of buffers written to an image in parallel while populating it.")
+	fs.StringVar(&o.Ceph.PopulatorSpoolDir, "populator-spool-dir", o.Ceph.PopulatorSpoolDir, "Directory qcow2 images are spooled to while converting them. Defaults to the temporary directory.")
+	fs.Int64Var(&o.Ceph.PopulatorSpoolSizeLimit, "populator-spool-size-limit", o.Ceph.PopulatorSpoolSizeLimit, "Maximum size (in bytes) of a spooled qcow2 image. Zero for no limit.")
 
-	fs.StringVar(&o.Ceph.Monitors, "ceph-monitors", o.Ceph.Monitors, "Ceph Monitors to connect to.")
-	fs.DurationVar(&o.Ceph.ConnectTimeout, "ceph-connect-timeout", o.Ceph.ConnectTimeout, "Connect timeout for establishing a connection to ceph.")
-	fs.StringVar(&o.Ceph.User, "ceph-user", o.Ceph.User, "Ceph User.")
-	fs.StringVar(&o.Ceph.KeyFile, "ceph-key-file", o.Ceph.KeyFile, "ceph-key-file or ceph-keyring-file must be provided (ceph-key-file has precedence). ceph-key-file contains contains only the ceph key.")
-	fs.StringVar(&o.Ceph.KeyringFile, "ceph-keyring-file", o.Ceph.KeyringFile, "ceph-key-file or ceph-keyring-file must be provided (ceph-key-file has precedence)s. ceph-keyring-file contains the ceph key and client information.")
-	fs.StringVar(&o.Ceph.Pool, "ceph-pool", o.Ceph.Pool, "Ceph pool which is used to store objects.")
+	o.Ceph.AddConnectionFlags(fs)
 	fs.StringVar(&o.Ceph.Client, "ceph-client", o.Ceph.Client, "Ceph client which grants access to pools/images eg. 'client.volumes'")
-	fs.StringVar(&o.Ceph.KeyEncryptionKeyPath, "ceph-kek-path", o.Ceph.KeyEncryptionKeyPath, "path to the key encryption key file (32 Bit - KEK) to encrypt volume keys.")
+	o.Ceph.AddKeyEncryptionKeyFlag(fs)
+
+	fs.IntVar(&o.Store.WatchQueueSize, "store-watch-queue-size", o.Store.WatchQueueSize, "Number of store events buffered per watch before a relist is triggered.")
+	fs.Int64Var(&o.Store.ListPageSize, "store-list-page-size", o.Store.ListPageSize, "Number of objects read from a store at once when listing.")
+	fs.IntVar(&o.Store.Shards, "store-shards", o.Store.Shards, "Number of rados objects the entries of a store are spread over. Existing entries are moved to the shards in the background. All replicas have to use the same number of shards.")
+	fs.BoolVar(&o.Store.Cache, "store-cache", o.Store.Cache, "Serve reads of the server from an in-memory cache kept current through store watches.")
+
+	fs.BoolVar(&o.LeaderElection.Enabled, "leader-elect", o.LeaderElection.Enabled, "Only run the reconcilers on the replica holding the leader lease. Required when running more than one replica against the same pool.")
+	fs.StringVar(&o.LeaderElection.Identity, "leader-elect-identity", o.LeaderElection.Identity, "Identity of this replica in leader election. Defaults to the hostname with a random suffix.")
+	fs.DurationVar(&o.LeaderElection.LeaseDuration, "leader-elect-lease-duration", o.LeaderElection.LeaseDuration, "Duration after which the leader lease expires unless renewed.")
+	fs.DurationVar(&o.LeaderElection.RenewDeadline, "leader-elect-renew-deadline", o.LeaderElection.RenewDeadline, "Duration the leader tries to renew its lease before giving up leadership.")
+	fs.DurationVar(&o.LeaderElection.RetryPeriod, "leader-elect-retry-period", o.LeaderElection.RetryPeriod, "Duration between attempts to acquire or renew the leader lease.")
+
+	fs.IntVar(&o.Reconciler.ImageWorkers, "image-reconciler-workers", o.Reconciler.ImageWorkers, "Number of images reconciled concurrently.")
+	fs.IntVar(&o.Reconciler.SnapshotWorkers, "snapshot-reconciler-workers", o.Reconciler.SnapshotWorkers, "Number of snapshots reconciled concurrently.")
+	fs.DurationVar(&o.Reconciler.BaseDelay, "reconciler-base-delay", o.Reconciler.BaseDelay, "Initial delay before a failed reconciliation is retried. Doubles with every failure.")
+	fs.DurationVar(&o.Reconciler.MaxDelay, "reconciler-max-delay", o.Reconciler.MaxDelay, "Maximum delay before a failed reconciliation is retried.")
+	fs.Float64Var(&o.Reconciler.QPS, "reconciler-qps", o.Reconciler.QPS, "Overall rate of retried reconciliations per second and reconciler.")
+	fs.IntVar(&o.Reconciler.Burst, "reconciler-burst", o.Reconciler.Burst, "Number of retried reconciliations allowed to exceed the rate.")
+	fs.IntVar(&o.Reconciler.MaxRetries, "reconciler-max-retries", o.Reconciler.MaxRetries, "Number of retries after which a failing image is dropped until its next change. Zero retries without limit. Snapshots are bounded by --snapshot-max-attempts instead.")
+	fs.DurationVar(&o.Reconciler.DrainTimeout, "reconciler-drain-timeout", o.Reconciler.DrainTimeout, "Time in-flight reconciliations are given to finish on shutdown.")
+	fs.IntVar(&o.Reconciler.SnapshotMaxAttempts, "snapshot-max-attempts", o.Reconciler.SnapshotMaxAttempts, "Number of failed attempts to populate a snapshot after which it is marked as failed.")
+	fs.DurationVar(&o.Reconciler.SnapshotFailedRetryInterval, "snapshot-failed-retry-interval", o.Reconciler.SnapshotFailedRetryInterval, "Interval after which a snapshot that ran out of attempts is populated again.")
+	fs.DurationVar(&o.Reconciler.SnapshotProgressInterval, "snapshot-progress-interval", o.Reconciler.SnapshotProgressInterval, "Interval in which the progress of populating a snapshot is recorded in its status.")
+	fs.DurationVar(&o.Reconciler.SnapshotCheckpointInterval, "snapshot-checkpoint-interval", o.Reconciler.SnapshotCheckpointInterval, "Interval in which a checkpoint to resume populating a snapshot from after a restart is recorded.")
+
+	fs.DurationVar(&o.OrphanSweeper.Interval, "orphan-sweep-interval", o.OrphanSweeper.Interval, "Interval in which rbd images are compared with the stores to find orphans.")
+	fs.DurationVar(&o.OrphanSweeper.GracePeriod, "orphan-grace-period", o.OrphanSweeper.GracePeriod, "Minimum age of an orphaned rbd image before it is deleted.")
+	fs.BoolVar(&o.OrphanSweeper.Delete, "orphan-delete", o.OrphanSweeper.Delete, "Delete orphaned rbd images older than the grace period instead of only reporting them.")
+
+	fs.DurationVar(&o.Audit.Retention, "audit-retention", o.Audit.Retention, "Duration the audit journal of image and snapshot mutations is kept for.")
+
+	fs.StringSliceVar(&o.URLSource.AllowedHosts, "url-source-allowed-hosts", o.URLSource.AllowedHosts, "Host names, IPs and CIDRs disk images may be downloaded from over HTTP(S). A host name starting with a dot allows its subdomains. Url images are rejected if empty.")
+	fs.BoolVar(&o.URLSource.AllowHTTP, "url-source-allow-http", o.URLSource.AllowHTTP, "Allow downloading disk images over plain http.")
+}
+
+// AddConnectionFlags adds the flags required to connect to the ceph pool.
+func (o *CephOptions) AddConnectionFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Monitors, "ceph-monitors", o.Monitors, "Ceph Monitors to connect to.")
+	fs.DurationVar(&o.ConnectTimeout, "ceph-connect-timeout", o.ConnectTimeout, "Connect timeout for establishing a connection to ceph.")
+	fs.StringVar(&o.User, "ceph-user", o.User, "Ceph User.")
+	fs.StringVar(&o.KeyFile, "ceph-key-file", o.KeyFile, "ceph-key-file or ceph-keyring-file must be provided (ceph-key-file has precedence). ceph-key-file contains contains only the ceph key.")
+	fs.StringVar(&o.KeyringFile, "ceph-keyring-file", o.KeyringFile, "ceph-key-file or ceph-keyring-file must be provided (ceph-key-file has precedence)s. ceph-keyring-file contains the ceph key and client information.")
+	fs.StringVar(&o.Pool, "ceph-pool", o.Pool, "Ceph pool which is used to store objects.")
+}
+
+// AddKeyEncryptionKeyFlag adds the flag for the key encryption key that
+// sensitive fields are sealed with.
+func (o *CephOptions) AddKeyEncryptionKeyFlag(fs *pflag.FlagSet) {
+	fs.StringVar(&o.KeyEncryptionKeyPath, "ceph-kek-path", o.KeyEncryptionKeyPath, "path to the key encryption key file (32 Bit - KEK) to encrypt volume keys.")
 }
 
 func (o *Options) MarkFlagsRequired(cmd *cobra.Command) {
@@ -128,6 +275,13 @@ func Command() *cobra.Command {
 	opts.AddFlags(cmd.Flags())
 	opts.MarkFlagsRequired(cmd)
 
+	cmd.AddCommand(
+		MigrateCommand(),
+		StoreCommand(),
+		AuditCommand(),
+		SnapshotsCommand(),
+	)
+
 	return cmd
 }
 
@@ -164,6 +318,33 @@ func configureCephAuth(opts *CephOptions) (func() error, error) {
 	return cleanup, nil
 }
 
+func newImageStore(conn *rados.Conn, pool string, opts StoreOptions, encryptor encryption.Encryptor) (*omap.Store[*api.Image], error) {
+	return omap.New(conn, pool, omap.Options[*api.Image]{
+		OmapName:        omap.OmapNameVolumes,
+		NewFunc:         func() *api.Image { return &api.Image{} },
+		CreateStrategy:  utils.ImageStrategy,
+		UpdateStrategy:  utils.ImageStrategy,
+		Shards:          opts.Shards,
+		Schema:          utils.ImageSchema,
+		Indexers:        utils.ImageIndexers,
+		SensitiveFields: utils.ImageSensitiveFields,
+		Encryptor:       encryptor,
+		WatchQueueSize:  opts.WatchQueueSize,
+	})
+}
+
+func newSnapshotStore(conn *rados.Conn, pool string, opts StoreOptions) (*omap.Store[*api.Snapshot], error) {
+	return omap.New(conn, pool, omap.Options[*api.Snapshot]{
+		OmapName:       omap.OmapNameOsImages,
+		NewFunc:        func() *api.Snapshot { return &api.Snapshot{} },
+		CreateStrategy: utils.SnapshotStrategy,
+		UpdateStrategy: utils.SnapshotStrategy,
+		Shards:         opts.Shards,
+		Schema:         utils.SnapshotSchema,
+		WatchQueueSize: opts.WatchQueueSize,
+	})
+}
+
 func Run(ctx context.Context, opts Options) error {
 	log := ctrl.LoggerFrom(ctx)
 	setupLog := log.WithName("setup")
@@ -202,118 +383,310 @@ func Run(ctx context.Context, opts Options) error {
 		return fmt.Errorf("configuration invalid: %w", err)
 	}
 
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
 	setupLog.Info("Configuring image store", "OmapName", omap.OmapNameVolumes)
-	imageStore, err := omap.New(conn, opts.Ceph.Pool, omap.Options[*api.Image]{
-		OmapName:       omap.OmapNameVolumes,
-		NewFunc:        func() *api.Image { return &api.Image{} },
-		CreateStrategy: utils.ImageStrategy,
-	})
+	imageStore, err := newImageStore(conn, opts.Ceph.Pool, opts.Store, encryptor)
 	if err != nil {
 		return fmt.Errorf("failed to initialize image store: %w", err)
 	}
+	defer imageStore.Close()
 
 	imageEvents, err := event.NewListWatchSource[*api.Image](
-		imageStore.List,
+		imageStore.ListPage,
 		imageStore.Watch,
-		event.ListWatchSourceOptions{},
+		event.ListWatchSourceOptions{
+			PageSize: opts.Store.ListPageSize,
+		},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to initialize image events: %w", err)
 	}
 
 	setupLog.Info("Configuring snapshot store", "OmapName", omap.OmapNameOsImages)
-	snapshotStore, err := omap.New(conn, opts.Ceph.Pool, omap.Options[*api.Snapshot]{
-		OmapName:       omap.OmapNameOsImages,
-		NewFunc:        func() *api.Snapshot { return &api.Snapshot{} },
-		CreateStrategy: utils.SnapshotStrategy,
-	})
+	snapshotStore, err := newSnapshotStore(conn, opts.Ceph.Pool, opts.Store)
 	if err != nil {
 		return fmt.Errorf("failed to initialize snapshot store: %w", err)
 	}
+	defer snapshotStore.Close()
 
 	snapshotEvents, err := event.NewListWatchSource[*api.Snapshot](
-		snapshotStore.List,
+		snapshotStore.ListPage,
 		snapshotStore.Watch,
-		event.ListWatchSourceOptions{},
+		event.ListWatchSourceOptions{
+			PageSize: opts.Store.ListPageSize,
+		},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to initialize snapshot events: %w", err)
 	}
 
+	imageJournal, err := newImageJournal(conn, opts.Ceph.Pool, opts.Audit)
+	if err != nil {
+		return fmt.Errorf("failed to initialize image journal: %w", err)
+	}
+
+	auditedImages, err := audit.NewStore[*api.Image](imageStore, imageJournal, audit.Options[*api.Image]{
+		SpecFunc: func(obj *api.Image) interface{} { return obj.Spec },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize audited image store: %w", err)
+	}
+
+	snapshotJournal, err := newSnapshotJournal(conn, opts.Ceph.Pool, opts.Audit)
+	if err != nil {
+		return fmt.Errorf("failed to initialize snapshot journal: %w", err)
+	}
+
+	auditedSnapshots, err := audit.NewStore[*api.Snapshot](snapshotStore, snapshotJournal, audit.Options[*api.Snapshot]{
+		SpecFunc: func(obj *api.Snapshot) interface{} { return obj.Source },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize audited snapshot store: %w", err)
+	}
+
 	reg, err := remote.DockerRegistry(nil)
 	if err != nil {
 		return fmt.Errorf("failed to initialize docker registry: %w", err)
 	}
 
+	urlSourcePolicy, err := controllers.NewURLSourcePolicy(opts.URLSource.AllowedHosts, opts.URLSource.AllowHTTP)
+	if err != nil {
+		return fmt.Errorf("failed to initialize url source policy: %w", err)
+	}
+
 	imageReconciler, err := controllers.NewImageReconciler(
 		log.WithName("image-reconciler"),
 		conn,
 		reg,
-		imageStore, snapshotStore,
+		auditedImages, auditedSnapshots,
 		imageEvents,
 		snapshotEvents,
 		encryptor,
 		controllers.ImageReconcilerOptions{
-			Monitors: opts.Ceph.Monitors,
-			Client:   opts.Ceph.Client,
-			Pool:     opts.Ceph.Pool,
+			Monitors:        opts.Ceph.Monitors,
+			Client:          opts.Ceph.Client,
+			Pool:            opts.Ceph.Pool,
+			URLSourcePolicy: urlSourcePolicy,
+			Runner:          opts.Reconciler.runnerOptions(opts.Reconciler.ImageWorkers),
 		},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to initialize image reconciler: %w", err)
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		setupLog.Info("Starting image reconciler")
-		if err := imageReconciler.Start(ctx); err != nil {
-			log.Error(err, "failed to start image reconciler")
-		}
-	}()
+	// Snapshots have their own attempt budget (--snapshot-max-attempts) after
+	// which they are moved to Failed, so the runner must not drop them earlier.
+	snapshotRunnerOptions := opts.Reconciler.runnerOptions(opts.Reconciler.SnapshotWorkers)
+	snapshotRunnerOptions.MaxRetries = 0
 
 	snapshotReconciler, err := controllers.NewSnapshotReconciler(
 		log.WithName("snapshot-reconciler"),
 		conn,
 		reg,
-		snapshotStore,
+		auditedSnapshots,
 		snapshotEvents,
 		controllers.SnapshotReconcilerOptions{
-			Pool:                opts.Ceph.Pool,
-			PopulatorBufferSize: opts.Ceph.PopulatorBufferSize,
+			Pool:                 opts.Ceph.Pool,
+			PopulatorBufferSize:  opts.Ceph.PopulatorBufferSize,
+			PopulatorConcurrency: opts.Ceph.PopulatorConcurrency,
+			SpoolDir:             opts.Ceph.PopulatorSpoolDir,
+			SpoolSizeLimit:       opts.Ceph.PopulatorSpoolSizeLimit,
+			MaxAttempts:          opts.Reconciler.SnapshotMaxAttempts,
+			FailedRetryInterval:  opts.Reconciler.SnapshotFailedRetryInterval,
+			ProgressStore:        snapshotStore,
+			ProgressInterval:     opts.Reconciler.SnapshotProgressInterval,
+			CheckpointInterval:   opts.Reconciler.SnapshotCheckpointInterval,
+			URLSourcePolicy:      urlSourcePolicy,
+			HTTPClient:           urlSourcePolicy.HTTPClient(),
+			Runner:               snapshotRunnerOptions,
 		},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to initialize snapshot reconciler: %w", err)
 	}
+	metricsRegistry.MustRegister(snapshotReconciler)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		setupLog.Info("Starting snapshot reconciler")
-		if err := snapshotReconciler.Start(ctx); err != nil {
-			log.Error(err, "failed to start snapshot reconciler")
+	orphanSweeper, err := controllers.NewOrphanSweeper(
+		log.WithName("orphan-sweeper"),
+		conn,
+		imageStore,
+		snapshotStore,
+		controllers.OrphanSweeperOptions{
+			Pool:        opts.Ceph.Pool,
+			Interval:    opts.OrphanSweeper.Interval,
+			GracePeriod: opts.OrphanSweeper.GracePeriod,
+			Delete:      opts.OrphanSweeper.Delete,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to initialize orphan sweeper: %w", err)
+	}
+	metricsRegistry.MustRegister(orphanSweeper)
+
+	// runControllers runs everything that must only run on a single replica.
+	// The server writes through the stores, which are safe for concurrent
+	// writers, and the leader picks up those writes from the store watches.
+	runControllers := func(ctx context.Context) {
+		var wg sync.WaitGroup
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Starting image reconciler")
+			if err := imageReconciler.Start(audit.WithMethod(ctx, "ImageReconciler")); err != nil {
+				log.Error(err, "failed to start image reconciler")
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Starting snapshot reconciler")
+			if err := snapshotReconciler.Start(audit.WithMethod(ctx, "SnapshotReconciler")); err != nil {
+				log.Error(err, "failed to start snapshot reconciler")
+			}
+
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Starting image events")
+			if err := imageEvents.Start(ctx); err != nil {
+				log.Error(err, "failed to start image events")
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Starting snapshot events")
+			if err := snapshotEvents.Start(ctx); err != nil {
+				log.Error(err, "failed to start snapshot events")
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Starting orphan sweeper", "Delete", opts.OrphanSweeper.Delete)
+			if err := orphanSweeper.Start(ctx); err != nil {
+				log.Error(err, "failed to start orphan sweeper")
+			}
+		}()
+
+		for _, journal := range []*audit.Journal{imageJournal, snapshotJournal} {
+			journal := journal
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := journal.Start(ctx); err != nil {
+					log.Error(err, "failed to start audit journal trimming")
+				}
+			}()
 		}
 
-	}()
+		if opts.Store.Shards > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				setupLog.Info("Moving store entries to shards", "Shards", opts.Store.Shards)
+				if moved, err := imageStore.Reshard(ctx); err != nil {
+					log.Error(err, "failed to move image store entries to shards")
+				} else {
+					setupLog.Info("Moved image store entries to shards", "Moved", moved)
+				}
+				if moved, err := snapshotStore.Reshard(ctx); err != nil {
+					log.Error(err, "failed to move snapshot store entries to shards")
+				} else {
+					setupLog.Info("Moved snapshot store entries to shards", "Moved", moved)
+				}
+			}()
+		}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		setupLog.Info("Starting image events")
-		if err := imageEvents.Start(ctx); err != nil {
-			log.Error(err, "failed to start image events")
+		wg.Wait()
+	}
+
+	var (
+		serverImages    store.Store[*api.Image]    = auditedImages
+		serverSnapshots store.Store[*api.Snapshot] = auditedSnapshots
+	)
+	if opts.Store.Cache {
+		imageCache, err := cache.New[*api.Image](auditedImages, cache.Options[*api.Image]{
+			Name:         omap.OmapNameVolumes,
+			NewFunc:      func() *api.Image { return &api.Image{} },
+			Indexers:     utils.ImageIndexers,
+			ListPageSize: opts.Store.ListPageSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to initialize image cache: %w", err)
 		}
-	}()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		setupLog.Info("Starting snapshot events")
-		if err := snapshotEvents.Start(ctx); err != nil {
-			log.Error(err, "failed to start snapshot events")
+		snapshotCache, err := cache.New[*api.Snapshot](auditedSnapshots, cache.Options[*api.Snapshot]{
+			Name:         omap.OmapNameOsImages,
+			NewFunc:      func() *api.Snapshot { return &api.Snapshot{} },
+			ListPageSize: opts.Store.ListPageSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to initialize snapshot cache: %w", err)
 		}
-	}()
+
+		for _, c := range []interface {
+			Start(ctx context.Context) error
+		}{imageCache, snapshotCache} {
+			c := c
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.Start(ctx); err != nil {
+					log.Error(err, "failed to start store cache")
+				}
+			}()
+		}
+
+		metricsRegistry.MustRegister(imageCache, snapshotCache)
+		serverImages, serverSnapshots = imageCache, snapshotCache
+	}
+
+	leaderErr := make(chan error, 1)
+	if opts.LeaderElection.Enabled {
+		elector, err := leaderelection.New(conn, opts.Ceph.Pool, leaderelection.Options{
+			Identity:      opts.LeaderElection.Identity,
+			LeaseDuration: opts.LeaderElection.LeaseDuration,
+			RenewDeadline: opts.LeaderElection.RenewDeadline,
+			RetryPeriod:   opts.LeaderElection.RetryPeriod,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to initialize leader election: %w", err)
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Starting leader election", "Identity", elector.Identity())
+			if err := elector.Run(ctx, runControllers); err != nil {
+				// Another replica may already be reconciling, so stop serving
+				// and let this replica be restarted.
+				leaderErr <- fmt.Errorf("leader election failed: %w", err)
+				cancel()
+			}
+		}()
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runControllers(ctx)
+		}()
+	}
 
 	supportedClasses, err := vcr.LoadVolumeClassesFile(opts.PathSupportedVolumeClasses)
 	if err != nil {
@@ -331,20 +704,32 @@ func Run(ctx context.Context, opts Options) error {
 	}
 
 	srv, err := server.New(
-		imageStore,
-		snapshotStore,
+		serverImages,
+		serverSnapshots,
 		classRegistry,
 		encryptor,
 		cephCommandClient,
 		server.Options{
 			BurstFactor:            opts.Ceph.BurstFactor,
 			BurstDurationInSeconds: opts.Ceph.BurstDurationInSeconds,
+			ListPageSize:           opts.Store.ListPageSize,
 		},
 	)
 	if err != nil {
 		return fmt.Errorf("error creating server: %w", err)
 	}
 
+	if opts.MetricsAddress != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setupLog.Info("Serving metrics", "Address", opts.MetricsAddress)
+			if err := serveMetrics(ctx, opts.MetricsAddress, metricsRegistry); err != nil {
+				log.Error(err, "failed to serve metrics")
+			}
+		}()
+	}
+
 	log.V(1).Info("Cleaning up any previous socket")
 	if err := common.CleanupSocketIfExists(opts.Address); err != nil {
 		return fmt.Errorf("error cleaning up socket: %w", err)
@@ -365,6 +750,7 @@ func Run(ctx context.Context, opts Options) error {
 		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 			log := log.WithName(info.FullMethod)
 			ctx = ctrl.LoggerInto(ctx, log)
+			ctx = audit.WithMethod(ctx, info.FullMethod)
 			log.V(1).Info("Request")
 			resp, err = handler(ctx, req)
 			if err != nil {
@@ -387,5 +773,32 @@ func Run(ctx context.Context, opts Options) error {
 	if err := grpcSrv.Serve(l); err != nil {
 		return fmt.Errorf("error serving: %w", err)
 	}
+
+	wg.Wait()
+	select {
+	case err := <-leaderErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+func serveMetrics(ctx context.Context, address string, gatherer prometheus.Gatherer) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
 	return nil
 }
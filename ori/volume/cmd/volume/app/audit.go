@@ -0,0 +1,133 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/onmetal/cephlet/pkg/audit"
+	"github.com/onmetal/cephlet/pkg/omap"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func newImageJournal(conn *rados.Conn, pool string, opts AuditOptions) (*audit.Journal, error) {
+	return audit.NewJournal(conn, pool, audit.JournalOptions{
+		Name:      omap.OmapNameVolumes + ".audit",
+		Retention: opts.Retention,
+	})
+}
+
+func newSnapshotJournal(conn *rados.Conn, pool string, opts AuditOptions) (*audit.Journal, error) {
+	return audit.NewJournal(conn, pool, audit.JournalOptions{
+		Name:      omap.OmapNameOsImages + ".audit",
+		Retention: opts.Retention,
+	})
+}
+
+type AuditCommandOptions struct {
+	Ceph  CephOptions
+	Store string
+	ID    string
+	Since time.Duration
+	Limit int
+}
+
+func (o *AuditCommandOptions) Defaults() {
+	o.Ceph.ConnectTimeout = 10 * time.Second
+	o.Store = storeNameImages
+}
+
+func (o *AuditCommandOptions) AddFlags(fs *pflag.FlagSet) {
+	o.Ceph.AddConnectionFlags(fs)
+
+	fs.StringVar(&o.Store, "store", o.Store, fmt.Sprintf("Store to show the journal of, %s or %s.", storeNameImages, storeNameSnapshots))
+	fs.StringVar(&o.ID, "id", o.ID, "Only show the entries of the object with this id.")
+	fs.DurationVar(&o.Since, "since", o.Since, "Only show the entries recorded within this duration.")
+	fs.IntVar(&o.Limit, "limit", o.Limit, "Maximum number of most recent entries to show.")
+}
+
+func (o *AuditCommandOptions) MarkFlagsRequired(cmd *cobra.Command) {
+	_ = cmd.MarkFlagRequired("ceph-monitors")
+	_ = cmd.MarkFlagRequired("ceph-pool")
+}
+
+func AuditCommand() *cobra.Command {
+	var opts AuditCommandOptions
+
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show the journal of mutations of images or snapshots.",
+		Long: `Show the journal of mutations of images or snapshots.
+
+Every entry is printed as a JSON line, oldest first.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunAudit(cmd.Context(), opts)
+		},
+	}
+
+	opts.Defaults()
+	opts.AddFlags(cmd.Flags())
+	opts.MarkFlagsRequired(cmd)
+
+	return cmd
+}
+
+func RunAudit(ctx context.Context, opts AuditCommandOptions) error {
+	conn, closeConn, err := connect(ctx, opts.Ceph)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	var journal *audit.Journal
+	switch opts.Store {
+	case storeNameImages:
+		journal, err = newImageJournal(conn, opts.Ceph.Pool, AuditOptions{})
+	case storeNameSnapshots:
+		journal, err = newSnapshotJournal(conn, opts.Ceph.Pool, AuditOptions{})
+	default:
+		return fmt.Errorf("unknown store %q", opts.Store)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to initialize journal: %w", err)
+	}
+
+	listOpts := audit.ListOptions{
+		ID:    opts.ID,
+		Limit: opts.Limit,
+	}
+	if opts.Since > 0 {
+		listOpts.Since = time.Now().Add(-opts.Since)
+	}
+
+	entries, err := journal.List(ctx, listOpts)
+	if err != nil {
+		return fmt.Errorf("failed to list journal: %w", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
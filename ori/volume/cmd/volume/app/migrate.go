@@ -0,0 +1,108 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+type MigrateOptions struct {
+	Ceph   CephOptions
+	Store  StoreOptions
+	DryRun bool
+}
+
+func (o *MigrateOptions) Defaults() {
+	o.Ceph.ConnectTimeout = 10 * time.Second
+}
+
+func (o *MigrateOptions) AddFlags(fs *pflag.FlagSet) {
+	o.Ceph.AddConnectionFlags(fs)
+	o.Ceph.AddKeyEncryptionKeyFlag(fs)
+
+	fs.IntVar(&o.Store.Shards, "store-shards", o.Store.Shards, "Number of rados objects the entries of a store are spread over.")
+
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "Only report the objects that would be migrated.")
+}
+
+func (o *MigrateOptions) MarkFlagsRequired(cmd *cobra.Command) {
+	_ = cmd.MarkFlagRequired("ceph-monitors")
+	_ = cmd.MarkFlagRequired("ceph-pool")
+	_ = cmd.MarkFlagRequired("ceph-kek-path")
+}
+
+func MigrateCommand() *cobra.Command {
+	var opts MigrateOptions
+
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Rewrite all stored images and snapshots with the latest schema version.",
+		Long: `Rewrite all stored images and snapshots with the latest schema version.
+
+Objects written with an older schema version are converted whenever they are
+read, so running the migration is only required before converters of old
+versions are dropped. Objects with plaintext sensitive fields are sealed as
+well. It should be run while no cephlet-volume is running against the pool.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunMigrate(cmd.Context(), opts)
+		},
+	}
+
+	opts.Defaults()
+	opts.AddFlags(cmd.Flags())
+	opts.MarkFlagsRequired(cmd)
+
+	return cmd
+}
+
+type migrator interface {
+	Migrate(ctx context.Context, dryRun bool) ([]string, error)
+}
+
+func RunMigrate(ctx context.Context, opts MigrateOptions) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	stores, err := openStores(ctx, opts.Ceph, opts.Store)
+	if err != nil {
+		return err
+	}
+	defer stores.Close()
+
+	for _, s := range []struct {
+		name  string
+		store migrator
+	}{
+		{name: storeNameImages, store: stores.images},
+		{name: storeNameSnapshots, store: stores.snapshots},
+	} {
+		migrated, err := s.store.Migrate(ctx, opts.DryRun)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", s.name, err)
+		}
+
+		log.Info("Migrated store", "Store", s.name, "Objects", len(migrated), "DryRun", opts.DryRun)
+		for _, id := range migrated {
+			log.V(1).Info("Migrated object", "Store", s.name, "ID", id, "DryRun", opts.DryRun)
+		}
+	}
+
+	return nil
+}
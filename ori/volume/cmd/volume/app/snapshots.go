@@ -0,0 +1,119 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+type SnapshotsCommandOptions struct {
+	Ceph  CephOptions
+	Store StoreOptions
+	ID    string
+}
+
+func (o *SnapshotsCommandOptions) Defaults() {
+	o.Ceph.ConnectTimeout = 10 * time.Second
+}
+
+func (o *SnapshotsCommandOptions) AddFlags(fs *pflag.FlagSet) {
+	o.Ceph.AddConnectionFlags(fs)
+
+	fs.IntVar(&o.Store.Shards, "store-shards", o.Store.Shards, "Number of rados objects the entries of a store are spread over.")
+
+	fs.StringVar(&o.ID, "id", o.ID, "Only show the snapshot with this id.")
+}
+
+func (o *SnapshotsCommandOptions) MarkFlagsRequired(cmd *cobra.Command) {
+	_ = cmd.MarkFlagRequired("ceph-monitors")
+	_ = cmd.MarkFlagRequired("ceph-pool")
+}
+
+func SnapshotsCommand() *cobra.Command {
+	var opts SnapshotsCommandOptions
+
+	cmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "Show the state and population progress of snapshots.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunSnapshots(cmd.Context(), opts)
+		},
+	}
+
+	opts.Defaults()
+	opts.AddFlags(cmd.Flags())
+	opts.MarkFlagsRequired(cmd)
+
+	return cmd
+}
+
+func RunSnapshots(ctx context.Context, opts SnapshotsCommandOptions) error {
+	conn, closeConn, err := connect(ctx, opts.Ceph)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	snapshotStore, err := newSnapshotStore(conn, opts.Ceph.Pool, opts.Store)
+	if err != nil {
+		return fmt.Errorf("failed to initialize snapshot store: %w", err)
+	}
+	defer snapshotStore.Close()
+
+	var snapshots []*api.Snapshot
+	if opts.ID != "" {
+		snapshot, err := snapshotStore.Get(ctx, opts.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	} else {
+		snapshots, err = snapshotStore.List(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots: %w", err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ID\tSTATE\tWRITTEN\tSKIPPED\tTOTAL\tRATE\tSTARTED\tETA")
+	for _, snapshot := range snapshots {
+		written, skipped, total, rate, started, eta := "-", "-", "-", "-", "-", "-"
+		if progress := snapshot.Status.Progress; progress != nil {
+			written = formatBytes(progress.BytesWritten)
+			skipped = formatBytes(progress.BytesSkipped)
+			total = formatBytes(progress.TotalBytes)
+			rate = formatBytes(progress.BytesPerSecond) + "/s"
+			started = progress.StartTime.Format(time.RFC3339)
+			if progress.EstimatedCompletionTime != nil {
+				eta = progress.EstimatedCompletionTime.Format(time.RFC3339)
+			}
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", snapshot.ID, snapshot.Status.State, written, skipped, total, rate, started, eta)
+	}
+	return w.Flush()
+}
+
+func formatBytes(n int64) string {
+	return resource.NewQuantity(n, resource.BinarySI).String()
+}
@@ -0,0 +1,346 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/backup"
+	"github.com/onmetal/cephlet/pkg/ceph"
+	"github.com/onmetal/cephlet/pkg/encryption"
+	"github.com/onmetal/cephlet/pkg/omap"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	storeNameImages    = "images"
+	storeNameSnapshots = "snapshots"
+)
+
+// stores are the stores of a subcommand operating on them directly.
+type stores struct {
+	images    *omap.Store[*api.Image]
+	snapshots *omap.Store[*api.Snapshot]
+
+	close func()
+}
+
+func (s *stores) Close() {
+	s.images.Close()
+	s.snapshots.Close()
+	s.close()
+}
+
+// connect connects to the ceph cluster and checks that the pool exists. The
+// returned function closes the connection.
+func connect(ctx context.Context, cephOpts CephOptions) (*rados.Conn, func(), error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	cleanup, err := configureCephAuth(&cephOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure ceph auth: %w", err)
+	}
+	cleanupAuth := func() {
+		if err := cleanup(); err != nil {
+			log.Error(err, "failed to cleanup")
+		}
+	}
+
+	connectCtx, cancelConnect := context.WithTimeout(ctx, cephOpts.ConnectTimeout)
+	defer cancelConnect()
+	conn, err := ceph.ConnectToRados(connectCtx, ceph.Credentials{
+		Monitors: cephOpts.Monitors,
+		User:     cephOpts.User,
+		Keyfile:  cephOpts.KeyFile,
+	})
+	if err != nil {
+		cleanupAuth()
+		return nil, nil, fmt.Errorf("failed to establish rados connection: %w", err)
+	}
+	closeAll := func() {
+		conn.Shutdown()
+		cleanupAuth()
+	}
+
+	if err := ceph.CheckIfPoolExists(conn, cephOpts.Pool); err != nil {
+		closeAll()
+		return nil, nil, fmt.Errorf("configuration invalid: %w", err)
+	}
+
+	return conn, closeAll, nil
+}
+
+func openStores(ctx context.Context, cephOpts CephOptions, storeOpts StoreOptions) (*stores, error) {
+	encryptor, err := encryption.NewAesGcmEncryptor(cephOpts.KeyEncryptionKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init encryptor: %w", err)
+	}
+
+	conn, closeAll, err := connect(ctx, cephOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	imageStore, err := newImageStore(conn, cephOpts.Pool, storeOpts, encryptor)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("failed to initialize image store: %w", err)
+	}
+
+	snapshotStore, err := newSnapshotStore(conn, cephOpts.Pool, storeOpts)
+	if err != nil {
+		imageStore.Close()
+		closeAll()
+		return nil, fmt.Errorf("failed to initialize snapshot store: %w", err)
+	}
+
+	return &stores{
+		images:    imageStore,
+		snapshots: snapshotStore,
+		close:     closeAll,
+	}, nil
+}
+
+type backupStore interface {
+	Export(ctx context.Context) (map[string]json.RawMessage, error)
+	Import(ctx context.Context, entries map[string]json.RawMessage, opts omap.ImportOptions) ([]string, error)
+}
+
+func (s *stores) byName() map[string]backupStore {
+	return map[string]backupStore{
+		storeNameImages:    s.images,
+		storeNameSnapshots: s.snapshots,
+	}
+}
+
+type StoreCommandOptions struct {
+	Ceph  CephOptions
+	Store StoreOptions
+	File  string
+}
+
+func (o *StoreCommandOptions) Defaults() {
+	o.Ceph.ConnectTimeout = 10 * time.Second
+	o.File = "-"
+}
+
+func (o *StoreCommandOptions) AddFlags(fs *pflag.FlagSet) {
+	o.Ceph.AddConnectionFlags(fs)
+	o.Ceph.AddKeyEncryptionKeyFlag(fs)
+
+	fs.IntVar(&o.Store.Shards, "store-shards", o.Store.Shards, "Number of rados objects the entries of a store are spread over.")
+	fs.StringVarP(&o.File, "file", "f", o.File, "Backup file to use, - for stdin / stdout.")
+}
+
+func (o *StoreCommandOptions) MarkFlagsRequired(cmd *cobra.Command) {
+	_ = cmd.MarkFlagRequired("ceph-monitors")
+	_ = cmd.MarkFlagRequired("ceph-pool")
+	_ = cmd.MarkFlagRequired("ceph-kek-path")
+}
+
+type ImportOptions struct {
+	StoreCommandOptions
+	Overwrite bool
+	DryRun    bool
+}
+
+func (o *ImportOptions) AddFlags(fs *pflag.FlagSet) {
+	o.StoreCommandOptions.AddFlags(fs)
+
+	fs.BoolVar(&o.Overwrite, "overwrite", o.Overwrite, "Overwrite existing entries instead of aborting on conflicts.")
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "Only report the entries conflicting with existing ones.")
+}
+
+func StoreCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "store",
+		Short: "Back up and restore the image and snapshot stores.",
+	}
+
+	cmd.AddCommand(
+		exportCommand(),
+		importCommand(),
+	)
+
+	return cmd
+}
+
+func exportCommand() *cobra.Command {
+	var opts StoreCommandOptions
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the image and snapshot stores to a backup file.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunExport(cmd.Context(), opts)
+		},
+	}
+
+	opts.Defaults()
+	opts.AddFlags(cmd.Flags())
+	opts.MarkFlagsRequired(cmd)
+
+	return cmd
+}
+
+func importCommand() *cobra.Command {
+	var opts ImportOptions
+
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import the image and snapshot stores from a backup file.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunImport(cmd.Context(), opts)
+		},
+	}
+
+	opts.Defaults()
+	opts.AddFlags(cmd.Flags())
+	opts.MarkFlagsRequired(cmd)
+
+	return cmd
+}
+
+func RunExport(ctx context.Context, opts StoreCommandOptions) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	stores, err := openStores(ctx, opts.Ceph, opts.Store)
+	if err != nil {
+		return err
+	}
+	defer stores.Close()
+
+	b := &backup.Backup{
+		CreatedAt: time.Now(),
+		Stores:    make(map[string]map[string]json.RawMessage),
+	}
+	for name, s := range stores.byName() {
+		entries, err := s.Export(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", name, err)
+		}
+
+		log.Info("Exported store", "Store", name, "Entries", len(entries))
+		b.Stores[name] = entries
+	}
+
+	return withOutput(opts.File, func(w io.Writer) error {
+		return backup.Write(w, b)
+	})
+}
+
+func RunImport(ctx context.Context, opts ImportOptions) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	var b *backup.Backup
+	if err := withInput(opts.File, func(r io.Reader) error {
+		var err error
+		b, err = backup.Read(r)
+		return err
+	}); err != nil {
+		return err
+	}
+	log.Info("Read backup", "CreatedAt", b.CreatedAt)
+
+	stores, err := openStores(ctx, opts.Ceph, opts.Store)
+	if err != nil {
+		return err
+	}
+	defer stores.Close()
+
+	byName := stores.byName()
+	for name := range b.Stores {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("backup contains unknown store %q", name)
+		}
+	}
+
+	// Conflicts of all stores are reported before anything is written.
+	conflicting := false
+	for name, s := range byName {
+		conflicts, err := s.Import(ctx, b.Stores[name], omap.ImportOptions{DryRun: true})
+		if err != nil {
+			return fmt.Errorf("failed to check %s for conflicts: %w", name, err)
+		}
+		logConflicts(log, name, conflicts)
+		conflicting = conflicting || len(conflicts) > 0
+	}
+
+	switch {
+	case opts.DryRun:
+		return nil
+	case conflicting && !opts.Overwrite:
+		return fmt.Errorf("backup conflicts with existing entries, use --overwrite to replace them")
+	}
+
+	for name, s := range byName {
+		if _, err := s.Import(ctx, b.Stores[name], omap.ImportOptions{Overwrite: opts.Overwrite}); err != nil {
+			return fmt.Errorf("failed to import %s: %w", name, err)
+		}
+		log.Info("Imported store", "Store", name, "Entries", len(b.Stores[name]))
+	}
+
+	return nil
+}
+
+func logConflicts(log logr.Logger, store string, conflicts []string) {
+	log.Info("Checked for conflicts", "Store", store, "Conflicts", len(conflicts))
+	for _, id := range conflicts {
+		log.Info("Entry already exists", "Store", store, "ID", id)
+	}
+}
+
+func withOutput(filename string, f func(w io.Writer) error) error {
+	if filename == "-" {
+		return f(os.Stdout)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	if err := f(file); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func withInput(filename string, f func(r io.Reader) error) error {
+	if filename == "-" {
+		return f(os.Stdin)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return f(file)
+}
@@ -44,6 +44,8 @@ type Server struct {
 	burstFactor            int64
 	burstDurationInSeconds int64
 
+	listPageSize int64
+
 	keyEncryption encryption.Encryptor
 }
 
@@ -56,12 +58,19 @@ type Options struct {
 
 	BurstFactor            int64
 	BurstDurationInSeconds int64
+
+	// ListPageSize is the number of images read from the store at once when
+	// listing volumes.
+	ListPageSize int64
 }
 
 func setOptionsDefaults(o *Options) {
 	if o.IDGen == nil {
 		o.IDGen = idgen.Default
 	}
+	if o.ListPageSize == 0 {
+		o.ListPageSize = store.DefaultListPageSize
+	}
 }
 
 var _ ori.VolumeRuntimeServer = (*Server)(nil)
@@ -90,5 +99,7 @@ func New(imageStore store.Store[*cephapi.Image],
 
 		burstFactor:            opts.BurstFactor,
 		burstDurationInSeconds: opts.BurstDurationInSeconds,
+
+		listPageSize: opts.ListPageSize,
 	}, nil
 }
@@ -113,6 +113,8 @@ func (s *Server) getOriState(state api.ImageState) (ori.VolumeState, error) {
 		return ori.VolumeState_VOLUME_AVAILABLE, nil
 	case api.ImageStatePending:
 		return ori.VolumeState_VOLUME_PENDING, nil
+	case api.ImageStateError:
+		return ori.VolumeState_VOLUME_ERROR, nil
 	default:
 		return 0, fmt.Errorf("unknown volume state '%q'", state)
 	}
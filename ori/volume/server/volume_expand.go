@@ -19,11 +19,19 @@ import (
 	"fmt"
 
 	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/store"
 	"github.com/onmetal/cephlet/pkg/utils"
 	ori "github.com/onmetal/onmetal-api/ori/apis/volume/v1alpha1"
+	"k8s.io/client-go/util/retry"
 )
 
 func (s *Server) expandImage(ctx context.Context, log logr.Logger, imageId string, storageBytes int64) error {
+	return retry.OnError(retry.DefaultRetry, store.IsConflict, func() error {
+		return s.tryExpandImage(ctx, log, imageId, storageBytes)
+	})
+}
+
+func (s *Server) tryExpandImage(ctx context.Context, log logr.Logger, imageId string, storageBytes int64) error {
 	log.V(2).Info("Fetching ceph image")
 	cephImage, err := s.imageStore.Get(ctx, imageId)
 	if err != nil {
@@ -42,6 +50,9 @@ func (s *Server) expandImage(ctx context.Context, log logr.Logger, imageId strin
 	log.V(2).Info("Updating ceph image with new size", "storageBytes", storageBytes)
 	cephImage.Spec.Size = validatedStorageBytes
 	if _, err := s.imageStore.Update(ctx, cephImage); err != nil {
+		if store.IsConflict(err) {
+			log.V(2).Info("Ceph image was modified concurrently, retrying")
+		}
 		return fmt.Errorf("failed to update ceph image: %w", err)
 	}
 
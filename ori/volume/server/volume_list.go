@@ -21,6 +21,7 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/onmetal/cephlet/ori/volume/apiutils"
+	cephapi "github.com/onmetal/cephlet/pkg/api"
 	"github.com/onmetal/cephlet/pkg/store"
 	ori "github.com/onmetal/onmetal-api/ori/apis/volume/v1alpha1"
 	"google.golang.org/grpc/codes"
@@ -64,23 +65,19 @@ func (s *Server) filterVolumes(volumes []*ori.Volume, filter *ori.VolumeFilter)
 }
 
 func (s *Server) listVolumes(ctx context.Context, log logr.Logger) ([]*ori.Volume, error) {
-	cephImages, err := s.imageStore.List(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error listing volumes: %w", err)
-	}
-
 	var res []*ori.Volume
-	for _, cephImage := range cephImages {
-		if !apiutils.IsManagedBy(cephImage, apiutils.VolumeManager) {
-			continue
-		}
+	if err := store.ForEachPage(ctx, s.imageStore.ListPage, s.listPageSize, func(cephImages []*cephapi.Image) error {
+		for _, cephImage := range cephImages {
+			oriVolume, err := s.convertImageToOriVolume(cephImage)
+			if err != nil {
+				return err
+			}
 
-		oriVolume, err := s.convertImageToOriVolume(cephImage)
-		if err != nil {
-			return nil, err
+			res = append(res, oriVolume)
 		}
-
-		res = append(res, oriVolume)
+		return nil
+	}, store.MatchingLabels{apiutils.ManagerLabel: apiutils.VolumeManager}); err != nil {
+		return nil, fmt.Errorf("error listing volumes: %w", err)
 	}
 	return res, nil
 }
@@ -25,6 +25,9 @@ type Metadata struct {
 	DeletedAt  *time.Time `json:"deletedAt,omitempty"`
 	Generation int64      `json:"generation"`
 
+	ResourceVersion uint64 `json:"resourceVersion"`
+	SchemaVersion   int    `json:"schemaVersion,omitempty"`
+
 	Finalizers []string `json:"finalizers,omitempty"`
 }
 
@@ -56,6 +59,14 @@ func (m *Metadata) GetFinalizers() []string {
 	return m.Finalizers
 }
 
+func (m *Metadata) GetResourceVersion() uint64 {
+	return m.ResourceVersion
+}
+
+func (m *Metadata) GetSchemaVersion() int {
+	return m.SchemaVersion
+}
+
 func (m *Metadata) SetID(id string) {
 	m.ID = id
 }
@@ -84,6 +95,14 @@ func (m *Metadata) SetFinalizers(finalizers []string) {
 	m.Finalizers = finalizers
 }
 
+func (m *Metadata) SetResourceVersion(resourceVersion uint64) {
+	m.ResourceVersion = resourceVersion
+}
+
+func (m *Metadata) SetSchemaVersion(schemaVersion int) {
+	m.SchemaVersion = schemaVersion
+}
+
 type Object interface {
 	GetID() string
 	GetAnnotations() map[string]string
@@ -92,6 +111,8 @@ type Object interface {
 	GetDeletedAt() *time.Time
 	GetGeneration() int64
 	GetFinalizers() []string
+	GetResourceVersion() uint64
+	GetSchemaVersion() int
 
 	SetID(id string)
 	SetAnnotations(annotations map[string]string)
@@ -100,4 +121,6 @@ type Object interface {
 	SetDeletedAt(deleted *time.Time)
 	SetGeneration(generation int64)
 	SetFinalizers(finalizers []string)
+	SetResourceVersion(resourceVersion uint64)
+	SetSchemaVersion(schemaVersion int)
 }
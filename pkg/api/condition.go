@@ -0,0 +1,67 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import "time"
+
+type ConditionStatus string
+
+const (
+	ConditionTrue    ConditionStatus = "True"
+	ConditionFalse   ConditionStatus = "False"
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+type Condition struct {
+	Type               string          `json:"type"`
+	Status             ConditionStatus `json:"status"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	LastTransitionTime time.Time       `json:"lastTransitionTime"`
+}
+
+// FindCondition returns the condition of the given type or nil if there is
+// none.
+func FindCondition(conditions []Condition, typ string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == typ {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds cond to conditions or replaces the condition of the same
+// type. The last transition time is only updated if the status changed.
+func SetCondition(conditions []Condition, cond Condition) []Condition {
+	existing := FindCondition(conditions, cond.Type)
+	if existing == nil {
+		if cond.LastTransitionTime.IsZero() {
+			cond.LastTransitionTime = time.Now()
+		}
+		return append(conditions, cond)
+	}
+
+	if existing.Status != cond.Status {
+		existing.LastTransitionTime = cond.LastTransitionTime
+		if existing.LastTransitionTime.IsZero() {
+			existing.LastTransitionTime = time.Now()
+		}
+	}
+	existing.Status = cond.Status
+	existing.Reason = cond.Reason
+	existing.Message = cond.Message
+	return conditions
+}
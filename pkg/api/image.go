@@ -26,6 +26,15 @@ type ImageState string
 const (
 	ImageStatePending   ImageState = "Pending"
 	ImageStateAvailable ImageState = "Available"
+	// ImageStateError is set if the image failed permanently. It is retried
+	// once the spec changes.
+	ImageStateError ImageState = "Error"
+)
+
+const (
+	// ImageConditionReady reports whether the image is available, and the
+	// reason why it is not otherwise.
+	ImageConditionReady = "Ready"
 )
 
 type EncryptionState string
@@ -56,9 +65,13 @@ type EncryptionSpec struct {
 }
 
 type ImageStatus struct {
-	State      ImageState      `json:"state"`
-	Encryption EncryptionState `json:"encryption"`
-	Access     *ImageAccess    `json:"access"`
+	// ObservedGeneration is the generation of the spec the status was last
+	// reconciled for.
+	ObservedGeneration int64           `json:"observedGeneration"`
+	State              ImageState      `json:"state"`
+	Encryption         EncryptionState `json:"encryption"`
+	Access             *ImageAccess    `json:"access"`
+	Conditions         []Condition     `json:"conditions,omitempty"`
 }
 
 type ImageAccess struct {
@@ -14,6 +14,8 @@
 
 package api
 
+import "time"
+
 type Snapshot struct {
 	Metadata `json:"metadata,omitempty"`
 
@@ -27,13 +29,57 @@ type SnapshotState string
 const (
 	SnapshotStatePending   SnapshotState = "Pending"
 	SnapshotStatePopulated SnapshotState = "Populated"
+	// SnapshotStateFailed is set if populating the snapshot failed
+	// permanently or ran out of attempts. It is retried once the source
+	// changes, or at Status.RetryAfter if it ran out of attempts.
+	SnapshotStateFailed SnapshotState = "Failed"
+)
+
+const (
+	// SnapshotConditionReady reports whether the snapshot is populated, and
+	// the reason why it is not otherwise.
+	SnapshotConditionReady = "Ready"
 )
 
 type SnapshotStatus struct {
-	State  SnapshotState `json:"state"`
-	Digest string        `json:"digest"`
+	// ObservedGeneration is the generation of the source the status was last
+	// reconciled for.
+	ObservedGeneration int64         `json:"observedGeneration"`
+	State              SnapshotState `json:"state"`
+	Digest             string        `json:"digest"`
+	// FailedAttempts is the number of failed attempts to populate the
+	// snapshot.
+	FailedAttempts int `json:"failedAttempts,omitempty"`
+	// RetryAfter is the time after which a snapshot that ran out of attempts
+	// is populated again. It is unset for permanent failures.
+	RetryAfter *time.Time  `json:"retryAfter,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Progress is the progress of the current or last population.
+	Progress *SnapshotProgress `json:"progress,omitempty"`
+}
+
+type SnapshotProgress struct {
+	BytesWritten int64 `json:"bytesWritten"`
+	// BytesSkipped is the part of BytesWritten that consisted of zero blocks
+	// and was not written to the rbd image.
+	BytesSkipped   int64     `json:"bytesSkipped,omitempty"`
+	TotalBytes     int64     `json:"totalBytes"`
+	BytesPerSecond int64     `json:"bytesPerSecond"`
+	StartTime      time.Time `json:"startTime"`
+	// EstimatedCompletionTime is extrapolated from the average throughput
+	// so far, or the time the population completed.
+	EstimatedCompletionTime *time.Time `json:"estimatedCompletionTime,omitempty"`
 }
 
 type SnapshotSource struct {
-	OnmetalImage string `json:"onmetalImage"`
+	OnmetalImage string     `json:"onmetalImage"`
+	URL          *URLSource `json:"url,omitempty"`
+}
+
+// URLSource is a raw, compressed or qcow2 disk image downloaded over
+// HTTP(S).
+type URLSource struct {
+	URL string `json:"url"`
+	// Checksum is the sha256 or sha512 digest of the content at URL.
+	Checksum string `json:"checksum"`
 }
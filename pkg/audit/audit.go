@@ -0,0 +1,64 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit records the mutations of store objects in a journal.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+type Operation string
+
+const (
+	OperationCreate Operation = "Create"
+	OperationUpdate Operation = "Update"
+	OperationDelete Operation = "Delete"
+)
+
+// Entry is a single mutation of a store object.
+type Entry struct {
+	Timestamp time.Time `json:"timestamp"`
+	ID        string    `json:"id"`
+	Operation Operation `json:"operation"`
+	// Method is the gRPC method or controller that caused the mutation.
+	Method          string   `json:"method,omitempty"`
+	ResourceVersion uint64   `json:"resourceVersion"`
+	Generation      int64    `json:"generation"`
+	Diff            []Change `json:"diff,omitempty"`
+}
+
+// Change is the change of a single spec field. Old or New is empty if the
+// field was added or removed.
+type Change struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+type methodKey struct{}
+
+// WithMethod returns a context recording method as cause of the mutations
+// made with it.
+func WithMethod(ctx context.Context, method string) context.Context {
+	return context.WithValue(ctx, methodKey{}, method)
+}
+
+// MethodFrom returns the method set by WithMethod.
+func MethodFrom(ctx context.Context) string {
+	method, _ := ctx.Value(methodKey{}).(string)
+	return method
+}
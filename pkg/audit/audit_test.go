@@ -0,0 +1,113 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/audit"
+	"github.com/onmetal/cephlet/pkg/store/memory"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/utils/ptr"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	entries []audit.Entry
+}
+
+func (r *recorder) Append(ctx context.Context, entry audit.Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+var _ = Describe("Diff", func() {
+	It("should report changed fields", func() {
+		changes, err := audit.Diff(
+			&api.ImageSpec{Size: 1024, Image: "foo"},
+			&api.ImageSpec{Size: 2048, SnapshotRef: ptr.To("bar")},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(Equal([]audit.Change{
+			{Path: "image", Old: json.RawMessage(`"foo"`), New: json.RawMessage(`""`)},
+			{Path: "size", Old: json.RawMessage(`1024`), New: json.RawMessage(`2048`)},
+			{Path: "snapshotRef", Old: json.RawMessage(`null`), New: json.RawMessage(`"bar"`)},
+		}))
+	})
+
+	It("should report added fields", func() {
+		changes, err := audit.Diff(nil, &api.ImageSpec{Limits: api.Limits{"foo": 1}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(ContainElement(audit.Change{Path: "limits.foo", New: json.RawMessage(`1`)}))
+	})
+
+	It("should report nothing for equal objects", func() {
+		Expect(audit.Diff(&api.ImageSpec{Size: 1024}, &api.ImageSpec{Size: 1024})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Store", func() {
+	It("should record every mutation with its method and spec diff", func() {
+		backend, err := memory.New(memory.Options[*api.Image]{
+			NewFunc: func() *api.Image { return &api.Image{} },
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := &recorder{}
+		s, err := audit.NewStore[*api.Image](backend, rec, audit.Options[*api.Image]{
+			SpecFunc: func(obj *api.Image) interface{} { return obj.Spec },
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx := audit.WithMethod(context.Background(), "/volume.v1alpha1.VolumeRuntime/ExpandVolume")
+
+		img, err := s.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "foo"}, Spec: api.ImageSpec{Size: 1024}})
+		Expect(err).NotTo(HaveOccurred())
+
+		img.Spec.Size = 2048
+		_, err = s.Update(ctx, img)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(s.Delete(ctx, "foo")).To(Succeed())
+
+		Expect(rec.entries).To(HaveLen(3))
+		Expect(rec.entries[0]).To(SatisfyAll(
+			HaveField("ID", "foo"),
+			HaveField("Operation", audit.OperationCreate),
+			HaveField("Method", "/volume.v1alpha1.VolumeRuntime/ExpandVolume"),
+			HaveField("ResourceVersion", BeEquivalentTo(1)),
+		))
+		Expect(rec.entries[1]).To(SatisfyAll(
+			HaveField("Operation", audit.OperationUpdate),
+			HaveField("ResourceVersion", BeEquivalentTo(2)),
+			HaveField("Diff", ConsistOf(audit.Change{
+				Path: "size",
+				Old:  json.RawMessage(`1024`),
+				New:  json.RawMessage(`2048`),
+			})),
+		))
+		Expect(rec.entries[2]).To(SatisfyAll(
+			HaveField("Operation", audit.OperationDelete),
+			HaveField("ResourceVersion", BeEquivalentTo(2)),
+		))
+	})
+})
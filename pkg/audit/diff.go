@@ -0,0 +1,110 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Diff returns the changes of the fields of new compared to old. Both are
+// compared in their JSON form, nested objects by field and lists as a whole.
+func Diff(old, new interface{}) ([]Change, error) {
+	oldFields, err := flatten(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flatten(new)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for path, oldValue := range oldFields {
+		newValue, ok := newFields[path]
+		if ok && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		change := Change{Path: path, Old: mustMarshal(oldValue)}
+		if ok {
+			change.New = mustMarshal(newValue)
+		}
+		changes = append(changes, change)
+	}
+	for path, newValue := range newFields {
+		if _, ok := oldFields[path]; !ok {
+			changes = append(changes, Change{Path: path, New: mustMarshal(newValue)})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func flatten(v interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+		return fields, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+
+	flattenInto(fields, "", value)
+	return fields, nil
+}
+
+func flattenInto(fields map[string]interface{}, path string, value interface{}) {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		if path != "" {
+			fields[path] = value
+		}
+		return
+	}
+
+	for key, v := range m {
+		p := key
+		if path != "" {
+			p = path + "." + key
+		}
+		flattenInto(fields, p, v)
+	}
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// Values were unmarshalled from JSON before, so they can always be
+		// marshalled again.
+		panic(err)
+	}
+	return data
+}
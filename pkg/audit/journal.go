@@ -0,0 +1,289 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	dayLayout = "2006-01-02"
+
+	listBatchSize = 1000
+)
+
+type JournalOptions struct {
+	// Name is the name of the rados object listing the days of the journal.
+	// The entries of a day are kept in the omap of the object Name.<day>.
+	Name string
+	// Retention is the duration entries are kept for. It is rounded up to
+	// whole days.
+	Retention time.Duration
+	// TrimInterval is the interval in which expired days are removed.
+	TrimInterval time.Duration
+}
+
+func setJournalOptionsDefaults(o *JournalOptions) {
+	if o.Retention == 0 {
+		o.Retention = 30 * 24 * time.Hour
+	}
+	if o.TrimInterval == 0 {
+		o.TrimInterval = 1 * time.Hour
+	}
+}
+
+// NewJournal returns a Recorder appending entries to omap objects in pool,
+// one per day.
+func NewJournal(conn *rados.Conn, pool string, opts JournalOptions) (*Journal, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("must specify conn")
+	}
+	if pool == "" {
+		return nil, fmt.Errorf("must specify pool")
+	}
+	if opts.Name == "" {
+		return nil, fmt.Errorf("must specify opts.Name")
+	}
+
+	setJournalOptionsDefaults(&opts)
+
+	return &Journal{
+		conn:         conn,
+		pool:         pool,
+		name:         opts.Name,
+		retention:    opts.Retention,
+		trimInterval: opts.TrimInterval,
+		days:         sets.New[string](),
+	}, nil
+}
+
+type Journal struct {
+	conn *rados.Conn
+	pool string
+	name string
+
+	retention    time.Duration
+	trimInterval time.Duration
+
+	// days are the days known to be listed in the head object.
+	daysMu sync.Mutex
+	days   sets.Set[string]
+}
+
+func (j *Journal) dayName(day string) string {
+	return j.name + "." + day
+}
+
+func (j *Journal) Append(ctx context.Context, entry Entry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	entry.Timestamp = entry.Timestamp.UTC()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal entry: %w", err)
+	}
+
+	ioCtx, err := j.conn.OpenIOContext(j.pool)
+	if err != nil {
+		return fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	day := entry.Timestamp.Format(dayLayout)
+	if err := j.addDay(ioCtx, day); err != nil {
+		return err
+	}
+
+	// The random suffix keeps entries of the same nanosecond apart.
+	key := fmt.Sprintf("%020d-%s", entry.Timestamp.UnixNano(), rand.String(8))
+	if err := ioCtx.SetOmap(j.dayName(day), map[string][]byte{key: data}); err != nil {
+		return fmt.Errorf("failed to append entry: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) addDay(ioCtx *rados.IOContext, day string) error {
+	j.daysMu.Lock()
+	defer j.daysMu.Unlock()
+
+	if j.days.Has(day) {
+		return nil
+	}
+
+	if err := ioCtx.SetOmap(j.name, map[string][]byte{day: nil}); err != nil {
+		return fmt.Errorf("failed to add day %s: %w", day, err)
+	}
+	j.days.Insert(day)
+	return nil
+}
+
+func (j *Journal) listDays(ioCtx *rados.IOContext) ([]string, error) {
+	values, err := ioCtx.GetAllOmapValues(j.name, "", "", listBatchSize)
+	if err != nil {
+		if errors.Is(err, rados.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list days: %w", err)
+	}
+
+	days := make([]string, 0, len(values))
+	for day := range values {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+type ListOptions struct {
+	// ID restricts the entries to the ones of a single object.
+	ID string
+	// Since restricts the entries to the ones recorded at or after it.
+	Since time.Time
+	// Limit is the maximum number of entries returned. If more entries match,
+	// the most recent ones are returned. Zero means no limit.
+	Limit int
+}
+
+// List returns the entries matching opts, oldest first.
+func (j *Journal) List(ctx context.Context, opts ListOptions) ([]Entry, error) {
+	ioCtx, err := j.conn.OpenIOContext(j.pool)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	days, err := j.listDays(ioCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		since   = opts.Since.UTC()
+		entries []Entry
+	)
+	for _, day := range days {
+		if !opts.Since.IsZero() && day < since.Format(dayLayout) {
+			continue
+		}
+
+		values, err := ioCtx.GetAllOmapValues(j.dayName(day), "", "", listBatchSize)
+		if err != nil {
+			if errors.Is(err, rados.ErrNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list entries of %s: %w", day, err)
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			var entry Entry
+			if err := json.Unmarshal(values[key], &entry); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal entry %s: %w", key, err)
+			}
+
+			if entry.Timestamp.Before(since) || (opts.ID != "" && entry.ID != opts.ID) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[len(entries)-opts.Limit:]
+	}
+	return entries, nil
+}
+
+// Trim removes the days older than the retention and returns their number.
+func (j *Journal) Trim(ctx context.Context) (int, error) {
+	ioCtx, err := j.conn.OpenIOContext(j.pool)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	days, err := j.listDays(ioCtx)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().UTC().Add(-j.retention).Format(dayLayout)
+
+	var expired []string
+	for _, day := range days {
+		if day >= cutoff {
+			break
+		}
+
+		if err := ioCtx.Delete(j.dayName(day)); err != nil && !errors.Is(err, rados.ErrNotFound) {
+			return len(expired), fmt.Errorf("failed to remove day %s: %w", day, err)
+		}
+		expired = append(expired, day)
+	}
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	if err := ioCtx.RmOmapKeys(j.name, expired); err != nil {
+		return 0, fmt.Errorf("failed to remove expired days: %w", err)
+	}
+
+	j.daysMu.Lock()
+	defer j.daysMu.Unlock()
+	j.days.Delete(expired...)
+
+	return len(expired), nil
+}
+
+// Start trims the journal periodically until ctx is done.
+func (j *Journal) Start(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("Journal", j.name)
+
+	ticker := time.NewTicker(j.trimInterval)
+	defer ticker.Stop()
+
+	for {
+		if trimmed, err := j.Trim(ctx); err != nil {
+			log.Error(err, "failed to trim journal")
+		} else if trimmed > 0 {
+			log.V(1).Info("Trimmed journal", "Days", trimmed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
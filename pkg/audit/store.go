@@ -0,0 +1,129 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/utils"
+)
+
+// Recorder records journal entries.
+type Recorder interface {
+	Append(ctx context.Context, entry Entry) error
+}
+
+type Options[E api.Object] struct {
+	// SpecFunc returns the part of an object the entries contain a diff of.
+	SpecFunc func(obj E) interface{}
+}
+
+// NewStore returns a store.Store recording every successful Create, Update and
+// Delete of backend with recorder. Failing to record an entry is logged, but
+// does not fail the mutation, as it was already committed.
+func NewStore[E api.Object](backend store.Store[E], recorder Recorder, opts Options[E]) (*Store[E], error) {
+	if backend == nil {
+		return nil, fmt.Errorf("must specify backend")
+	}
+	if recorder == nil {
+		return nil, fmt.Errorf("must specify recorder")
+	}
+	if opts.SpecFunc == nil {
+		return nil, fmt.Errorf("must specify opts.SpecFunc")
+	}
+
+	return &Store[E]{
+		Store:    backend,
+		recorder: recorder,
+		specFunc: opts.SpecFunc,
+	}, nil
+}
+
+type Store[E api.Object] struct {
+	store.Store[E]
+
+	recorder Recorder
+	specFunc func(obj E) interface{}
+}
+
+func (s *Store[E]) record(ctx context.Context, op Operation, obj E, old, new interface{}) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	diff, err := Diff(old, new)
+	if err != nil {
+		log.Error(err, "failed to compute audit diff", "ID", obj.GetID())
+	}
+
+	if err := s.recorder.Append(ctx, Entry{
+		ID:              obj.GetID(),
+		Operation:       op,
+		Method:          MethodFrom(ctx),
+		ResourceVersion: obj.GetResourceVersion(),
+		Generation:      obj.GetGeneration(),
+		Diff:            diff,
+	}); err != nil {
+		log.Error(err, "failed to record audit entry", "ID", obj.GetID(), "Operation", op)
+	}
+}
+
+func (s *Store[E]) Create(ctx context.Context, obj E) (E, error) {
+	obj, err := s.Store.Create(ctx, obj)
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+
+	s.record(ctx, OperationCreate, obj, nil, s.specFunc(obj))
+	return obj, nil
+}
+
+func (s *Store[E]) Update(ctx context.Context, obj E) (E, error) {
+	// The object is read before updating to diff against it. If it changed in
+	// between, the update fails with a conflict anyway.
+	var oldSpec interface{}
+	old, err := s.Store.Get(ctx, obj.GetID())
+	switch {
+	case err == nil:
+		oldSpec = s.specFunc(old)
+	case !errors.Is(err, store.ErrNotFound):
+		return utils.Zero[E](), err
+	}
+
+	obj, err = s.Store.Update(ctx, obj)
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+
+	s.record(ctx, OperationUpdate, obj, oldSpec, s.specFunc(obj))
+	return obj, nil
+}
+
+func (s *Store[E]) Delete(ctx context.Context, id string) error {
+	old, err := s.Store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Store.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	s.record(ctx, OperationDelete, old, nil, nil)
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup implements the file format store exports are written in.
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FormatVersion is the version of the file format written by Write.
+const FormatVersion = 1
+
+const checksumPrefix = "sha256:"
+
+// file is the serialized form of a backup. Checksum covers the exact bytes of
+// Data.
+type file struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Backup holds the entries of a set of stores.
+type Backup struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// Stores maps store names to their entries by id.
+	Stores map[string]map[string]json.RawMessage `json:"stores"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return checksumPrefix + hex.EncodeToString(sum[:])
+}
+
+// Write writes b to w.
+func Write(w io.Writer, b *Backup) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup: %w", err)
+	}
+
+	if err := json.NewEncoder(w).Encode(file{
+		Version:  FormatVersion,
+		Checksum: checksum(data),
+		Data:     data,
+	}); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// Read reads a backup written by Write from r and verifies its checksum.
+func Read(r io.Reader) (*Backup, error) {
+	var f file
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if f.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version %d", f.Version)
+	}
+
+	if actual := checksum(f.Data); actual != f.Checksum {
+		return nil, fmt.Errorf("backup checksum mismatch: expected %s, got %s", f.Checksum, actual)
+	}
+
+	b := &Backup{}
+	if err := json.Unmarshal(f.Data, b); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal backup: %w", err)
+	}
+	return b, nil
+}
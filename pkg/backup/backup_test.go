@@ -0,0 +1,64 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	. "github.com/onmetal/cephlet/pkg/backup"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backup", func() {
+	newBackup := func() *Backup {
+		return &Backup{
+			CreatedAt: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+			Stores: map[string]map[string]json.RawMessage{
+				"images": {
+					"foo": json.RawMessage(`{"metadata":{"id":"foo"}}`),
+				},
+			},
+		}
+	}
+
+	It("should read a written backup", func() {
+		var buf bytes.Buffer
+		Expect(Write(&buf, newBackup())).To(Succeed())
+
+		b, err := Read(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.CreatedAt).To(BeTemporally("==", newBackup().CreatedAt))
+		Expect(b.Stores).To(HaveKeyWithValue("images", HaveKeyWithValue("foo", MatchJSON(`{"metadata":{"id":"foo"}}`))))
+	})
+
+	It("should reject a modified backup", func() {
+		var buf bytes.Buffer
+		Expect(Write(&buf, newBackup())).To(Succeed())
+
+		modified := bytes.Replace(buf.Bytes(), []byte(`"id":"foo"`), []byte(`"id":"bar"`), 1)
+		Expect(modified).NotTo(Equal(buf.Bytes()))
+
+		_, err := Read(bytes.NewReader(modified))
+		Expect(err).To(MatchError(ContainSubstring("checksum mismatch")))
+	})
+
+	It("should reject an unsupported format version", func() {
+		_, err := Read(bytes.NewReader([]byte(`{"version":2,"checksum":"","data":{}}`)))
+		Expect(err).To(MatchError(ContainSubstring("unsupported backup format version 2")))
+	})
+})
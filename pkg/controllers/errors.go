@@ -0,0 +1,67 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import "errors"
+
+const (
+	ReasonAvailable             = "Available"
+	ReasonInvalidImageReference = "InvalidImageReference"
+	ReasonImageNotFound         = "ImageNotFound"
+	ReasonImageResolutionFailed = "ImageResolutionFailed"
+	ReasonSnapshotNotFound      = "SnapshotNotFound"
+	ReasonCloneFailed           = "CloneFailed"
+	ReasonEncryptionFailed      = "EncryptionFailed"
+	ReasonSnapshotFailed        = "SnapshotFailed"
+	ReasonPopulated             = "Populated"
+	ReasonRootFSMissing         = "RootFSMissing"
+	ReasonPopulationFailed      = "PopulationFailed"
+	ReasonUnsupportedFormat     = "UnsupportedFormat"
+)
+
+// reconcileError is a classified failure of a reconciliation step. Its reason
+// is reported in the conditions of the reconciled object. Permanent failures
+// are not retried until the spec of the object changes, transient ones are
+// retried with backoff.
+type reconcileError struct {
+	reason    string
+	permanent bool
+	err       error
+}
+
+func (e *reconcileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reconcileError) Unwrap() error {
+	return e.err
+}
+
+func permanentError(reason string, err error) error {
+	return &reconcileError{reason: reason, permanent: true, err: err}
+}
+
+func transientError(reason string, err error) error {
+	return &reconcileError{reason: reason, err: err}
+}
+
+// classifyError returns the reconcileError err wraps, if any.
+func classifyError(err error) (*reconcileError, bool) {
+	var rErr *reconcileError
+	if !errors.As(err, &rErr) {
+		return nil, false
+	}
+	return rErr, true
+}
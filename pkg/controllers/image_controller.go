@@ -21,10 +21,10 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/ceph/go-ceph/rados"
 	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	"github.com/go-logr/logr"
 	"github.com/onmetal/cephlet/pkg/api"
@@ -35,7 +35,6 @@ import (
 	"github.com/onmetal/cephlet/pkg/utils"
 	"github.com/onmetal/onmetal-image/oci/image"
 	"golang.org/x/exp/slices"
-	"k8s.io/client-go/util/workqueue"
 	"k8s.io/utils/ptr"
 )
 
@@ -49,6 +48,11 @@ type ImageReconcilerOptions struct {
 	Monitors string
 	Client   string
 	Pool     string
+	// URLSourcePolicy restricts the hosts disk images are downloaded from
+	// over HTTP(S). Url images are rejected if nil.
+	URLSourcePolicy *URLSourcePolicy
+
+	Runner RunnerOptions
 }
 
 func NewImageReconciler(
@@ -102,11 +106,10 @@ func NewImageReconciler(
 		return nil, fmt.Errorf("must specify ceph client")
 	}
 
-	return &ImageReconciler{
+	r := &ImageReconciler{
 		log:            log,
 		conn:           conn,
 		registry:       registry,
-		queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
 		images:         images,
 		snapshots:      snapshots,
 		imageEvents:    imageEvents,
@@ -115,7 +118,19 @@ func NewImageReconciler(
 		client:         opts.Client,
 		pool:           opts.Pool,
 		keyEncryption:  keyEncryption,
-	}, nil
+		urlSources:     opts.URLSourcePolicy,
+	}
+
+	if opts.Runner.LogKey == "" {
+		opts.Runner.LogKey = "imageId"
+	}
+	runner, err := NewRunner(log, r.reconcile, opts.Runner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize runner: %w", err)
+	}
+	r.runner = runner
+
+	return r, nil
 }
 
 type ImageReconciler struct {
@@ -123,7 +138,7 @@ type ImageReconciler struct {
 	conn *rados.Conn
 
 	registry image.Source
-	queue    workqueue.RateLimitingInterface
+	runner   *Runner
 
 	images    store.Store[*api.Image]
 	snapshots store.Store[*api.Snapshot]
@@ -136,17 +151,15 @@ type ImageReconciler struct {
 	pool     string
 
 	keyEncryption encryption.Encryptor
+	urlSources    *URLSourcePolicy
 }
 
 func (r *ImageReconciler) Start(ctx context.Context) error {
 	log := r.log
 
-	//todo make configurable
-	workerSize := 15
-
-	imgEventReg, err := r.imageEvents.AddHandler(event.HandlerFunc[*api.Image](func(evt event.Event[*api.Image]) {
-		r.queue.Add(evt.Object.ID)
-	}))
+	imgEventReg, err := r.imageEvents.AddHandler(event.NewStatusUpdateFilter[*api.Image](event.HandlerFunc[*api.Image](func(evt event.Event[*api.Image]) {
+		r.runner.Enqueue(evt.Object.ID)
+	})))
 	if err != nil {
 		return err
 	}
@@ -155,20 +168,21 @@ func (r *ImageReconciler) Start(ctx context.Context) error {
 	}()
 
 	snapEventReg, err := r.snapshotEvents.AddHandler(event.HandlerFunc[*api.Snapshot](func(evt event.Event[*api.Snapshot]) {
-		if evt.Type != event.TypeUpdated || evt.Object.Status.State != api.SnapshotStatePopulated {
+		if evt.Type != event.TypeUpdated {
+			return
+		}
+		if state := evt.Object.Status.State; state != api.SnapshotStatePopulated && state != api.SnapshotStateFailed {
 			return
 		}
 
-		imageList, err := r.images.List(ctx)
+		imageList, err := r.images.List(ctx, store.MatchingFields{utils.ImageSnapshotRefField: evt.Object.ID})
 		if err != nil {
 			log.Error(err, "failed to list images")
 			return
 		}
 
 		for _, img := range imageList {
-			if snapshotRef := img.Spec.SnapshotRef; snapshotRef != nil && *snapshotRef == evt.Object.ID {
-				r.queue.Add(img.ID)
-			}
+			r.runner.Enqueue(img.ID)
 		}
 	}))
 	if err != nil {
@@ -178,44 +192,71 @@ func (r *ImageReconciler) Start(ctx context.Context) error {
 		_ = r.snapshotEvents.RemoveHandler(snapEventReg)
 	}()
 
-	go func() {
-		<-ctx.Done()
-		r.queue.ShutDown()
-	}()
+	return r.runner.Start(ctx)
+}
 
-	var wg sync.WaitGroup
-	for i := 0; i < workerSize; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for r.processNextWorkItem(ctx, log) {
-			}
-		}()
+func (r *ImageReconciler) reconcile(ctx context.Context, id string) (Result, error) {
+	err := r.reconcileImage(ctx, id)
+	rErr, ok := classifyError(err)
+	if !ok {
+		return Result{}, err
 	}
 
-	wg.Wait()
-	return nil
+	if statusErr := r.setImageError(ctx, id, rErr); statusErr != nil {
+		return Result{}, errors.Join(err, fmt.Errorf("failed to report error in image status: %w", statusErr))
+	}
+
+	if rErr.permanent {
+		logr.FromContextOrDiscard(ctx).Error(err, "Image failed permanently", "reason", rErr.reason)
+		return Result{}, nil
+	}
+	return Result{}, err
 }
 
-func (r *ImageReconciler) processNextWorkItem(ctx context.Context, log logr.Logger) bool {
-	item, shutdown := r.queue.Get()
-	if shutdown {
-		return false
+// setImageError reports rErr in the Ready condition of the image unless it is
+// already reported. Permanent errors move the image to the error state until
+// its spec changes.
+func (r *ImageReconciler) setImageError(ctx context.Context, id string, rErr *reconcileError) error {
+	img, err := r.images.Get(ctx, id)
+	if err != nil {
+		return store.IgnoreErrNotFound(err)
+	}
+
+	if img.DeletedAt != nil {
+		return nil
+	}
+
+	state, observedGeneration := img.Status.State, img.Status.ObservedGeneration
+	if rErr.permanent {
+		state, observedGeneration = api.ImageStateError, img.Generation
+	}
+	if cond := api.FindCondition(img.Status.Conditions, api.ImageConditionReady); cond != nil &&
+		cond.Status == api.ConditionFalse && cond.Reason == rErr.reason && cond.Message == rErr.Error() &&
+		img.Status.State == state && img.Status.ObservedGeneration == observedGeneration {
+		return nil
 	}
-	defer r.queue.Done(item)
 
-	id := item.(string)
-	log = log.WithValues("imageId", id)
-	ctx = logr.NewContext(ctx, log)
+	img.Status.Conditions = api.SetCondition(img.Status.Conditions, api.Condition{
+		Type:    api.ImageConditionReady,
+		Status:  api.ConditionFalse,
+		Reason:  rErr.reason,
+		Message: rErr.Error(),
+	})
+	img.Status.State = state
+	img.Status.ObservedGeneration = observedGeneration
 
-	if err := r.reconcileImage(ctx, id); err != nil {
-		log.Error(err, "failed to reconcile image")
-		r.queue.AddRateLimited(item)
-		return true
+	if _, err := r.images.Update(ctx, img); err != nil {
+		return err
 	}
+	return nil
+}
 
-	r.queue.Forget(item)
-	return true
+func setImageReady(img *api.Image) {
+	img.Status.Conditions = api.SetCondition(img.Status.Conditions, api.Condition{
+		Type:   api.ImageConditionReady,
+		Status: api.ConditionTrue,
+		Reason: ReasonAvailable,
+	})
 }
 
 const (
@@ -270,26 +311,37 @@ func (r *ImageReconciler) fetchAuth(ctx context.Context, log logr.Logger) (strin
 	return strings.TrimPrefix(r.client, "client."), response.Key, nil
 }
 
-func (r *ImageReconciler) reconcileSnapshot(ctx context.Context, log logr.Logger, img *api.Image) error {
-	if !(img.Spec.Image != "" && img.Spec.SnapshotRef == nil) {
-		return nil
+// isSnapshotRecovered reports whether img errored because its snapshot failed
+// and the snapshot has been populated since.
+func (r *ImageReconciler) isSnapshotRecovered(ctx context.Context, img *api.Image) (bool, error) {
+	if img.Status.State != api.ImageStateError || img.Spec.SnapshotRef == nil {
+		return false, nil
+	}
+	if cond := api.FindCondition(img.Status.Conditions, api.ImageConditionReady); cond == nil || cond.Reason != ReasonSnapshotFailed {
+		return false, nil
 	}
 
-	spec, err := reference.Parse(img.Spec.Image)
+	snapshot, err := r.snapshots.Get(ctx, *img.Spec.SnapshotRef)
 	if err != nil {
-		return fmt.Errorf("failed to parse image reference: %w", err)
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get snapshot: %w", err)
 	}
+	return snapshot.Status.State == api.SnapshotStatePopulated, nil
+}
 
-	resolvedImg, err := r.registry.Resolve(ctx, img.Spec.Image)
-	if err != nil {
-		return fmt.Errorf("failed to resolve image ref in registry: %w", err)
+func (r *ImageReconciler) reconcileSnapshot(ctx context.Context, log logr.Logger, img *api.Image) error {
+	if !(img.Spec.Image != "" && img.Spec.SnapshotRef == nil) {
+		return nil
 	}
 
-	snapshotDigest := resolvedImg.Descriptor().Digest.String()
-	resolvedImageName := fmt.Sprintf("%s@%s", spec.Locator, snapshotDigest)
+	snapshotDigest, source, err := r.resolveSnapshotSource(ctx, img.Spec.Image)
+	if err != nil {
+		return err
+	}
 
-	//TODO select later by label
-	snap, err := r.snapshots.Get(ctx, snapshotDigest)
+	snap, err := r.getSnapshotByDigest(ctx, snapshotDigest)
 	if err != nil {
 		switch {
 		case errors.Is(err, store.ErrNotFound):
@@ -300,9 +352,7 @@ func (r *ImageReconciler) reconcileSnapshot(ctx context.Context, log logr.Logger
 						imageDigestLabel: snapshotDigest,
 					},
 				},
-				Source: api.SnapshotSource{
-					OnmetalImage: resolvedImageName,
-				},
+				Source: source,
 			})
 			if err != nil {
 				return fmt.Errorf("failed to create snapshot: %w", err)
@@ -321,6 +371,54 @@ func (r *ImageReconciler) reconcileSnapshot(ctx context.Context, log logr.Logger
 	return nil
 }
 
+// resolveSnapshotSource resolves ref to the source of the snapshot to create
+// the image from and the digest identifying it. Disk images downloaded over
+// HTTP(S) are identified by their checksum.
+func (r *ImageReconciler) resolveSnapshotSource(ctx context.Context, ref string) (string, api.SnapshotSource, error) {
+	if IsURLImage(ref) {
+		src, err := ParseURLImage(ref)
+		if err != nil {
+			return "", api.SnapshotSource{}, permanentError(ReasonInvalidImageReference, fmt.Errorf("failed to parse image url: %w", err))
+		}
+		if err := r.urlSources.Check(src.URL); err != nil {
+			return "", api.SnapshotSource{}, permanentError(ReasonInvalidImageReference, err)
+		}
+		return src.Checksum, api.SnapshotSource{URL: src}, nil
+	}
+
+	spec, err := reference.Parse(ref)
+	if err != nil {
+		return "", api.SnapshotSource{}, permanentError(ReasonInvalidImageReference, fmt.Errorf("failed to parse image reference: %w", err))
+	}
+
+	resolvedImg, err := r.registry.Resolve(ctx, ref)
+	if err != nil {
+		err = fmt.Errorf("failed to resolve image ref in registry: %w", err)
+		if errdefs.IsNotFound(err) {
+			return "", api.SnapshotSource{}, permanentError(ReasonImageNotFound, err)
+		}
+		return "", api.SnapshotSource{}, transientError(ReasonImageResolutionFailed, err)
+	}
+
+	snapshotDigest := resolvedImg.Descriptor().Digest.String()
+	return snapshotDigest, api.SnapshotSource{
+		OnmetalImage: fmt.Sprintf("%s@%s", spec.Locator, snapshotDigest),
+	}, nil
+}
+
+func (r *ImageReconciler) getSnapshotByDigest(ctx context.Context, digest string) (*api.Snapshot, error) {
+	snapshots, err := r.snapshots.List(ctx, store.MatchingLabels{imageDigestLabel: digest})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot with digest %q %w", digest, store.ErrNotFound)
+	}
+
+	return snapshots[0], nil
+}
+
 func (r *ImageReconciler) isImageExisting(ctx context.Context, log logr.Logger, ioCtx *rados.IOContext, image *api.Image) (bool, error) {
 	images, err := librbd.GetImageNames(ioCtx)
 	if err != nil {
@@ -403,6 +501,19 @@ func (r *ImageReconciler) reconcileImage(ctx context.Context, id string) error {
 		return nil
 	}
 
+	if (img.Status.State == api.ImageStateAvailable || img.Status.State == api.ImageStateError) &&
+		img.Status.ObservedGeneration == img.Generation {
+		recovered, err := r.isSnapshotRecovered(ctx, img)
+		if err != nil {
+			return err
+		}
+		if !recovered {
+			log.V(1).Info("Image spec unchanged since last reconciliation", "generation", img.Generation, "state", img.Status.State)
+			return nil
+		}
+		log.V(1).Info("Snapshot of errored image was populated, retrying")
+	}
+
 	if err := r.reconcileSnapshot(ctx, log, img); err != nil {
 		return fmt.Errorf("failed to reconcile snapshot: %w", err)
 	}
@@ -418,6 +529,18 @@ func (r *ImageReconciler) reconcileImage(ctx context.Context, id string) error {
 			if err := r.updateImage(ctx, log, ioCtx, img); err != nil {
 				return fmt.Errorf("failed to update image: %w", err)
 			}
+
+			if err := r.setImageLimits(ctx, log, ioCtx, img); err != nil {
+				return fmt.Errorf("failed to set limits: %w", err)
+			}
+
+			img.Status.ObservedGeneration = img.Generation
+			setImageReady(img)
+			if _, err := r.images.Update(ctx, img); err != nil {
+				return fmt.Errorf("failed to update image status: %w", err)
+			}
+
+			log.V(1).Info("Successfully updated image", "generation", img.Generation)
 			return nil
 		}
 	} else {
@@ -472,6 +595,8 @@ func (r *ImageReconciler) reconcileImage(ctx context.Context, id string) error {
 		UserKey:  key,
 	}
 	img.Status.State = api.ImageStateAvailable
+	img.Status.ObservedGeneration = img.Generation
+	setImageReady(img)
 	if _, err = r.images.Update(ctx, img); err != nil {
 		return fmt.Errorf("failed to update image metadate: %w", err)
 	}
@@ -539,7 +664,7 @@ func (r *ImageReconciler) setEncryptionHeader(ctx context.Context, log logr.Logg
 	log.V(1).Info("Configuring encryption")
 	passphrase, err := r.keyEncryption.Decrypt(image.Spec.Encryption.EncryptedPassphrase)
 	if err != nil {
-		return fmt.Errorf("failed to decrypt passphrase: %w", err)
+		return permanentError(ReasonEncryptionFailed, fmt.Errorf("failed to decrypt passphrase: %w", err))
 	}
 
 	img, err := librbd.OpenImage(ioCtx, ImageIDToRBDID(image.ID), librbd.NoSnapshot)
@@ -552,9 +677,9 @@ func (r *ImageReconciler) setEncryptionHeader(ctx context.Context, log logr.Logg
 		Passphrase: passphrase,
 	}); err != nil {
 		if closeErr := img.Close(); closeErr != nil {
-			return errors.Join(err, fmt.Errorf("unable to close image: %w", closeErr))
+			return transientError(ReasonEncryptionFailed, errors.Join(err, fmt.Errorf("unable to close image: %w", closeErr)))
 		}
-		return fmt.Errorf("failed to set encryption format: %w", err)
+		return transientError(ReasonEncryptionFailed, fmt.Errorf("failed to set encryption format: %w", err))
 	}
 
 	if err := img.Close(); err != nil {
@@ -585,12 +710,18 @@ func (r *ImageReconciler) createImageFromSnapshot(ctx context.Context, log logr.
 			return false, fmt.Errorf("failed to get snapshot: %w", err)
 		}
 
-		log.V(1).Info("snapshot not found", "snapshotID", snapshot.ID)
-
-		return false, nil
+		return false, permanentError(ReasonSnapshotNotFound, fmt.Errorf("snapshot %q %w", snapshotRef, err))
 	}
 
-	if snapshot.Status.State != api.SnapshotStatePopulated {
+	switch snapshot.Status.State {
+	case api.SnapshotStatePopulated:
+	case api.SnapshotStateFailed:
+		message := "snapshot failed"
+		if cond := api.FindCondition(snapshot.Status.Conditions, api.SnapshotConditionReady); cond != nil {
+			message = fmt.Sprintf("snapshot failed: %s: %s", cond.Reason, cond.Message)
+		}
+		return false, permanentError(ReasonSnapshotFailed, errors.New(message))
+	default:
 		log.V(1).Info("snapshot is not populated", "state", snapshot.Status.State)
 		return false, nil
 	}
@@ -602,7 +733,7 @@ func (r *ImageReconciler) createImageFromSnapshot(ctx context.Context, log logr.
 	defer ioCtx2.Destroy()
 
 	if err = librbd.CloneImage(ioCtx2, SnapshotIDToRBDID(snapshot.ID), ImageSnapshotVersion, ioCtx, ImageIDToRBDID(image.ID), options); err != nil {
-		return false, fmt.Errorf("failed to clone rbd image: %w", err)
+		return false, transientError(ReasonCloneFailed, fmt.Errorf("failed to clone rbd image: %w", err))
 	}
 
 	img, err := librbd.OpenImage(ioCtx, ImageIDToRBDID(image.ID), librbd.NoSnapshot)
@@ -612,9 +743,9 @@ func (r *ImageReconciler) createImageFromSnapshot(ctx context.Context, log logr.
 
 	if err := img.Resize(round.OffBytes(image.Spec.Size)); err != nil {
 		if closeErr := img.Close(); closeErr != nil {
-			return false, errors.Join(err, fmt.Errorf("unable to close image: %w", closeErr))
+			return false, transientError(ReasonCloneFailed, errors.Join(err, fmt.Errorf("unable to close image: %w", closeErr)))
 		}
-		return false, fmt.Errorf("failed to resize rbd image: %w", err)
+		return false, transientError(ReasonCloneFailed, fmt.Errorf("failed to resize rbd image: %w", err))
 	}
 	log.V(2).Info("Resized cloned image", "bytes", image.Spec.Size)
 
@@ -0,0 +1,281 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	orphanKindImage    = "image"
+	orphanKindSnapshot = "snapshot"
+)
+
+type OrphanSweeperOptions struct {
+	Pool string
+	// Interval is the time between two sweeps.
+	Interval time.Duration
+	// GracePeriod is the minimum age of an orphaned rbd image before it is
+	// deleted.
+	GracePeriod time.Duration
+	// Delete enables deleting orphaned rbd images. Otherwise they are only
+	// reported.
+	Delete bool
+}
+
+func setOrphanSweeperOptionsDefaults(o *OrphanSweeperOptions) {
+	if o.Interval == 0 {
+		o.Interval = 10 * time.Minute
+	}
+	if o.GracePeriod == 0 {
+		o.GracePeriod = 24 * time.Hour
+	}
+}
+
+func NewOrphanSweeper(
+	log logr.Logger,
+	conn *rados.Conn,
+	images store.Store[*api.Image],
+	snapshots store.Store[*api.Snapshot],
+	opts OrphanSweeperOptions,
+) (*OrphanSweeper, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("must specify conn")
+	}
+
+	if images == nil {
+		return nil, fmt.Errorf("must specify image store")
+	}
+
+	if snapshots == nil {
+		return nil, fmt.Errorf("must specify snapshot store")
+	}
+
+	if opts.Pool == "" {
+		return nil, fmt.Errorf("must specify pool")
+	}
+
+	setOrphanSweeperOptionsDefaults(&opts)
+
+	return &OrphanSweeper{
+		log:         log,
+		conn:        conn,
+		images:      images,
+		snapshots:   snapshots,
+		pool:        opts.Pool,
+		interval:    opts.Interval,
+		gracePeriod: opts.GracePeriod,
+		delete:      opts.Delete,
+
+		orphanedImages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cephlet_orphaned_rbd_images",
+			Help: "Number of rbd images with the cephlet prefixes that have no store entry.",
+		}, []string{"kind"}),
+		danglingEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cephlet_dangling_store_entries",
+			Help: "Number of store entries whose rbd image is missing.",
+		}, []string{"kind"}),
+		deletedImages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cephlet_orphaned_rbd_images_deleted_total",
+			Help: "Number of orphaned rbd images deleted.",
+		}, []string{"kind"}),
+	}, nil
+}
+
+// OrphanSweeper periodically compares the rbd images of the pool with the
+// image and snapshot stores. It reports rbd images without store entry as well
+// as store entries whose rbd image is missing, and optionally deletes orphaned
+// rbd images once they are older than the grace period.
+type OrphanSweeper struct {
+	log  logr.Logger
+	conn *rados.Conn
+
+	images    store.Store[*api.Image]
+	snapshots store.Store[*api.Snapshot]
+
+	pool        string
+	interval    time.Duration
+	gracePeriod time.Duration
+	delete      bool
+
+	orphanedImages  *prometheus.GaugeVec
+	danglingEntries *prometheus.GaugeVec
+	deletedImages   *prometheus.CounterVec
+}
+
+func (s *OrphanSweeper) Describe(ch chan<- *prometheus.Desc) {
+	s.orphanedImages.Describe(ch)
+	s.danglingEntries.Describe(ch)
+	s.deletedImages.Describe(ch)
+}
+
+func (s *OrphanSweeper) Collect(ch chan<- prometheus.Metric) {
+	s.orphanedImages.Collect(ch)
+	s.danglingEntries.Collect(ch)
+	s.deletedImages.Collect(ch)
+}
+
+func (s *OrphanSweeper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			s.log.Error(err, "failed to sweep orphans")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep compares the rbd images with the stores once.
+func (s *OrphanSweeper) Sweep(ctx context.Context) error {
+	log := s.log
+
+	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	if err != nil {
+		return fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	// The rbd images are listed before the stores: store entries are created
+	// before and removed after their rbd images, so every listed rbd image
+	// still having an entry shows up in the stores.
+	names, err := librbd.GetImageNames(ioCtx)
+	if err != nil {
+		return fmt.Errorf("failed to list rbd images: %w", err)
+	}
+
+	rbdImageIDs, rbdSnapshotIDs := sets.New[string](), sets.New[string]()
+	for _, name := range names {
+		switch {
+		case strings.HasPrefix(name, ImageRBDIDPrefix):
+			rbdImageIDs.Insert(strings.TrimPrefix(name, ImageRBDIDPrefix))
+		case strings.HasPrefix(name, SnapshotRBDIDPrefix):
+			rbdSnapshotIDs.Insert(strings.TrimPrefix(name, SnapshotRBDIDPrefix))
+		}
+	}
+
+	images, err := s.images.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+
+	snapshots, err := s.snapshots.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	imageIDs, danglingImages := sets.New[string](), 0
+	for _, image := range images {
+		imageIDs.Insert(image.ID)
+		if image.Status.State == api.ImageStateAvailable && !rbdImageIDs.Has(image.ID) {
+			log.Info("Rbd image of image is missing", "ImageID", image.ID, "RbdImage", ImageIDToRBDID(image.ID))
+			danglingImages++
+		}
+	}
+	s.danglingEntries.WithLabelValues(orphanKindImage).Set(float64(danglingImages))
+
+	snapshotIDs, danglingSnapshots := sets.New[string](), 0
+	for _, snapshot := range snapshots {
+		snapshotIDs.Insert(snapshot.ID)
+		if snapshot.Status.State == api.SnapshotStatePopulated && !rbdSnapshotIDs.Has(snapshot.ID) {
+			log.Info("Rbd image of snapshot is missing", "SnapshotID", snapshot.ID, "RbdImage", SnapshotIDToRBDID(snapshot.ID))
+			danglingSnapshots++
+		}
+	}
+	s.danglingEntries.WithLabelValues(orphanKindSnapshot).Set(float64(danglingSnapshots))
+
+	var errs []error
+	for _, orphans := range []struct {
+		kind  string
+		names []string
+	}{
+		{kind: orphanKindImage, names: prefixAll(ImageRBDIDPrefix, sets.List(rbdImageIDs.Difference(imageIDs)))},
+		{kind: orphanKindSnapshot, names: prefixAll(SnapshotRBDIDPrefix, sets.List(rbdSnapshotIDs.Difference(snapshotIDs)))},
+	} {
+		s.orphanedImages.WithLabelValues(orphans.kind).Set(float64(len(orphans.names)))
+
+		for _, name := range orphans.names {
+			if err := s.sweepOrphan(log.WithValues("Kind", orphans.kind, "RbdImage", name), ioCtx, orphans.kind, name); err != nil {
+				errs = append(errs, fmt.Errorf("rbd image %s: %w", name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func prefixAll(prefix string, ids []string) []string {
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, prefix+id)
+	}
+	return names
+}
+
+func (s *OrphanSweeper) sweepOrphan(log logr.Logger, ioCtx *rados.IOContext, kind, name string) error {
+	img, err := librbd.OpenImage(ioCtx, name, librbd.NoSnapshot)
+	if err != nil {
+		if errors.Is(err, librbd.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to open rbd image: %w", err)
+	}
+
+	created, err := img.GetCreateTimestamp()
+	if err != nil {
+		_ = img.Close()
+		return fmt.Errorf("failed to get creation time: %w", err)
+	}
+	age := time.Since(time.Unix(created.Sec, created.Nsec))
+
+	if !s.delete || age < s.gracePeriod {
+		log.Info("Found orphaned rbd image", "Age", age.Round(time.Second))
+		return img.Close()
+	}
+
+	log.Info("Deleting orphaned rbd image", "Age", age.Round(time.Second))
+	if err := cleanupSnapshotResources(log, img); err != nil {
+		_ = img.Close()
+		return err
+	}
+	if err := img.Close(); err != nil {
+		return fmt.Errorf("unable to close rbd image: %w", err)
+	}
+	if err := img.Remove(); err != nil {
+		return fmt.Errorf("unable to remove rbd image: %w", err)
+	}
+
+	s.deletedImages.WithLabelValues(kind).Inc()
+	log.Info("Deleted orphaned rbd image")
+	return nil
+}
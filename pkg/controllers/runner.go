@@ -0,0 +1,202 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/store"
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Result is the result of a single reconciliation.
+type Result struct {
+	// RequeueAfter reconciles the object again after the given duration if it
+	// is greater than zero.
+	RequeueAfter time.Duration
+}
+
+// ReconcileFunc reconciles the object with the given id. Errors are retried
+// with backoff, except for conflicts which are retried immediately.
+type ReconcileFunc func(ctx context.Context, id string) (Result, error)
+
+type RunnerOptions struct {
+	// Workers is the number of objects reconciled concurrently.
+	Workers int
+
+	// BaseDelay and MaxDelay bound the exponential backoff of a failing
+	// object.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// QPS and Burst limit the overall rate of retries.
+	QPS   float64
+	Burst int
+
+	// MaxRetries is the number of times a failing object is retried before it
+	// is dropped until it is enqueued again. Zero retries without limit.
+	MaxRetries int
+
+	// DrainTimeout is the time in-flight reconciliations are given to finish
+	// on shutdown before their context is cancelled.
+	DrainTimeout time.Duration
+
+	// LogKey is the key the id of the reconciled object is logged with.
+	LogKey string
+}
+
+func setRunnerOptionsDefaults(o *RunnerOptions) {
+	if o.Workers == 0 {
+		o.Workers = 15
+	}
+	if o.BaseDelay == 0 {
+		o.BaseDelay = 5 * time.Millisecond
+	}
+	if o.MaxDelay == 0 {
+		o.MaxDelay = 1000 * time.Second
+	}
+	if o.QPS == 0 {
+		o.QPS = 10
+	}
+	if o.Burst == 0 {
+		o.Burst = 100
+	}
+	if o.DrainTimeout == 0 {
+		o.DrainTimeout = 30 * time.Second
+	}
+	if o.LogKey == "" {
+		o.LogKey = "id"
+	}
+}
+
+// NewRunner returns a Runner calling reconcile for every enqueued id.
+func NewRunner(log logr.Logger, reconcile ReconcileFunc, opts RunnerOptions) (*Runner, error) {
+	if reconcile == nil {
+		return nil, fmt.Errorf("must specify reconcile")
+	}
+
+	setRunnerOptionsDefaults(&opts)
+
+	if opts.Workers < 0 {
+		return nil, fmt.Errorf("must specify a positive number of workers")
+	}
+	if opts.MaxRetries < 0 {
+		return nil, fmt.Errorf("must specify a non-negative number of retries")
+	}
+
+	return &Runner{
+		log:       log,
+		reconcile: reconcile,
+		queue: workqueue.NewRateLimitingQueue(workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(opts.BaseDelay, opts.MaxDelay),
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(opts.QPS), opts.Burst)},
+		)),
+		workers:      opts.Workers,
+		maxRetries:   opts.MaxRetries,
+		drainTimeout: opts.DrainTimeout,
+		logKey:       opts.LogKey,
+	}, nil
+}
+
+// Runner reconciles enqueued object ids with a pool of workers. Each id is
+// reconciled by at most one worker at a time.
+type Runner struct {
+	log       logr.Logger
+	reconcile ReconcileFunc
+	queue     workqueue.RateLimitingInterface
+
+	workers      int
+	maxRetries   int
+	drainTimeout time.Duration
+	logKey       string
+}
+
+// Enqueue schedules the object with the given id for reconciliation.
+func (r *Runner) Enqueue(id string) {
+	r.queue.Add(id)
+}
+
+// Start runs the workers until ctx is done. Queued objects are no longer
+// picked up afterwards, while in-flight reconciliations are given the drain
+// timeout to finish. Start returns once all workers are stopped.
+func (r *Runner) Start(ctx context.Context) error {
+	reconcileCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		r.queue.ShutDown()
+
+		select {
+		case <-reconcileCtx.Done():
+		case <-time.After(r.drainTimeout):
+			r.log.Info("Drain timeout exceeded, cancelling in-flight reconciliations")
+			cancel()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r.processNextWorkItem(ctx, reconcileCtx) {
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func (r *Runner) processNextWorkItem(ctx, reconcileCtx context.Context) bool {
+	item, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(item)
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	id := item.(string)
+	log := r.log.WithValues(r.logKey, id)
+
+	res, err := r.reconcile(logr.NewContext(reconcileCtx, log), id)
+	switch {
+	case err == nil:
+		r.queue.Forget(item)
+		if res.RequeueAfter > 0 {
+			r.queue.AddAfter(item, res.RequeueAfter)
+		}
+	case store.IsConflict(err) && (r.maxRetries == 0 || r.queue.NumRequeues(item) < r.maxRetries):
+		// Conflicts are retried with backoff like any other failure, so
+		// workers do not spin on a contended object.
+		log.V(1).Info("Object was modified concurrently, requeueing", "error", err.Error())
+		r.queue.AddRateLimited(item)
+	case r.maxRetries > 0 && r.queue.NumRequeues(item) >= r.maxRetries:
+		log.Error(err, "failed to reconcile, giving up after maximum retries", "retries", r.queue.NumRequeues(item))
+		r.queue.Forget(item)
+	default:
+		log.Error(err, "failed to reconcile")
+		r.queue.AddRateLimited(item)
+	}
+	return true
+}
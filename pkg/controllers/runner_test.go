@@ -0,0 +1,130 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onmetal/cephlet/pkg/controllers"
+	"github.com/onmetal/cephlet/pkg/store"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Runner", func() {
+	start := func(runner *Runner) (cancel func(), done <-chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(stopped)
+			Expect(runner.Start(ctx)).To(Succeed())
+		}()
+		DeferCleanup(func() {
+			cancel()
+			Eventually(stopped).Should(BeClosed())
+		})
+		return cancel, stopped
+	}
+
+	It("should requeue an object after the requested duration", func() {
+		var calls atomic.Int32
+		runner, err := NewRunner(logr.Discard(), func(ctx context.Context, id string) (Result, error) {
+			if calls.Add(1) < 3 {
+				return Result{RequeueAfter: 10 * time.Millisecond}, nil
+			}
+			return Result{}, nil
+		}, RunnerOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		start(runner)
+
+		runner.Enqueue("foo")
+		Eventually(calls.Load).Should(BeEquivalentTo(3))
+		Consistently(calls.Load, 50*time.Millisecond).Should(BeEquivalentTo(3))
+	})
+
+	It("should give up on an object after the maximum retries", func() {
+		var calls atomic.Int32
+		runner, err := NewRunner(logr.Discard(), func(ctx context.Context, id string) (Result, error) {
+			calls.Add(1)
+			return Result{}, errors.New("failed")
+		}, RunnerOptions{BaseDelay: time.Millisecond, MaxRetries: 2})
+		Expect(err).NotTo(HaveOccurred())
+		start(runner)
+
+		runner.Enqueue("foo")
+		Eventually(calls.Load).Should(BeEquivalentTo(3))
+		Consistently(calls.Load, 50*time.Millisecond).Should(BeEquivalentTo(3))
+	})
+
+	It("should retry conflicts with backoff up to the maximum retries", func() {
+		var calls atomic.Int32
+		runner, err := NewRunner(logr.Discard(), func(ctx context.Context, id string) (Result, error) {
+			calls.Add(1)
+			return Result{}, fmt.Errorf("object changed: %w", store.ErrConflict)
+		}, RunnerOptions{BaseDelay: 20 * time.Millisecond, MaxRetries: 3})
+		Expect(err).NotTo(HaveOccurred())
+		start(runner)
+
+		runner.Enqueue("foo")
+		Eventually(calls.Load).Should(BeEquivalentTo(1))
+		Consistently(calls.Load, 10*time.Millisecond).Should(BeEquivalentTo(1))
+		Eventually(calls.Load).Should(BeEquivalentTo(4))
+		Consistently(calls.Load, 200*time.Millisecond).Should(BeEquivalentTo(4))
+	})
+
+	It("should let in-flight reconciliations finish on shutdown", func() {
+		started := make(chan struct{})
+		var finished atomic.Bool
+		runner, err := NewRunner(logr.Discard(), func(ctx context.Context, id string) (Result, error) {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			finished.Store(ctx.Err() == nil)
+			return Result{}, nil
+		}, RunnerOptions{Workers: 1})
+		Expect(err).NotTo(HaveOccurred())
+		cancel, stopped := start(runner)
+
+		runner.Enqueue("foo")
+		Eventually(started).Should(BeClosed())
+		runner.Enqueue("bar")
+		cancel()
+
+		Eventually(stopped).Should(BeClosed())
+		Expect(finished.Load()).To(BeTrue())
+	})
+
+	It("should cancel in-flight reconciliations after the drain timeout", func() {
+		started := make(chan struct{})
+		runner, err := NewRunner(logr.Discard(), func(ctx context.Context, id string) (Result, error) {
+			close(started)
+			<-ctx.Done()
+			return Result{}, ctx.Err()
+		}, RunnerOptions{DrainTimeout: 10 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		cancel, stopped := start(runner)
+
+		runner.Enqueue("foo")
+		Eventually(started).Should(BeClosed())
+		cancel()
+
+		Eventually(stopped).Should(BeClosed())
+	})
+})
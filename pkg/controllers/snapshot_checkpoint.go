@@ -0,0 +1,175 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Checkpoints of a population are kept in the metadata of the rbd image of
+// the snapshot, so a population interrupted by a restart can be resumed.
+const (
+	checkpointSourceKey  = "cephlet.populate.source"
+	checkpointOffsetKey  = "cephlet.populate.offset"
+	checkpointHashKey    = "cephlet.populate.hash"
+	checkpointSkippedKey = "cephlet.populate.skipped"
+
+	// populatedSourceKey is set to the digest of the source once the image
+	// is completely populated with it.
+	populatedSourceKey = "cephlet.populated.source"
+)
+
+// checkpoint is the state of a population up to offset. hashState is the
+// marshalled state of the hash of the content written so far, skipped the
+// number of zero bytes that were not written.
+type checkpoint struct {
+	source    digest.Digest
+	offset    int64
+	skipped   int64
+	hashState []byte
+}
+
+// readCheckpoint returns the checkpoint of img or nil if it has none.
+func readCheckpoint(img populationImage) (*checkpoint, error) {
+	get := func(key string) (string, bool, error) {
+		value, err := img.GetMetadata(key)
+		if err != nil {
+			if errors.Is(err, librbd.ErrNotFound) {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("failed to get metadata %s: %w", key, err)
+		}
+		return value, true, nil
+	}
+
+	// The offset is written last, so a checkpoint without it is incomplete.
+	offset, ok, err := get(checkpointOffsetKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	source, ok, err := get(checkpointSourceKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	hashState, ok, err := get(checkpointHashKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	cp := &checkpoint{source: digest.Digest(source)}
+	if cp.offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint offset %q: %w", offset, err)
+	}
+	// Checkpoints written before zero blocks were skipped lack the count.
+	skipped, ok, err := get(checkpointSkippedKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if cp.skipped, err = strconv.ParseInt(skipped, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid checkpoint skipped bytes %q: %w", skipped, err)
+		}
+	}
+	if cp.hashState, err = base64.StdEncoding.DecodeString(hashState); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint hash: %w", err)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint flushes the content written to img and records cp.
+func writeCheckpoint(img populationImage, cp checkpoint) error {
+	if err := img.Flush(); err != nil {
+		return fmt.Errorf("failed to flush image: %w", err)
+	}
+
+	// Invalidate the previous checkpoint while the other keys are replaced.
+	if err := img.RemoveMetadata(checkpointOffsetKey); err != nil && !errors.Is(err, librbd.ErrNotFound) {
+		return fmt.Errorf("failed to remove metadata %s: %w", checkpointOffsetKey, err)
+	}
+
+	for _, kv := range []struct{ key, value string }{
+		{checkpointSourceKey, cp.source.String()},
+		{checkpointHashKey, base64.StdEncoding.EncodeToString(cp.hashState)},
+		{checkpointSkippedKey, strconv.FormatInt(cp.skipped, 10)},
+		{checkpointOffsetKey, strconv.FormatInt(cp.offset, 10)},
+	} {
+		if err := img.SetMetadata(kv.key, kv.value); err != nil {
+			return fmt.Errorf("failed to set metadata %s: %w", kv.key, err)
+		}
+	}
+	return nil
+}
+
+func clearCheckpoint(img populationImage) error {
+	for _, key := range []string{checkpointOffsetKey, checkpointHashKey, checkpointSkippedKey, checkpointSourceKey} {
+		if err := img.RemoveMetadata(key); err != nil && !errors.Is(err, librbd.ErrNotFound) {
+			return fmt.Errorf("failed to remove metadata %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// markPopulated records that img is completely populated with the source
+// identified by sourceDigest.
+func markPopulated(img populationImage, sourceDigest string) error {
+	if err := img.Flush(); err != nil {
+		return fmt.Errorf("failed to flush image: %w", err)
+	}
+	if err := img.SetMetadata(populatedSourceKey, sourceDigest); err != nil {
+		return fmt.Errorf("failed to set metadata %s: %w", populatedSourceKey, err)
+	}
+	return nil
+}
+
+// populatedSource returns the digest of the source img is completely
+// populated with, or an empty string if it is not.
+func populatedSource(img populationImage) (string, error) {
+	source, err := img.GetMetadata(populatedSourceKey)
+	if err != nil {
+		if errors.Is(err, librbd.ErrNotFound) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get metadata %s: %w", populatedSourceKey, err)
+	}
+	return source, nil
+}
+
+// newContentHash returns the hash to verify content with the given digest
+// with. The hash is restored from hashState if set.
+func newContentHash(source digest.Digest, hashState []byte) (hash.Hash, error) {
+	if err := source.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid content digest: %w", err)
+	}
+
+	h := source.Algorithm().Hash()
+	if len(hashState) > 0 {
+		unmarshaler, ok := h.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return nil, fmt.Errorf("hash of %s cannot be restored", source.Algorithm())
+		}
+		if err := unmarshaler.UnmarshalBinary(hashState); err != nil {
+			return nil, fmt.Errorf("failed to restore hash: %w", err)
+		}
+	}
+	return h, nil
+}
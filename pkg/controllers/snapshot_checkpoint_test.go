@@ -0,0 +1,103 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ = Describe("checkpoint", func() {
+	source := digest.FromString("source")
+
+	It("should read the checkpoint that was written", func() {
+		img := newFakeImage(0)
+		cp := checkpoint{source: source, offset: 1024, skipped: 512, hashState: []byte("state")}
+		Expect(writeCheckpoint(img, cp)).To(Succeed())
+		Expect(img.flushes).To(Equal(1))
+
+		Expect(readCheckpoint(img)).To(Equal(&cp))
+	})
+
+	It("should ignore an incomplete checkpoint", func() {
+		img := newFakeImage(0)
+		Expect(writeCheckpoint(img, checkpoint{source: source, offset: 1024})).To(Succeed())
+		Expect(img.RemoveMetadata(checkpointOffsetKey)).To(Succeed())
+
+		Expect(readCheckpoint(img)).To(BeNil())
+	})
+
+	It("should read a checkpoint without skipped bytes", func() {
+		img := newFakeImage(0)
+		Expect(writeCheckpoint(img, checkpoint{source: source, offset: 1024, skipped: 512})).To(Succeed())
+		Expect(img.RemoveMetadata(checkpointSkippedKey)).To(Succeed())
+
+		Expect(readCheckpoint(img)).To(Equal(&checkpoint{source: source, offset: 1024, hashState: []byte{}}))
+	})
+
+	It("should reject a malformed checkpoint", func() {
+		img := newFakeImage(0)
+		Expect(writeCheckpoint(img, checkpoint{source: source, offset: 1024})).To(Succeed())
+		Expect(img.SetMetadata(checkpointOffsetKey, "foo")).To(Succeed())
+
+		_, err := readCheckpoint(img)
+		Expect(err).To(MatchError(ContainSubstring("invalid checkpoint offset")))
+	})
+
+	It("should clear the checkpoint", func() {
+		img := newFakeImage(0)
+		Expect(writeCheckpoint(img, checkpoint{source: source, offset: 1024, skipped: 512, hashState: []byte("state")})).To(Succeed())
+		Expect(markPopulated(img, "sha256:foo")).To(Succeed())
+
+		Expect(clearCheckpoint(img)).To(Succeed())
+		Expect(clearCheckpoint(img)).To(Succeed())
+		Expect(img.metadata).To(Equal(map[string]string{populatedSourceKey: "sha256:foo"}))
+	})
+
+	It("should record the populated source", func() {
+		img := newFakeImage(0)
+		Expect(populatedSource(img)).To(BeEmpty())
+
+		Expect(markPopulated(img, "sha256:foo")).To(Succeed())
+		Expect(populatedSource(img)).To(Equal("sha256:foo"))
+	})
+
+	It("should restore a content hash from its state", func() {
+		src := []byte("some content to hash in two parts")
+		source := digest.FromBytes(src)
+
+		h, err := newContentHash(source, nil)
+		Expect(err).NotTo(HaveOccurred())
+		h.Write(src[:10])
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		Expect(err).NotTo(HaveOccurred())
+
+		restored, err := newContentHash(source, state)
+		Expect(err).NotTo(HaveOccurred())
+		restored.Write(src[10:])
+		Expect(digest.NewDigest(source.Algorithm(), restored)).To(Equal(source))
+	})
+
+	It("should reject an invalid content digest", func() {
+		_, err := newContentHash("foo", nil)
+		Expect(err).To(MatchError(ContainSubstring("invalid content digest")))
+
+		_, err = newContentHash(source, []byte("garbage"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,436 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/onmetal/cephlet/pkg/qcow2"
+	"github.com/onmetal/onmetal-image/oci/image"
+)
+
+// RootFSUncompressedSizeAnnotation is the annotation of a compressed root fs
+// layer holding the size of its uncompressed content in bytes. Without it,
+// the size is computed by decompressing the layer once before populating, so
+// the layer is downloaded twice. The same applies to compressed url sources,
+// which cannot be annotated.
+const RootFSUncompressedSizeAnnotation = "cephlet.onmetal.de/uncompressed-size"
+
+type compression string
+
+const (
+	compressionNone compression = ""
+	compressionGzip compression = "gzip"
+	compressionZstd compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// magicSize is the number of bytes peeked to detect the format of content.
+const magicSize = 4
+
+// peekMagic returns the first bytes of the content of r without consuming
+// them.
+func peekMagic(r *bufio.Reader) ([]byte, error) {
+	magic, err := r.Peek(magicSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read magic bytes: %w", err)
+	}
+	return magic, nil
+}
+
+// detectCompression detects the compression of content from its magic
+// bytes. onmetal-image only accepts the plain root fs media type, so the
+// media type does not tell whether a layer is compressed.
+func detectCompression(magic []byte) compression {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return compressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return compressionZstd
+	default:
+		return compressionNone
+	}
+}
+
+// sizedReader fails permanently if its content exceeds size, which the rbd
+// image of the snapshot is created with.
+type sizedReader struct {
+	io.Reader
+	size uint64
+	read uint64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.read+uint64(n) > r.size {
+		return int(r.size - r.read), permanentError(ReasonUnsupportedFormat,
+			fmt.Errorf("uncompressed content exceeds its size of %d bytes", r.size))
+	}
+	r.read += uint64(n)
+	return n, err
+}
+
+// decompressingReader decompresses a layer while streaming it. As the
+// decompressed content has no known digest, the digest of the compressed
+// content is verified once it was read completely. The compressed content
+// may be followed by zero padding.
+type decompressingReader struct {
+	decompressor io.Reader
+	compressed   *bufio.Reader
+	verifier     interface {
+		io.Writer
+		Verified() bool
+	}
+	closers []func() error
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	n, err := r.decompressor.Read(p)
+	if errors.Is(err, io.EOF) {
+		padded, err := readPadding(r.compressed)
+		if err != nil {
+			return n, err
+		}
+		if !r.verifier.Verified() {
+			return n, fmt.Errorf("compressed content does not match its digest")
+		}
+		if !padded {
+			return n, permanentError(ReasonUnsupportedFormat, fmt.Errorf("unexpected data after compressed content"))
+		}
+	}
+	return n, err
+}
+
+func (r *decompressingReader) Close() error {
+	var errs []error
+	for _, closer := range r.closers {
+		errs = append(errs, closer())
+	}
+	return errors.Join(errs...)
+}
+
+// readPadding reads the rest of r and reports whether it consists of zeros.
+func readPadding(r io.Reader) (bool, error) {
+	padded := true
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if len(bytes.TrimLeft(buf[:n], "\x00")) > 0 {
+			padded = false
+		}
+		if errors.Is(err, io.EOF) {
+			return padded, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read compressed content: %w", err)
+		}
+	}
+}
+
+// gzipMembers decompresses consecutive gzip members and stops at the first
+// position that does not start a member.
+type gzipMembers struct {
+	zr *gzip.Reader
+	r  *bufio.Reader
+}
+
+func newGzipMembers(r *bufio.Reader) (*gzipMembers, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gzip header: %w", err)
+	}
+	zr.Multistream(false)
+	return &gzipMembers{zr: zr, r: r}, nil
+}
+
+func (g *gzipMembers) Read(p []byte) (int, error) {
+	for {
+		n, err := g.zr.Read(p)
+		if !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		if magic, _ := g.r.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+			return n, io.EOF
+		}
+		if err := g.zr.Reset(g.r); err != nil {
+			return n, fmt.Errorf("failed to read gzip header: %w", err)
+		}
+		g.zr.Multistream(false)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (g *gzipMembers) Close() error {
+	return g.zr.Close()
+}
+
+// zstdFrames passes the zstd frames of r through and ends at the first
+// position that does not start a frame. The zstd decoder would fail on
+// padding as an invalid frame otherwise.
+type zstdFrames struct {
+	r *bufio.Reader
+	// remaining is the number of bytes left of the current part of a frame.
+	remaining int
+	next      zstdFramePart
+	checksum  bool
+}
+
+type zstdFramePart int
+
+const (
+	zstdFrameStart zstdFramePart = iota
+	zstdBlock
+	zstdChecksum
+)
+
+var zstdSkippableMagic = []byte{0x2a, 0x4d, 0x18}
+
+func (f *zstdFrames) Read(p []byte) (int, error) {
+	if f.remaining == 0 {
+		if err := f.nextPart(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.r.Read(p[:min(len(p), f.remaining)])
+	f.remaining -= n
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextPart determines the size of the next part of the current frame, or of
+// the next frame.
+func (f *zstdFrames) nextPart() error {
+	peek := func(n int) ([]byte, error) {
+		b, err := f.r.Peek(n)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return b, err
+	}
+
+	switch f.next {
+	case zstdFrameStart:
+		magic, err := f.r.Peek(len(zstdMagic))
+		switch {
+		case errors.Is(err, io.EOF):
+			return io.EOF
+		case err != nil:
+			return err
+		case bytes.Equal(magic[1:], zstdSkippableMagic) && magic[0]&0xf0 == 0x50:
+			header, err := peek(8)
+			if err != nil {
+				return err
+			}
+			f.remaining = 8 + int(binary.LittleEndian.Uint32(header[4:]))
+			return nil
+		case !bytes.Equal(magic, zstdMagic):
+			return io.EOF
+		}
+
+		header, err := peek(len(zstdMagic) + 1)
+		if err != nil {
+			return err
+		}
+		descriptor := header[len(zstdMagic)]
+		singleSegment := descriptor&0x20 != 0
+		f.checksum = descriptor&0x04 != 0
+
+		f.remaining = len(zstdMagic) + 1
+		if !singleSegment {
+			f.remaining++
+		}
+		f.remaining += []int{0, 1, 2, 4}[descriptor&0x03]
+		switch fcsFlag := descriptor >> 6; {
+		case fcsFlag == 0 && singleSegment:
+			f.remaining++
+		case fcsFlag > 0:
+			f.remaining += 1 << fcsFlag
+		}
+		f.next = zstdBlock
+	case zstdBlock:
+		header, err := peek(3)
+		if err != nil {
+			return err
+		}
+		blockHeader := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		size := int(blockHeader >> 3)
+		if blockType := (blockHeader >> 1) & 0x03; blockType == 1 {
+			size = 1
+		}
+		f.remaining = 3 + size
+
+		if last := blockHeader&0x01 != 0; last {
+			f.next = zstdFrameStart
+			if f.checksum {
+				f.next = zstdChecksum
+			}
+		}
+	case zstdChecksum:
+		f.remaining = 4
+		f.next = zstdFrameStart
+	}
+	return nil
+}
+
+// openLayerContent opens the content of layer to populate a snapshot with.
+// Compressed content is decompressed while streaming and qcow2 images are
+// converted to raw. unmodified reports whether the content is the one of the
+// layer, which has to be verified against the layer digest. Otherwise it was
+// verified already or is verified while reading it.
+func openLayerContent(ctx context.Context, layer image.Layer, spool qcow2Spool) (content io.ReadCloser, size uint64, unmodified bool, err error) {
+	raw, err := layer.Content(ctx)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to get content: %w", err)
+	}
+
+	br := bufio.NewReader(raw)
+	magic, err := peekMagic(br)
+	if err != nil {
+		return nil, 0, false, errors.Join(err, raw.Close())
+	}
+
+	comp := detectCompression(magic)
+	if comp == compressionNone {
+		if qcow2.IsQcow2(magic) {
+			verifier := layer.Descriptor().Digest.Verifier()
+			content, size, err := spool.spool(io.TeeReader(br, verifier), func() error {
+				if !verifier.Verified() {
+					return fmt.Errorf("content does not match its digest")
+				}
+				return nil
+			})
+			return content, size, false, errors.Join(err, raw.Close())
+		}
+
+		size := uint64(layer.Descriptor().Size)
+		// Keep the content seekable, so populations can be resumed.
+		if seeker, ok := raw.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, 0, false, errors.Join(fmt.Errorf("failed to rewind content: %w", err), raw.Close())
+			}
+			return raw, size, true, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, raw}, size, true, nil
+	}
+
+	decompressed, err := newDecompressingReader(layer, br, raw, comp)
+	if err != nil {
+		return nil, 0, false, errors.Join(err, raw.Close())
+	}
+
+	dbr := bufio.NewReader(decompressed)
+	if magic, err = peekMagic(dbr); err != nil {
+		return nil, 0, false, errors.Join(err, decompressed.Close())
+	}
+	if qcow2.IsQcow2(magic) {
+		// The compressed content is verified once spooled completely.
+		content, size, err := spool.spool(dbr, nil)
+		return content, size, false, errors.Join(err, decompressed.Close())
+	}
+
+	size, err = uncompressedSize(ctx, layer, comp)
+	if err != nil {
+		return nil, 0, false, errors.Join(err, decompressed.Close())
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&sizedReader{Reader: dbr, size: size}, decompressed}, size, false, nil
+}
+
+func newDecompressingReader(layer image.Layer, br *bufio.Reader, raw io.Closer, comp compression) (*decompressingReader, error) {
+	verifier := layer.Descriptor().Digest.Verifier()
+	// The decompressors read from a buffered reader, so the content they
+	// did not consume is left to be read as padding.
+	compressed := bufio.NewReader(io.TeeReader(br, verifier))
+
+	r := &decompressingReader{
+		compressed: compressed,
+		verifier:   verifier,
+		closers:    []func() error{raw.Close},
+	}
+	switch comp {
+	case compressionGzip:
+		zr, err := newGzipMembers(compressed)
+		if err != nil {
+			return nil, err
+		}
+		r.decompressor = zr
+		r.closers = append(r.closers, zr.Close)
+	case compressionZstd:
+		zr, err := zstd.NewReader(&zstdFrames{r: compressed}, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize zstd decoder: %w", err)
+		}
+		r.decompressor = zr
+		r.closers = append(r.closers, func() error {
+			zr.Close()
+			return nil
+		})
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", comp)
+	}
+	return r, nil
+}
+
+// uncompressedSize returns the size of the uncompressed content of layer,
+// either from its annotation or by downloading and decompressing it.
+func uncompressedSize(ctx context.Context, layer image.Layer, comp compression) (uint64, error) {
+	if value, ok := layer.Descriptor().Annotations[RootFSUncompressedSizeAnnotation]; ok {
+		size, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, permanentError(ReasonUnsupportedFormat,
+				fmt.Errorf("invalid %s annotation %q: %w", RootFSUncompressedSizeAnnotation, value, err))
+		}
+		return size, nil
+	}
+
+	raw, err := layer.Content(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get content: %w", err)
+	}
+	content, err := newDecompressingReader(layer, bufio.NewReader(raw), raw, comp)
+	if err != nil {
+		return 0, errors.Join(err, raw.Close())
+	}
+	defer func() { _ = content.Close() }()
+
+	size, err := io.Copy(io.Discard, content)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute uncompressed size: %w", err)
+	}
+	return uint64(size), nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testLayer is a layer with the given content and annotations.
+type testLayer struct {
+	content     []byte
+	digest      digest.Digest
+	annotations map[string]string
+}
+
+func newTestLayer(content []byte, annotations map[string]string) *testLayer {
+	return &testLayer{content: content, digest: digest.FromBytes(content), annotations: annotations}
+}
+
+func (l *testLayer) Descriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		Digest:      l.digest,
+		Size:        int64(len(l.content)),
+		Annotations: l.annotations,
+	}
+}
+
+func (l *testLayer) Content(context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.content)), nil
+}
+
+func gzipped(members ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, member := range members {
+		zw, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = zw.Write(member)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(zw.Close()).To(Succeed())
+	}
+	return buf.Bytes()
+}
+
+func zstded(content []byte, opts ...zstd.EOption) []byte {
+	zw, err := zstd.NewWriter(nil, opts...)
+	Expect(err).NotTo(HaveOccurred())
+	defer zw.Close()
+	return zw.EncodeAll(content, nil)
+}
+
+var _ = Describe("compression", func() {
+	// Stored gzip blocks keep the zeros of the content, so the compressed
+	// content has zero runs that are not padding.
+	uncompressed := append(bytes.Repeat([]byte("content"), 100), make([]byte, 1024)...)
+	uncompressed = append(uncompressed, "end"...)
+
+	decompress := func(layer *testLayer) ([]byte, error) {
+		r, err := newDecompressingReader(layer, bufio.NewReader(bytes.NewReader(layer.content)), io.NopCloser(nil), detectCompression(layer.content))
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { Expect(r.Close()).To(Succeed()) }()
+		return io.ReadAll(r)
+	}
+
+	DescribeTable("should detect the compression from the magic bytes",
+		func(content []byte, expected compression) {
+			Expect(detectCompression(content)).To(Equal(expected))
+		},
+		Entry("gzip", gzipped([]byte("foo")), compressionGzip),
+		Entry("zstd", zstded([]byte("foo")), compressionZstd),
+		Entry("raw", []byte("raw content"), compressionNone),
+		Entry("qcow2", []byte{'Q', 'F', 'I', 0xfb}, compressionNone),
+		Entry("truncated magic", []byte{0x28, 0xb5}, compressionNone),
+		Entry("empty", []byte{}, compressionNone),
+	)
+
+	DescribeTable("should decompress and verify the content",
+		func(compressed []byte, padding int) {
+			compressed = append(compressed, make([]byte, padding)...)
+			Expect(decompress(newTestLayer(compressed, nil))).To(Equal(uncompressed))
+		},
+		Entry("gzip with one byte of padding", gzipped(uncompressed), 1),
+		Entry("gzip", gzipped(uncompressed), 0),
+		Entry("gzip with short padding", gzipped(uncompressed), 3),
+		Entry("gzip with padding", gzipped(uncompressed), 64*1024),
+		Entry("gzip with multiple members", gzipped(uncompressed[:100], uncompressed[100:]), 512),
+		Entry("zstd", zstded(uncompressed), 0),
+		Entry("zstd with short padding", zstded(uncompressed), 3),
+		Entry("zstd with padding", zstded(uncompressed), 64*1024),
+		Entry("zstd without checksum", zstded(uncompressed, zstd.WithEncoderCRC(false)), 512),
+		Entry("zstd with multiple frames", append(zstded(uncompressed[:100]), zstded(uncompressed[100:])...), 512),
+		Entry("zstd with a skippable frame", bytes.Join([][]byte{
+			zstded(uncompressed[:100]),
+			{0x50, 0x2a, 0x4d, 0x18, 2, 0, 0, 0, 0, 0},
+			zstded(uncompressed[100:]),
+		}, nil), 512),
+	)
+
+	It("should decompress zstd content of multiple blocks", func() {
+		large := make([]byte, 4*1024*1024)
+		for i := range large {
+			large[i] = byte(i * i >> 7)
+		}
+		compressed := append(zstded(large), make([]byte, 512)...)
+		Expect(decompress(newTestLayer(compressed, nil))).To(Equal(large))
+	})
+
+	It("should fail permanently on data after the compressed content", func() {
+		compressed := append(gzipped(uncompressed), 0, 0, 1)
+
+		_, err := decompress(newTestLayer(compressed, nil))
+		rErr, ok := classifyError(err)
+		Expect(ok).To(BeTrue())
+		Expect(rErr.permanent).To(BeTrue())
+		Expect(rErr.reason).To(Equal(ReasonUnsupportedFormat))
+	})
+
+	It("should fail if the compressed content does not match its digest", func() {
+		layer := newTestLayer(append(gzipped(uncompressed), make([]byte, 512)...), nil)
+		layer.digest = digest.FromString("other")
+
+		_, err := decompress(layer)
+		Expect(err).To(MatchError(ContainSubstring("does not match its digest")))
+	})
+
+	It("should fail if the padding does not match the digest", func() {
+		compressed := append(gzipped(uncompressed), make([]byte, 512)...)
+		layer := newTestLayer(compressed, nil)
+		layer.content = append(compressed, 0)
+
+		_, err := decompress(layer)
+		Expect(err).To(MatchError(ContainSubstring("does not match its digest")))
+	})
+
+	Describe("uncompressedSize", func() {
+		It("should take the size from the annotation", func() {
+			layer := newTestLayer(gzipped(uncompressed), map[string]string{
+				RootFSUncompressedSizeAnnotation: "42",
+			})
+			Expect(uncompressedSize(context.Background(), layer, compressionGzip)).To(BeEquivalentTo(42))
+		})
+
+		It("should compute the size without annotation", func() {
+			layer := newTestLayer(append(zstded(uncompressed), make([]byte, 512)...), nil)
+			Expect(uncompressedSize(context.Background(), layer, compressionZstd)).To(BeEquivalentTo(len(uncompressed)))
+		})
+
+		It("should fail permanently for an invalid annotation", func() {
+			layer := newTestLayer(gzipped(uncompressed), map[string]string{
+				RootFSUncompressedSizeAnnotation: "-1",
+			})
+			_, err := uncompressedSize(context.Background(), layer, compressionGzip)
+			rErr, ok := classifyError(err)
+			Expect(ok).To(BeTrue())
+			Expect(rErr.permanent).To(BeTrue())
+			Expect(rErr.reason).To(Equal(ReasonUnsupportedFormat))
+		})
+	})
+
+	It("should fail permanently if the content exceeds its annotated size", func() {
+		layer := newTestLayer(gzipped(uncompressed), map[string]string{
+			RootFSUncompressedSizeAnnotation: strconv.Itoa(len(uncompressed) - 1),
+		})
+		content, size, unmodified, err := openLayerContent(context.Background(), layer, qcow2Spool{})
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { Expect(content.Close()).To(Succeed()) }()
+		Expect(size).To(BeEquivalentTo(len(uncompressed) - 1))
+		Expect(unmodified).To(BeFalse())
+
+		_, err = io.ReadAll(content)
+		rErr, ok := classifyError(err)
+		Expect(ok).To(BeTrue())
+		Expect(rErr.permanent).To(BeTrue())
+		Expect(rErr.reason).To(Equal(ReasonUnsupportedFormat))
+	})
+
+	It("should open compressed content with its annotated size", func() {
+		layer := newTestLayer(gzipped(uncompressed), map[string]string{
+			RootFSUncompressedSizeAnnotation: strconv.Itoa(len(uncompressed)),
+		})
+		content, size, _, err := openLayerContent(context.Background(), layer, qcow2Spool{})
+		Expect(err).NotTo(HaveOccurred())
+		defer func() { Expect(content.Close()).To(Succeed()) }()
+		Expect(size).To(BeEquivalentTo(len(uncompressed)))
+		Expect(io.ReadAll(content)).To(Equal(uncompressed))
+	})
+})
@@ -18,12 +18,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/ceph/go-ceph/rados"
 	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
 	"github.com/go-logr/logr"
 	"github.com/onmetal/cephlet/pkg/api"
 	"github.com/onmetal/cephlet/pkg/event"
@@ -32,13 +36,48 @@ import (
 	"github.com/onmetal/cephlet/pkg/utils"
 	onmetalimage "github.com/onmetal/onmetal-image"
 	"github.com/onmetal/onmetal-image/oci/image"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/exp/slices"
-	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
 )
 
 type SnapshotReconcilerOptions struct {
 	Pool                string
 	PopulatorBufferSize int64
+	// PopulatorConcurrency is the number of writes of PopulatorBufferSize
+	// kept in flight while populating a snapshot.
+	PopulatorConcurrency int
+	// MaxAttempts is the number of failed attempts to populate a snapshot
+	// after which it is moved to the failed state.
+	MaxAttempts int
+	// FailedRetryInterval is the interval after which a snapshot that ran
+	// out of attempts is retried.
+	FailedRetryInterval time.Duration
+	// ProgressInterval is the interval in which the progress of a
+	// population is recorded in the snapshot status.
+	ProgressInterval time.Duration
+	// CheckpointInterval is the interval in which a population records
+	// checkpoints to resume from after a restart.
+	CheckpointInterval time.Duration
+	// URLSourcePolicy restricts the hosts url sources are downloaded from.
+	// Url sources are rejected if nil.
+	URLSourcePolicy *URLSourcePolicy
+	// HTTPClient is used to download url sources. Defaults to the client of
+	// the URLSourcePolicy.
+	HTTPClient *http.Client
+	// SpoolDir is the directory qcow2 images are spooled to while they are
+	// converted. Defaults to the temporary directory.
+	SpoolDir string
+	// SpoolSizeLimit is the maximum size of a spooled qcow2 image in bytes.
+	// Zero spools images of any size.
+	SpoolSizeLimit int64
+	// ProgressStore is the store the population progress is recorded in. It
+	// should bypass auditing, as only the status changes. Defaults to the
+	// store of the reconciler.
+	ProgressStore store.Store[*api.Snapshot]
+
+	Runner RunnerOptions
 }
 
 func NewSnapshotReconciler(
@@ -73,16 +112,67 @@ func NewSnapshotReconciler(
 		opts.PopulatorBufferSize = 5 * 1024 * 1024
 	}
 
-	return &SnapshotReconciler{
-		log:                 log,
-		conn:                conn,
-		registry:            registry,
-		queue:               workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-		store:               store,
-		events:              events,
-		pool:                opts.Pool,
-		populatorBufferSize: opts.PopulatorBufferSize,
-	}, nil
+	if opts.PopulatorConcurrency == 0 {
+		opts.PopulatorConcurrency = 4
+	}
+
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = 5
+	}
+
+	if opts.FailedRetryInterval == 0 {
+		opts.FailedRetryInterval = 1 * time.Hour
+	}
+
+	if opts.ProgressInterval == 0 {
+		opts.ProgressInterval = 10 * time.Second
+	}
+
+	if opts.CheckpointInterval == 0 {
+		opts.CheckpointInterval = 30 * time.Second
+	}
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = opts.URLSourcePolicy.HTTPClient()
+	}
+
+	if opts.ProgressStore == nil {
+		opts.ProgressStore = store
+	}
+
+	r := &SnapshotReconciler{
+		log:                  log,
+		conn:                 conn,
+		registry:             registry,
+		store:                store,
+		progressStore:        opts.ProgressStore,
+		events:               events,
+		pool:                 opts.Pool,
+		populatorBufferSize:  opts.PopulatorBufferSize,
+		populatorConcurrency: opts.PopulatorConcurrency,
+		maxAttempts:          opts.MaxAttempts,
+		failedRetryInterval:  opts.FailedRetryInterval,
+		progressInterval:     opts.ProgressInterval,
+		checkpointInterval:   opts.CheckpointInterval,
+		urlSources:           opts.URLSourcePolicy,
+		httpClient:           opts.HTTPClient,
+		spool: qcow2Spool{
+			dir:       opts.SpoolDir,
+			sizeLimit: opts.SpoolSizeLimit,
+		},
+		populationMetrics: newPopulationMetrics(),
+	}
+
+	if opts.Runner.LogKey == "" {
+		opts.Runner.LogKey = "snapshotId"
+	}
+	runner, err := NewRunner(log, r.reconcile, opts.Runner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize runner: %w", err)
+	}
+	r.runner = runner
+
+	return r, nil
 }
 
 type SnapshotReconciler struct {
@@ -90,54 +180,121 @@ type SnapshotReconciler struct {
 	conn *rados.Conn
 
 	registry image.Source
-	queue    workqueue.RateLimitingInterface
+	runner   *Runner
+
+	store         store.Store[*api.Snapshot]
+	progressStore store.Store[*api.Snapshot]
+	events        event.Source[*api.Snapshot]
+
+	pool                 string
+	populatorBufferSize  int64
+	populatorConcurrency int
+	maxAttempts          int
+	failedRetryInterval  time.Duration
+	progressInterval     time.Duration
+	checkpointInterval   time.Duration
+	urlSources           *URLSourcePolicy
+	httpClient           *http.Client
+	spool                qcow2Spool
+
+	populationMetrics populationMetrics
+}
+
+func (r *SnapshotReconciler) Describe(ch chan<- *prometheus.Desc) {
+	r.populationMetrics.Describe(ch)
+}
 
-	store  store.Store[*api.Snapshot]
-	events event.Source[*api.Snapshot]
+func (r *SnapshotReconciler) Collect(ch chan<- prometheus.Metric) {
+	r.populationMetrics.Collect(ch)
+}
 
-	pool                string
-	populatorBufferSize int64
+type snapshotSource struct {
+	content io.ReadCloser
+	size    uint64
+	// digest identifies the source in the snapshot status.
+	digest string
+	// contentDigest is the digest of content. It is empty if content is
+	// verified while reading it instead.
+	contentDigest digest.Digest
 }
 
-func (r *SnapshotReconciler) openSnapshotSource(ctx context.Context, src api.SnapshotSource) (io.ReadCloser, uint64, string, error) {
+func (r *SnapshotReconciler) openSnapshotSource(ctx context.Context, src api.SnapshotSource) (*snapshotSource, error) {
 	switch {
 	case src.OnmetalImage != "":
 
 		img, err := r.registry.Resolve(ctx, src.OnmetalImage)
 		if err != nil {
-			return nil, 0, "", fmt.Errorf("failed to resolve image ref in registry: %w", err)
+			err = fmt.Errorf("failed to resolve image ref in registry: %w", err)
+			switch {
+			case errors.Is(err, reference.ErrInvalid):
+				return nil, permanentError(ReasonInvalidImageReference, err)
+			case errdefs.IsNotFound(err):
+				return nil, permanentError(ReasonImageNotFound, err)
+			default:
+				return nil, transientError(ReasonImageResolutionFailed, err)
+			}
 		}
 
 		onmetalImage, err := onmetalimage.ResolveImage(ctx, img)
 		if err != nil {
-			return nil, 0, "", fmt.Errorf("failed to resolve onmetal image: %w", err)
+			return nil, transientError(ReasonImageResolutionFailed, fmt.Errorf("failed to resolve onmetal image: %w", err))
 		}
 
 		rootFS := onmetalImage.RootFS
 		if rootFS == nil {
-			return nil, 0, "", fmt.Errorf("image has no root fs")
+			return nil, permanentError(ReasonRootFSMissing, fmt.Errorf("image has no root fs"))
 		}
 
-		content, err := rootFS.Content(ctx)
+		return openLayerSource(ctx, rootFS, img.Descriptor().Digest.String(), r.spool)
+	case src.URL != nil:
+		if err := r.urlSources.Check(src.URL.URL); err != nil {
+			return nil, permanentError(ReasonInvalidImageReference, err)
+		}
+
+		layer, err := newURLLayer(r.httpClient, src.URL)
 		if err != nil {
-			return nil, 0, "", fmt.Errorf("failed to get root fs content: %w", err)
+			return nil, permanentError(ReasonInvalidImageReference, err)
 		}
 
-		return content, uint64(rootFS.Descriptor().Size), img.Descriptor().Digest.String(), nil
+		return openLayerSource(ctx, layer, src.URL.Checksum, r.spool)
 	default:
-		return nil, 0, "", fmt.Errorf("unrecognized image source %#v", src)
+		return nil, permanentError(ReasonInvalidImageReference, fmt.Errorf("unrecognized image source %#v", src))
 	}
 }
 
-func (r *SnapshotReconciler) Start(ctx context.Context) error {
-	log := r.log
+// openLayerSource opens layer as the source of a snapshot identified by
+// sourceDigest.
+func openLayerSource(ctx context.Context, layer image.Layer, sourceDigest string, spool qcow2Spool) (*snapshotSource, error) {
+	content, size, unmodified, err := openLayerContent(ctx, layer, spool)
+	if err != nil {
+		err = fmt.Errorf("failed to open content: %w", err)
+		if _, ok := classifyError(err); ok {
+			return nil, err
+		}
+		return nil, transientError(ReasonPopulationFailed, err)
+	}
+
+	source := &snapshotSource{
+		content: content,
+		size:    size,
+		digest:  sourceDigest,
+	}
+	if unmodified {
+		source.contentDigest = layer.Descriptor().Digest
+	}
+	return source, nil
+}
 
-	//todo make configurable
-	workerSize := 15
+func (r *SnapshotReconciler) Start(ctx context.Context) error {
+	if err := r.spool.removeStale(r.log); err != nil {
+		r.log.Error(err, "failed to remove stale spool files")
+	}
 
-	reg, err := r.events.AddHandler(event.HandlerFunc[*api.Snapshot](func(event event.Event[*api.Snapshot]) {
-		r.queue.Add(event.Object.ID)
-	}))
+	// Failed attempts are retried by the runner with backoff, so the status
+	// updates recording them must not requeue the snapshot right away.
+	reg, err := r.events.AddHandler(event.NewStatusUpdateFilter[*api.Snapshot](event.HandlerFunc[*api.Snapshot](func(event event.Event[*api.Snapshot]) {
+		r.runner.Enqueue(event.Object.ID)
+	})))
 	if err != nil {
 		return err
 	}
@@ -145,51 +302,118 @@ func (r *SnapshotReconciler) Start(ctx context.Context) error {
 		_ = r.events.RemoveHandler(reg)
 	}()
 
-	go func() {
-		<-ctx.Done()
-		r.queue.ShutDown()
-	}()
+	return r.runner.Start(ctx)
+}
 
-	var wg sync.WaitGroup
-	for i := 0; i < workerSize; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for r.processNextWorkItem(ctx, log) {
-			}
-		}()
+func (r *SnapshotReconciler) reconcile(ctx context.Context, id string) (Result, error) {
+	res, err := r.reconcileSnapshot(ctx, id)
+	rErr, ok := classifyError(err)
+	if !ok {
+		return res, err
 	}
 
-	wg.Wait()
-	return nil
+	failed, statusErr := r.recordFailure(ctx, id, rErr)
+	if statusErr != nil {
+		return Result{}, errors.Join(err, fmt.Errorf("failed to report failure in snapshot status: %w", statusErr))
+	}
+
+	if failed {
+		logr.FromContextOrDiscard(ctx).Error(err, "Snapshot failed", "reason", rErr.reason)
+		return Result{}, nil
+	}
+	return Result{}, err
+}
+
+// recordFailure counts a failed attempt to populate the snapshot and reports
+// rErr in its Ready condition. If rErr is permanent or the attempts are used
+// up, the partial rbd image is removed and the snapshot moved to the failed
+// state, and recordFailure returns true. Snapshots that used up their
+// attempts are retried after the failed retry interval.
+func (r *SnapshotReconciler) recordFailure(ctx context.Context, id string, rErr *reconcileError) (bool, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	snapshot, err := r.store.Get(ctx, id)
+	if err != nil {
+		return false, store.IgnoreErrNotFound(err)
+	}
+
+	if snapshot.DeletedAt != nil || snapshot.Status.State != api.SnapshotStatePending {
+		return false, nil
+	}
+
+	snapshot.Status.FailedAttempts++
+	failed := rErr.permanent || snapshot.Status.FailedAttempts >= r.maxAttempts
+
+	message := rErr.Error()
+	if failed && !rErr.permanent {
+		message = fmt.Sprintf("giving up after %d attempts: %s", snapshot.Status.FailedAttempts, message)
+	}
+	snapshot.Status.Conditions = api.SetCondition(snapshot.Status.Conditions, api.Condition{
+		Type:    api.SnapshotConditionReady,
+		Status:  api.ConditionFalse,
+		Reason:  rErr.reason,
+		Message: message,
+	})
+
+	if failed {
+		ioCtx, err := r.conn.OpenIOContext(r.pool)
+		if err != nil {
+			return false, fmt.Errorf("unable to get io context: %w", err)
+		}
+		defer ioCtx.Destroy()
+
+		if err := removePartialSnapshotImage(log, ioCtx, id); err != nil {
+			return false, err
+		}
+
+		snapshot.Status.State = api.SnapshotStateFailed
+		snapshot.Status.ObservedGeneration = snapshot.Generation
+		if !rErr.permanent {
+			snapshot.Status.RetryAfter = ptr.To(time.Now().Add(r.failedRetryInterval).Truncate(time.Second))
+		}
+	}
+
+	if _, err := r.store.Update(ctx, snapshot); err != nil {
+		return false, err
+	}
+	return failed, nil
 }
 
-func (r *SnapshotReconciler) processNextWorkItem(ctx context.Context, log logr.Logger) bool {
-	item, shutdown := r.queue.Get()
-	if shutdown {
-		return false
+// removePartialSnapshotImage removes the rbd image a previous, unfinished
+// attempt to populate the snapshot left behind.
+func removePartialSnapshotImage(log logr.Logger, ioCtx *rados.IOContext, id string) error {
+	img, err := librbd.OpenImage(ioCtx, SnapshotIDToRBDID(id), librbd.NoSnapshot)
+	if err != nil {
+		if errors.Is(err, librbd.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to open partial rbd image: %w", err)
 	}
-	defer r.queue.Done(item)
 
-	id := item.(string)
-	log = log.WithValues("snapshotId", id)
-	ctx = logr.NewContext(ctx, log)
+	if err := cleanupSnapshotResources(log, img); err != nil {
+		if closeErr := img.Close(); closeErr != nil {
+			return errors.Join(err, fmt.Errorf("unable to close partial rbd image: %w", closeErr))
+		}
+		return fmt.Errorf("failed to cleanup partial rbd image: %w", err)
+	}
 
-	if err := r.reconcileSnapshot(ctx, id); err != nil {
-		log.Error(err, "failed to reconcile snapshot")
-		r.queue.AddRateLimited(item)
-		return true
+	if err := img.Close(); err != nil {
+		return fmt.Errorf("unable to close partial rbd image: %w", err)
+	}
+
+	if err := img.Remove(); err != nil {
+		return fmt.Errorf("unable to remove partial rbd image: %w", err)
 	}
 
-	r.queue.Forget(item)
-	return true
+	log.V(1).Info("Removed partial rbd image")
+	return nil
 }
 
 const (
 	SnapshotFinalizer = "snapshot"
 )
 
-func (r *SnapshotReconciler) cleanupSnapshotResources(log logr.Logger, img *librbd.Image) error {
+func cleanupSnapshotResources(log logr.Logger, img *librbd.Image) error {
 	pools, imgs, err := img.ListChildren()
 	if err != nil {
 		return fmt.Errorf("unable to list children: %w", err)
@@ -251,7 +475,7 @@ func (r *SnapshotReconciler) deleteSnapshot(ctx context.Context, log logr.Logger
 
 	}
 
-	if err := r.cleanupSnapshotResources(log, img); err != nil {
+	if err := cleanupSnapshotResources(log, img); err != nil {
 		if closeErr := img.Close(); closeErr != nil {
 			return errors.Join(err, fmt.Errorf("unable to close snapshot: %w", closeErr))
 		}
@@ -277,133 +501,385 @@ func (r *SnapshotReconciler) deleteSnapshot(ctx context.Context, log logr.Logger
 	return nil
 }
 
-func (r *SnapshotReconciler) reconcileSnapshot(ctx context.Context, id string) error {
+func (r *SnapshotReconciler) reconcileSnapshot(ctx context.Context, id string) (Result, error) {
 	log := logr.FromContextOrDiscard(ctx)
 	ioCtx, err := r.conn.OpenIOContext(r.pool)
 	if err != nil {
-		return fmt.Errorf("unable to get io context: %w", err)
+		return Result{}, fmt.Errorf("unable to get io context: %w", err)
 	}
 	defer ioCtx.Destroy()
 
 	snapshot, err := r.store.Get(ctx, id)
 	if err != nil {
 		if !errors.Is(err, store.ErrNotFound) {
-			return fmt.Errorf("failed to fetch snapshot from store: %w", err)
+			return Result{}, fmt.Errorf("failed to fetch snapshot from store: %w", err)
 		}
 
-		return nil
+		return Result{}, nil
 	}
 
 	if snapshot.DeletedAt != nil {
 		if err := r.deleteSnapshot(ctx, log, ioCtx, snapshot); err != nil {
-			return fmt.Errorf("failed to delete snapshot: %w", err)
+			return Result{}, fmt.Errorf("failed to delete snapshot: %w", err)
 		}
+		return Result{}, nil
 	}
 
-	if snapshot.Status.State == api.SnapshotStatePopulated {
+	switch snapshot.Status.State {
+	case api.SnapshotStatePopulated:
 		log.V(1).Info("Snapshot already populated")
-		return nil
+		return Result{}, nil
+	case api.SnapshotStateFailed:
+		if snapshot.Status.ObservedGeneration == snapshot.Generation {
+			if snapshot.Status.RetryAfter == nil {
+				log.V(1).Info("Snapshot failed, waiting for a source change")
+				return Result{}, nil
+			}
+			if wait := time.Until(*snapshot.Status.RetryAfter); wait > 0 {
+				log.V(1).Info("Snapshot ran out of attempts, waiting to retry", "retryAfter", snapshot.Status.RetryAfter)
+				return Result{RequeueAfter: wait}, nil
+			}
+			log.V(1).Info("Retrying snapshot that ran out of attempts")
+		} else {
+			log.V(1).Info("Source of failed snapshot changed, retrying")
+		}
+
+		snapshot.Status.State = api.SnapshotStatePending
+		snapshot.Status.FailedAttempts = 0
+		snapshot.Status.RetryAfter = nil
+		if _, err := r.store.Update(ctx, snapshot); err != nil {
+			return Result{}, fmt.Errorf("failed to reset snapshot state: %w", err)
+		}
 	}
 
 	if !slices.Contains(snapshot.Finalizers, SnapshotFinalizer) {
 		snapshot.Finalizers = append(snapshot.Finalizers, SnapshotFinalizer)
 		if _, err := r.store.Update(ctx, snapshot); err != nil {
-			return fmt.Errorf("failed to set finalizers: %w", err)
+			return Result{}, fmt.Errorf("failed to set finalizers: %w", err)
 		}
 	}
 
-	rc, snapshotSize, digest, err := r.openSnapshotSource(ctx, snapshot.Source)
+	source, err := r.openSnapshotSource(ctx, snapshot.Source)
 	if err != nil {
-		return fmt.Errorf("failed to open snapshot source: %w", err)
+		return Result{}, fmt.Errorf("failed to open snapshot source: %w", err)
 	}
 	defer func() {
-		if err := rc.Close(); err != nil {
+		if err := source.content.Close(); err != nil {
 			log.Error(err, "failed to close snapshot source")
 		}
 	}()
 
+	populated, err := isPopulatedSnapshotImage(log, ioCtx, snapshot.ID, source.digest)
+	if err != nil {
+		return Result{}, transientError(ReasonPopulationFailed, err)
+	}
+	if populated {
+		// A previous attempt populated the image but failed to record it.
+		log.V(1).Info("Rbd image was populated already")
+		if progress := snapshot.Status.Progress; progress != nil {
+			now := time.Now().Truncate(time.Second)
+			progress.BytesWritten = progress.TotalBytes
+			progress.EstimatedCompletionTime = &now
+		}
+	} else {
+		progress, err := r.populateSnapshotImage(ctx, log, ioCtx, snapshot, source)
+		if err != nil {
+			return Result{}, err
+		}
+		snapshot.Status.Progress = &progress
+	}
+
+	snapshot.Status.Digest = source.digest
+	snapshot.Status.State = api.SnapshotStatePopulated
+	snapshot.Status.ObservedGeneration = snapshot.Generation
+	snapshot.Status.FailedAttempts = 0
+	snapshot.Status.Conditions = api.SetCondition(snapshot.Status.Conditions, api.Condition{
+		Type:   api.SnapshotConditionReady,
+		Status: api.ConditionTrue,
+		Reason: ReasonPopulated,
+	})
+
+	if _, err = r.store.Update(ctx, snapshot); err != nil {
+		return Result{}, fmt.Errorf("failed to update snapshot metadate: %w", err)
+	}
+
+	return Result{}, nil
+}
+
+// populateSnapshotImage populates the rbd image of snapshot with source and
+// creates the protected snapshot images are cloned from.
+func (r *SnapshotReconciler) populateSnapshotImage(ctx context.Context, log logr.Logger, ioCtx *rados.IOContext, snapshot *api.Snapshot, source *snapshotSource) (api.SnapshotProgress, error) {
+	rbdImg, cp, err := r.openPopulationImage(log, ioCtx, snapshot.ID, source)
+	if err != nil {
+		if _, ok := classifyError(err); ok {
+			return api.SnapshotProgress{}, err
+		}
+		return api.SnapshotProgress{}, transientError(ReasonPopulationFailed, err)
+	}
+
+	progress, err := r.prepareSnapshotContent(ctx, log, snapshot, rbdImg, source, cp)
+	if err != nil {
+		if closeErr := rbdImg.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("unable to close snapshot: %w", closeErr))
+		}
+		// The content may turn out to be malformed while populating.
+		if _, ok := classifyError(err); ok {
+			return api.SnapshotProgress{}, err
+		}
+		return api.SnapshotProgress{}, transientError(ReasonPopulationFailed, err)
+	}
+
+	if err := rbdImg.Close(); err != nil {
+		return api.SnapshotProgress{}, fmt.Errorf("unable to close snapshot: %w", err)
+	}
+	return progress, nil
+}
+
+// isPopulatedSnapshotImage reports whether the rbd image of the snapshot was
+// completely populated with the source identified by sourceDigest. This is
+// the case if it was marked as populated and has its image snapshot, which is
+// protected if a previous attempt was interrupted before doing so.
+func isPopulatedSnapshotImage(log logr.Logger, ioCtx *rados.IOContext, id, sourceDigest string) (bool, error) {
+	img, err := librbd.OpenImage(ioCtx, SnapshotIDToRBDID(id), librbd.NoSnapshot)
+	if err != nil {
+		if errors.Is(err, librbd.ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to open rbd image: %w", err)
+	}
+
+	populated, err := func() (bool, error) {
+		if source, err := populatedSource(img); err != nil || source != sourceDigest {
+			return false, err
+		}
+
+		snaps, err := img.GetSnapshotNames()
+		if err != nil {
+			return false, fmt.Errorf("unable to list snapshots: %w", err)
+		}
+		if !slices.ContainsFunc(snaps, func(snap librbd.SnapInfo) bool { return snap.Name == ImageSnapshotVersion }) {
+			return false, nil
+		}
+
+		snap := img.GetSnapshot(ImageSnapshotVersion)
+		isProtected, err := snap.IsProtected()
+		if err != nil {
+			return false, fmt.Errorf("unable to check if snapshot is protected: %w", err)
+		}
+		if !isProtected {
+			if err := snap.Protect(); err != nil {
+				return false, fmt.Errorf("unable to protect snapshot: %w", err)
+			}
+			log.V(1).Info("Protected snapshot of populated rbd image")
+		}
+		return true, nil
+	}()
+	if closeErr := img.Close(); closeErr != nil {
+		return false, errors.Join(err, fmt.Errorf("unable to close rbd image: %w", closeErr))
+	}
+	return populated, err
+}
+
+// openPopulationImage opens the rbd image to populate the snapshot into. The
+// partial image of an interrupted population is resumed from its checkpoint
+// if possible, and removed otherwise.
+func (r *SnapshotReconciler) openPopulationImage(log logr.Logger, ioCtx *rados.IOContext, id string, source *snapshotSource) (*librbd.Image, *checkpoint, error) {
+	img, err := librbd.OpenImage(ioCtx, SnapshotIDToRBDID(id), librbd.NoSnapshot)
+	switch {
+	case err == nil:
+		cp, err := resumableCheckpoint(log, img, source)
+		if err != nil {
+			if closeErr := img.Close(); closeErr != nil {
+				return nil, nil, errors.Join(err, fmt.Errorf("unable to close partial rbd image: %w", closeErr))
+			}
+			return nil, nil, err
+		}
+		if cp != nil {
+			log.Info("Resuming population", "offset", cp.offset)
+			return img, cp, nil
+		}
+
+		if err := img.Close(); err != nil {
+			return nil, nil, fmt.Errorf("unable to close partial rbd image: %w", err)
+		}
+		if err := removePartialSnapshotImage(log, ioCtx, id); err != nil {
+			return nil, nil, err
+		}
+	case !errors.Is(err, librbd.ErrNotFound):
+		return nil, nil, fmt.Errorf("failed to open partial rbd image: %w", err)
+	}
+
 	options := librbd.NewRbdImageOptions()
 	defer options.Destroy()
 
 	//TODO: different pool for OS images?
 	if err := options.SetString(librbd.RbdImageOptionDataPool, r.pool); err != nil {
-		return fmt.Errorf("failed to set data pool: %w", err)
+		return nil, nil, fmt.Errorf("failed to set data pool: %w", err)
 	}
 	log.V(2).Info("Configured pool", "pool", r.pool)
 
-	roundedSize := round.OffBytes(snapshotSize)
-	if err = librbd.CreateImage(ioCtx, SnapshotIDToRBDID(snapshot.ID), roundedSize, options); err != nil {
-		return fmt.Errorf("failed to create os rbd image: %w", err)
+	roundedSize := round.OffBytes(source.size)
+	if err = librbd.CreateImage(ioCtx, SnapshotIDToRBDID(id), roundedSize, options); err != nil {
+		return nil, nil, fmt.Errorf("failed to create os rbd image: %w", err)
 	}
 	log.V(2).Info("Created rbd image", "bytes", roundedSize)
 
-	rbdImg, err := librbd.OpenImage(ioCtx, SnapshotIDToRBDID(snapshot.ID), librbd.NoSnapshot)
+	img, err = librbd.OpenImage(ioCtx, SnapshotIDToRBDID(id), librbd.NoSnapshot)
 	if err != nil {
-		return fmt.Errorf("failed to open rbd image: %w", err)
+		return nil, nil, fmt.Errorf("failed to open rbd image: %w", err)
 	}
+	return img, nil, nil
+}
 
-	if err := r.prepareSnapshotContent(log, rbdImg, rc); err != nil {
-		if closeErr := rbdImg.Close(); closeErr != nil {
-			return errors.Join(err, fmt.Errorf("unable to close snapshot: %w", closeErr))
-		}
+// resumableCheckpoint returns the checkpoint of img if the population can be
+// resumed from it. It seeks the source content to the checkpoint in that case.
+func resumableCheckpoint(log logr.Logger, img *librbd.Image, source *snapshotSource) (*checkpoint, error) {
+	cp, err := readCheckpoint(img)
+	if err != nil {
+		log.Error(err, "failed to read checkpoint, restarting population")
+		return nil, nil
 	}
-
-	if err := rbdImg.Close(); err != nil {
-		return fmt.Errorf("unable to close snapshot: %w", err)
+	if cp == nil {
+		return nil, nil
 	}
 
-	snapshot.Status.Digest = digest
-	snapshot.Status.State = api.SnapshotStatePopulated
+	if cp.source != source.contentDigest {
+		log.V(1).Info("Checkpoint is of a different source, restarting population", "checkpointSource", cp.source)
+		return nil, nil
+	}
 
-	if _, err = r.store.Update(ctx, snapshot); err != nil {
-		return fmt.Errorf("failed to update snapshot metadate: %w", err)
+	snaps, err := img.GetSnapshotNames()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list snapshots: %w", err)
+	}
+	if len(snaps) > 0 {
+		return nil, nil
 	}
 
-	return nil
+	seeker, ok := source.content.(io.Seeker)
+	if !ok {
+		log.V(1).Info("Source does not support ranged reads, restarting population")
+		return nil, nil
+	}
+	if _, err := seeker.Seek(cp.offset, io.SeekStart); err != nil {
+		// The position of the content is unknown now, so the population is
+		// restarted with a freshly opened source.
+		return nil, errors.Join(
+			fmt.Errorf("failed to seek source to checkpoint: %w", err),
+			clearCheckpoint(img),
+		)
+	}
+	return cp, nil
 }
 
-func (r *SnapshotReconciler) prepareSnapshotContent(log logr.Logger, rbdImg *librbd.Image, rc io.ReadCloser) error {
-	if err := r.populateImage(log, rbdImg, rc); err != nil {
-		return fmt.Errorf("failed to populate os image: %w", err)
+func (r *SnapshotReconciler) prepareSnapshotContent(ctx context.Context, log logr.Logger, snapshot *api.Snapshot, rbdImg *librbd.Image, source *snapshotSource, cp *checkpoint) (api.SnapshotProgress, error) {
+	var (
+		offset    int64
+		skipped   int64
+		hashState []byte
+	)
+	if cp != nil {
+		offset, skipped, hashState = cp.offset, cp.skipped, cp.hashState
+	}
+
+	var contentHash hash.Hash
+	if source.contentDigest != "" {
+		var err error
+		if contentHash, err = newContentHash(source.contentDigest, hashState); err != nil {
+			return api.SnapshotProgress{}, err
+		}
+	}
+
+	w := &populationWriter{
+		log:    log,
+		img:    rbdImg,
+		source: source.contentDigest,
+		hash:   contentHash,
+		offset: offset,
+		// A previous attempt may have written past the checkpoint, so zero
+		// blocks have to be discarded rather than skipped when resuming.
+		discard:        cp != nil,
+		bufferSize:     r.populatorBufferSize,
+		concurrency:    r.populatorConcurrency,
+		interval:       r.checkpointInterval,
+		lastCheckpoint: time.Now(),
+	}
+	w.written.Store(offset)
+	w.skipped.Store(skipped)
+	progress, err := r.populateImage(ctx, log, snapshot, w, source.content, int64(source.size), offset)
+	if err != nil {
+		// A resumed population failing right away is restarted cleanly next
+		// time, in case the source does not support ranged reads after all.
+		if cp != nil && w.offset == cp.offset {
+			err = errors.Join(err, clearCheckpoint(rbdImg))
+		}
+		return api.SnapshotProgress{}, fmt.Errorf("failed to populate os image: %w", err)
+	}
+
+	if err := w.verify(); err != nil {
+		return api.SnapshotProgress{}, errors.Join(err, clearCheckpoint(rbdImg))
+	}
+	if err := clearCheckpoint(rbdImg); err != nil {
+		return api.SnapshotProgress{}, err
+	}
+	// The image is marked as populated before its snapshot is created, so it
+	// is not populated again if recording the snapshot as populated fails.
+	if err := markPopulated(rbdImg, source.digest); err != nil {
+		return api.SnapshotProgress{}, err
 	}
 	log.V(2).Info("Populated os image on rbd image")
 
 	imgSnap, err := rbdImg.CreateSnapshot(ImageSnapshotVersion)
 	if err != nil {
-		return fmt.Errorf("unable to create snapshot: %w", err)
+		return api.SnapshotProgress{}, fmt.Errorf("unable to create snapshot: %w", err)
 	}
 
 	if err := imgSnap.Protect(); err != nil {
-		return fmt.Errorf("unable to protect snapshot: %w", err)
+		return api.SnapshotProgress{}, fmt.Errorf("unable to protect snapshot: %w", err)
 	}
 
-	return nil
+	return progress, nil
 }
 
-func (r *SnapshotReconciler) populateImage(log logr.Logger, dst io.WriteCloser, src io.Reader) error {
+// populateImage copies src to dst, which already holds resumedBytes of the
+// content. The progress is recorded in the status of snapshot every progress
+// interval, and the final progress is returned.
+func (r *SnapshotReconciler) populateImage(ctx context.Context, log logr.Logger, snapshot *api.Snapshot, dst *populationWriter, src io.Reader, totalBytes, resumedBytes int64) (api.SnapshotProgress, error) {
+	start := time.Now().Truncate(time.Second)
 	rater := utils.NewRater(src)
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(r.progressInterval)
 	defer ticker.Stop()
 	done := make(chan struct{})
 
+	r.recordProgress(ctx, log, snapshot, populationProgress(rater, totalBytes, resumedBytes, dst.writtenBytes(), dst.skippedBytes(), start))
+	defer r.populationMetrics.delete(snapshot.ID)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
 			case <-ticker.C:
-				log.Info("Populating", "rate", rater.String())
+				r.recordProgress(ctx, log, snapshot, populationProgress(rater, totalBytes, resumedBytes, dst.writtenBytes(), dst.skippedBytes(), start))
 			case <-done:
 				return
 			}
 		}
 	}()
-	defer func() { close(done) }()
+	// snapshot must not be touched before the reporting goroutine stopped.
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
 
-	buffer := make([]byte, r.populatorBufferSize)
-	_, err := io.CopyBuffer(dst, rater, buffer)
-	if err != nil {
-		return fmt.Errorf("failed to populate image: %w", err)
+	if _, err := dst.ReadFrom(rater); err != nil {
+		return api.SnapshotProgress{}, fmt.Errorf("failed to populate image: %w", err)
 	}
-	log.Info("Successfully populated image")
+	progress := populationProgress(rater, totalBytes, resumedBytes, dst.writtenBytes(), dst.skippedBytes(), start)
+	log.Info("Successfully populated image", "logicalBytes", progress.BytesWritten, "writtenBytes", progress.BytesWritten-progress.BytesSkipped)
 
-	return nil
+	now := time.Now().Truncate(time.Second)
+	progress.EstimatedCompletionTime = &now
+	return progress, nil
 }
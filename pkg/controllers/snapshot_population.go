@@ -0,0 +1,261 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+)
+
+// sparseBlockSize is the granularity in which zero blocks are detected.
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// populationImage is the part of an rbd image a population writes its
+// content and checkpoints to. It is implemented by *librbd.Image.
+type populationImage interface {
+	WriteAt(p []byte, off int64) (int, error)
+	Discard(ofs, length uint64) (int, error)
+	Flush() error
+	GetMetadata(key string) (string, error)
+	SetMetadata(key, value string) error
+	RemoveMetadata(key string) error
+}
+
+var _ populationImage = (*librbd.Image)(nil)
+
+// populationWriter writes content sequentially read from a source to an rbd
+// image starting at offset. It keeps up to concurrency writes of bufferSize
+// in flight, so reading the source overlaps with writing to the image. The
+// content is hashed as it is read and a checkpoint is recorded every
+// interval, unless hash is nil because the content is verified otherwise.
+//
+// Zero blocks are not written, so the image stays thin. They are skipped, or
+// discarded if discard is set because the image may already hold data there.
+type populationWriter struct {
+	log         logr.Logger
+	img         populationImage
+	source      digest.Digest
+	hash        hash.Hash
+	offset      int64
+	discard     bool
+	bufferSize  int64
+	concurrency int
+
+	interval       time.Duration
+	lastCheckpoint time.Time
+
+	written atomic.Int64
+	skipped atomic.Int64
+
+	buffers   chan []byte
+	allocated int
+	inFlight  sync.WaitGroup
+
+	errMu sync.Mutex
+	err   error
+}
+
+// ReadFrom populates the image with the content of src until EOF or the
+// first failing write.
+func (w *populationWriter) ReadFrom(src io.Reader) (int64, error) {
+	var read int64
+	for {
+		buf, err := w.buffer()
+		if err != nil {
+			// The image must not be closed while writes are in flight. The
+			// error is that of a failed write, which wait returns as well.
+			return read, w.wait()
+		}
+
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if w.hash != nil {
+				w.hash.Write(buf[:n])
+			}
+			w.submit(buf[:n], w.offset)
+			w.offset += int64(n)
+			read += int64(n)
+		} else {
+			w.buffers <- buf
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return read, w.wait()
+		}
+		if err != nil {
+			return read, errors.Join(err, w.wait())
+		}
+
+		if time.Since(w.lastCheckpoint) >= w.interval {
+			w.lastCheckpoint = time.Now()
+			if err := w.checkpoint(); err != nil {
+				return read, err
+			}
+		}
+	}
+}
+
+// buffer returns a free buffer, waiting for a write to complete if
+// concurrency buffers are in use already.
+func (w *populationWriter) buffer() ([]byte, error) {
+	if w.buffers == nil {
+		w.buffers = make(chan []byte, w.concurrency)
+	}
+
+	var buf []byte
+	select {
+	case buf = <-w.buffers:
+	default:
+		if w.allocated < w.concurrency {
+			w.allocated++
+			buf = make([]byte, w.bufferSize)
+		} else {
+			buf = <-w.buffers
+		}
+	}
+
+	if err := w.firstError(); err != nil {
+		w.buffers <- buf
+		return nil, err
+	}
+	return buf[:w.bufferSize], nil
+}
+
+func (w *populationWriter) submit(buf []byte, offset int64) {
+	w.inFlight.Add(1)
+	go func() {
+		defer w.inFlight.Done()
+		if err := w.write(buf, offset); err != nil {
+			w.errMu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.errMu.Unlock()
+		}
+		w.buffers <- buf
+	}()
+}
+
+// write writes p at offset, skipping its zero blocks.
+func (w *populationWriter) write(p []byte, offset int64) error {
+	// blockEnd returns the end of the block of the image p[i] falls into.
+	blockEnd := func(i int) int {
+		return min(i+sparseBlockSize-int((offset+int64(i))%sparseBlockSize), len(p))
+	}
+	isZero := func(start, end int) bool {
+		return bytes.Equal(p[start:end], zeroBlock[:end-start])
+	}
+
+	for start := 0; start < len(p); {
+		// Consecutive blocks of the same kind are handled in one go.
+		end := blockEnd(start)
+		zero := isZero(start, end)
+		for end < len(p) && isZero(end, blockEnd(end)) == zero {
+			end = blockEnd(end)
+		}
+
+		at := offset + int64(start)
+		if zero {
+			if w.discard {
+				if _, err := w.img.Discard(uint64(at), uint64(end-start)); err != nil {
+					return fmt.Errorf("failed to discard zero blocks at %d: %w", at, err)
+				}
+			}
+			w.skipped.Add(int64(end - start))
+		} else if _, err := w.img.WriteAt(p[start:end], at); err != nil {
+			return fmt.Errorf("failed to write at %d: %w", at, err)
+		}
+		w.written.Add(int64(end - start))
+		start = end
+	}
+	return nil
+}
+
+// wait waits for all writes in flight and returns the first error of any
+// write.
+func (w *populationWriter) wait() error {
+	w.inFlight.Wait()
+	return w.firstError()
+}
+
+func (w *populationWriter) firstError() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+// writtenBytes returns the number of bytes of the content whose write
+// completed, including skipped zero blocks. It may be called concurrently to
+// ReadFrom.
+func (w *populationWriter) writtenBytes() int64 {
+	return w.written.Load()
+}
+
+// skippedBytes returns the number of zero bytes that were not written. It
+// may be called concurrently to ReadFrom.
+func (w *populationWriter) skippedBytes() int64 {
+	return w.skipped.Load()
+}
+
+// checkpoint records a checkpoint at the current offset once all writes in
+// flight completed. Failing to record it is not fatal, the population can
+// only not be resumed from here.
+func (w *populationWriter) checkpoint() error {
+	if err := w.wait(); err != nil {
+		return err
+	}
+
+	marshaler, ok := w.hash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	hashState, err := marshaler.MarshalBinary()
+	if err != nil {
+		w.log.Error(err, "failed to marshal hash", "offset", w.offset)
+		return nil
+	}
+
+	if err := writeCheckpoint(w.img, checkpoint{source: w.source, offset: w.offset, skipped: w.skipped.Load(), hashState: hashState}); err != nil {
+		w.log.Error(err, "failed to write checkpoint", "offset", w.offset)
+		return nil
+	}
+	w.log.V(2).Info("Wrote checkpoint", "offset", w.offset)
+	return nil
+}
+
+// verify returns an error if the content written does not match the source
+// digest.
+func (w *populationWriter) verify() error {
+	if w.hash == nil {
+		return nil
+	}
+	if actual := digest.NewDigest(w.source.Algorithm(), w.hash); actual != w.source {
+		return fmt.Errorf("content digest %s does not match %s", actual, w.source)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	librbd "github.com/ceph/go-ceph/rbd"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+)
+
+type imageOp struct {
+	discard bool
+	offset  int64
+	length  int64
+}
+
+// fakeImage is an in-memory populationImage recording the writes and
+// discards issued to it.
+type fakeImage struct {
+	mu       sync.Mutex
+	data     []byte
+	metadata map[string]string
+	ops      []imageOp
+	flushes  int
+
+	// writeDelay delays every write, so writes overlap.
+	writeDelay time.Duration
+	// writeErr fails writes at the given offset if set.
+	writeErr       error
+	writeErrOffset int64
+	// writeBlock blocks writes at writeBlockOffset until it is closed.
+	writeBlock       chan struct{}
+	writeBlockOffset int64
+	// onSetMetadata is called with the image locked before metadata is set.
+	onSetMetadata func(key, value string)
+}
+
+func newFakeImage(size int) *fakeImage {
+	return &fakeImage{
+		data:     make([]byte, size),
+		metadata: map[string]string{},
+	}
+}
+
+func (img *fakeImage) WriteAt(p []byte, off int64) (int, error) {
+	if img.writeBlock != nil && off == img.writeBlockOffset {
+		<-img.writeBlock
+	}
+	time.Sleep(img.writeDelay)
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.writeErr != nil && off == img.writeErrOffset {
+		return 0, img.writeErr
+	}
+	img.ops = append(img.ops, imageOp{offset: off, length: int64(len(p))})
+	return copy(img.data[off:], p), nil
+}
+
+func (img *fakeImage) Discard(ofs, length uint64) (int, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	img.ops = append(img.ops, imageOp{discard: true, offset: int64(ofs), length: int64(length)})
+	clear(img.data[ofs : ofs+length])
+	return int(length), nil
+}
+
+func (img *fakeImage) Flush() error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	img.flushes++
+	return nil
+}
+
+func (img *fakeImage) GetMetadata(key string) (string, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	value, ok := img.metadata[key]
+	if !ok {
+		return "", librbd.ErrNotFound
+	}
+	return value, nil
+}
+
+func (img *fakeImage) SetMetadata(key, value string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.onSetMetadata != nil {
+		img.onSetMetadata(key, value)
+	}
+	img.metadata[key] = value
+	return nil
+}
+
+func (img *fakeImage) RemoveMetadata(key string) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if _, ok := img.metadata[key]; !ok {
+		return librbd.ErrNotFound
+	}
+	delete(img.metadata, key)
+	return nil
+}
+
+// content returns the concatenation of blocks, where each block is the given
+// number of bytes of either zeros or a repeated non-zero byte.
+func content(blocks ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		switch block := block.(type) {
+		case zeros:
+			buf.Write(make([]byte, block))
+		case data:
+			buf.Write(bytes.Repeat([]byte{0xab}, int(block)))
+		default:
+			panic(fmt.Sprintf("unexpected block %T", block))
+		}
+	}
+	return buf.Bytes()
+}
+
+type (
+	zeros int
+	data  int
+)
+
+var _ = Describe("populationWriter", func() {
+	newWriter := func(img *fakeImage, offset int64, discard bool) *populationWriter {
+		return &populationWriter{
+			log:         logr.Discard(),
+			img:         img,
+			offset:      offset,
+			discard:     discard,
+			bufferSize:  4 * sparseBlockSize,
+			concurrency: 1,
+			interval:    time.Hour,
+		}
+	}
+
+	It("should coalesce consecutive blocks of the same kind", func() {
+		img := newFakeImage(8 * sparseBlockSize)
+		src := content(data(2*sparseBlockSize), zeros(2*sparseBlockSize), data(sparseBlockSize))
+
+		w := newWriter(img, 0, false)
+		w.bufferSize = int64(len(src))
+		Expect(w.ReadFrom(bytes.NewReader(src))).To(BeEquivalentTo(len(src)))
+
+		Expect(img.ops).To(Equal([]imageOp{
+			{offset: 0, length: 2 * sparseBlockSize},
+			{offset: 4 * sparseBlockSize, length: sparseBlockSize},
+		}))
+		Expect(w.skippedBytes()).To(BeEquivalentTo(2 * sparseBlockSize))
+		Expect(w.writtenBytes()).To(BeEquivalentTo(len(src)))
+		Expect(img.data[:len(src)]).To(Equal(src))
+	})
+
+	It("should align blocks to the image when writing at an unaligned offset", func() {
+		img := newFakeImage(4 * sparseBlockSize)
+		// Blocks are those of the image, so the partially covered first block
+		// is zero, while the third one is written including its zeros.
+		src := content(zeros(sparseBlockSize-1000), zeros(sparseBlockSize), data(100), zeros(sparseBlockSize-100), data(10))
+
+		w := newWriter(img, 1000, true)
+		w.bufferSize = int64(len(src))
+		Expect(w.ReadFrom(bytes.NewReader(src))).To(BeEquivalentTo(len(src)))
+
+		Expect(img.ops).To(Equal([]imageOp{
+			{discard: true, offset: 1000, length: 2*sparseBlockSize - 1000},
+			{offset: 2 * sparseBlockSize, length: sparseBlockSize + 10},
+		}))
+		Expect(w.skippedBytes()).To(BeEquivalentTo(2*sparseBlockSize - 1000))
+	})
+
+	It("should skip zero blocks unless discarding them", func() {
+		src := content(zeros(sparseBlockSize), data(sparseBlockSize))
+
+		By("skipping zero blocks of a fresh image")
+		img := newFakeImage(2 * sparseBlockSize)
+		copy(img.data, content(data(sparseBlockSize)))
+		Expect(newWriter(img, 0, false).ReadFrom(bytes.NewReader(src))).To(BeEquivalentTo(len(src)))
+		Expect(img.ops).To(Equal([]imageOp{{offset: sparseBlockSize, length: sparseBlockSize}}))
+		Expect(img.data).To(Equal(content(data(2 * sparseBlockSize))))
+
+		By("discarding zero blocks of an image that may hold data")
+		img = newFakeImage(2 * sparseBlockSize)
+		copy(img.data, content(data(sparseBlockSize)))
+		Expect(newWriter(img, 0, true).ReadFrom(bytes.NewReader(src))).To(BeEquivalentTo(len(src)))
+		Expect(img.ops).To(Equal([]imageOp{
+			{discard: true, offset: 0, length: sparseBlockSize},
+			{offset: sparseBlockSize, length: sparseBlockSize},
+		}))
+		Expect(img.data).To(Equal(src))
+	})
+
+	It("should reuse its buffers", func() {
+		img := newFakeImage(16 * sparseBlockSize)
+		src := content(data(16 * sparseBlockSize))
+
+		w := newWriter(img, 0, false)
+		w.bufferSize = sparseBlockSize
+		w.concurrency = 2
+		img.writeDelay = time.Millisecond
+		Expect(w.ReadFrom(bytes.NewReader(src))).To(BeEquivalentTo(len(src)))
+
+		Expect(w.allocated).To(Equal(2))
+		Expect(w.buffers).To(HaveLen(2))
+		Expect(img.ops).To(HaveLen(16))
+		Expect(img.data).To(Equal(src))
+	})
+
+	It("should stop at the first failing write", func() {
+		img := newFakeImage(16 * sparseBlockSize)
+		src := content(data(16 * sparseBlockSize))
+		writeErr := errors.New("write failed")
+		img.writeErr, img.writeErrOffset = writeErr, 2*sparseBlockSize
+
+		w := newWriter(img, 0, false)
+		w.bufferSize = sparseBlockSize
+		w.concurrency = 2
+		n, err := w.ReadFrom(bytes.NewReader(src))
+		Expect(err).To(MatchError(writeErr))
+		Expect(n).To(BeNumerically("<", len(src)))
+		Expect(w.wait()).To(MatchError(writeErr))
+	})
+
+	It("should wait for the writes in flight when a write failed", func() {
+		img := newFakeImage(16 * sparseBlockSize)
+		src := content(data(16 * sparseBlockSize))
+		writeErr := errors.New("write failed")
+		img.writeErr, img.writeErrOffset = writeErr, sparseBlockSize
+		img.writeBlock = make(chan struct{})
+
+		w := newWriter(img, 0, false)
+		w.bufferSize = sparseBlockSize
+		w.concurrency = 2
+		// A checkpoint would wait for the blocked write.
+		w.lastCheckpoint = time.Now()
+
+		done := make(chan error)
+		go func() {
+			defer GinkgoRecover()
+			_, err := w.ReadFrom(bytes.NewReader(src))
+			done <- err
+		}()
+
+		Eventually(w.firstError).Should(MatchError(writeErr))
+		Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+
+		close(img.writeBlock)
+		Eventually(done).Should(Receive(MatchError(writeErr)))
+		Expect(img.ops).To(Equal([]imageOp{{offset: 0, length: sparseBlockSize}}))
+	})
+
+	It("should record checkpoints once the writes in flight completed", func() {
+		img := newFakeImage(16 * sparseBlockSize)
+		src := content(data(16 * sparseBlockSize))
+		source := digest.FromBytes(src)
+
+		var checkpoints []int64
+		img.onSetMetadata = func(key, value string) {
+			if key != checkpointOffsetKey {
+				return
+			}
+			offset, err := strconv.ParseInt(value, 10, 64)
+			Expect(err).NotTo(HaveOccurred())
+
+			var written int64
+			for _, op := range img.ops {
+				written += op.length
+			}
+			Expect(written).To(Equal(offset), "checkpoint at %d with %d bytes written", offset, written)
+			checkpoints = append(checkpoints, offset)
+		}
+
+		w := newWriter(img, 0, false)
+		w.source = source
+		w.hash = sha256.New()
+		w.bufferSize = sparseBlockSize
+		w.concurrency = 4
+		w.interval = 0
+		img.writeDelay = time.Millisecond
+		Expect(w.ReadFrom(bytes.NewReader(src))).To(BeEquivalentTo(len(src)))
+		Expect(w.verify()).To(Succeed())
+
+		Expect(checkpoints).NotTo(BeEmpty())
+		cp, err := readCheckpoint(img)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cp.offset).To(Equal(checkpoints[len(checkpoints)-1]))
+	})
+})
@@ -0,0 +1,130 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type populationMetrics struct {
+	bytesWritten   *prometheus.GaugeVec
+	bytesSkipped   *prometheus.GaugeVec
+	bytesTotal     *prometheus.GaugeVec
+	bytesPerSecond *prometheus.GaugeVec
+}
+
+func newPopulationMetrics() populationMetrics {
+	return populationMetrics{
+		bytesWritten: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cephlet_snapshot_population_written_bytes",
+			Help: "Number of bytes written to the rbd image of a snapshot being populated.",
+		}, []string{"snapshot"}),
+		bytesSkipped: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cephlet_snapshot_population_skipped_bytes",
+			Help: "Number of zero bytes of a snapshot being populated that were skipped instead of written.",
+		}, []string{"snapshot"}),
+		bytesTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cephlet_snapshot_population_total_bytes",
+			Help: "Size of the source of a snapshot being populated.",
+		}, []string{"snapshot"}),
+		bytesPerSecond: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cephlet_snapshot_population_bytes_per_second",
+			Help: "Average throughput of a snapshot being populated.",
+		}, []string{"snapshot"}),
+	}
+}
+
+func (m populationMetrics) set(id string, progress api.SnapshotProgress) {
+	m.bytesWritten.WithLabelValues(id).Set(float64(progress.BytesWritten))
+	m.bytesSkipped.WithLabelValues(id).Set(float64(progress.BytesSkipped))
+	m.bytesTotal.WithLabelValues(id).Set(float64(progress.TotalBytes))
+	m.bytesPerSecond.WithLabelValues(id).Set(float64(progress.BytesPerSecond))
+}
+
+func (m populationMetrics) delete(id string) {
+	m.bytesWritten.DeleteLabelValues(id)
+	m.bytesSkipped.DeleteLabelValues(id)
+	m.bytesTotal.DeleteLabelValues(id)
+	m.bytesPerSecond.DeleteLabelValues(id)
+}
+
+func (m populationMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.bytesWritten.Describe(ch)
+	m.bytesSkipped.Describe(ch)
+	m.bytesTotal.Describe(ch)
+	m.bytesPerSecond.Describe(ch)
+}
+
+func (m populationMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.bytesWritten.Collect(ch)
+	m.bytesSkipped.Collect(ch)
+	m.bytesTotal.Collect(ch)
+	m.bytesPerSecond.Collect(ch)
+}
+
+// populationProgress returns the progress of a population that started at
+// start and resumed after resumedBytes. writtenBytes of the content were
+// written so far, of which skippedBytes were skipped zero blocks. rater
+// measures the time elapsed since the population (re)started.
+func populationProgress(rater *utils.Rater, totalBytes, resumedBytes, writtenBytes, skippedBytes int64, start time.Time) api.SnapshotProgress {
+	_, elapsed := rater.Rate()
+	progress := api.SnapshotProgress{
+		BytesWritten: writtenBytes,
+		BytesSkipped: skippedBytes,
+		TotalBytes:   totalBytes,
+		StartTime:    start,
+	}
+	if elapsed > 0 {
+		progress.BytesPerSecond = int64(float64(writtenBytes-resumedBytes) / elapsed.Seconds())
+	}
+	if progress.BytesPerSecond > 0 && totalBytes >= progress.BytesWritten {
+		remaining := time.Duration(float64(totalBytes-progress.BytesWritten) / float64(progress.BytesPerSecond) * float64(time.Second))
+		eta := time.Now().Add(remaining).Truncate(time.Second)
+		progress.EstimatedCompletionTime = &eta
+	}
+	return progress
+}
+
+// recordProgress records progress in the status of snapshot. It is written
+// to the progress store, so it is not audited. Failing to do so is not fatal
+// to the population. snapshot is refreshed in that case, so the update
+// marking it as populated does not conflict.
+func (r *SnapshotReconciler) recordProgress(ctx context.Context, log logr.Logger, snapshot *api.Snapshot, progress api.SnapshotProgress) {
+	r.populationMetrics.set(snapshot.ID, progress)
+	log.Info("Populating",
+		"bytesWritten", progress.BytesWritten,
+		"bytesSkipped", progress.BytesSkipped,
+		"totalBytes", progress.TotalBytes,
+		"bytesPerSecond", progress.BytesPerSecond,
+	)
+
+	snapshot.Status.Progress = &progress
+	if _, err := r.progressStore.Update(ctx, snapshot); err != nil {
+		log.V(1).Info("Failed to record population progress", "error", err.Error())
+
+		current, err := r.progressStore.Get(ctx, snapshot.ID)
+		if err != nil {
+			log.Error(err, "failed to refresh snapshot")
+			return
+		}
+		*snapshot = *current
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/qcow2"
+)
+
+type closeFunc func() error
+
+func (f closeFunc) Close() error {
+	return f()
+}
+
+// qcow2SpoolPattern is the pattern of the names of spooled qcow2 images.
+const qcow2SpoolPattern = "cephlet-qcow2-"
+
+// qcow2Spool spools qcow2 images to files in dir, as converting them needs
+// random access. Images larger than sizeLimit bytes are rejected, unless
+// sizeLimit is zero.
+type qcow2Spool struct {
+	dir       string
+	sizeLimit int64
+}
+
+// spool copies the qcow2 image in r to a file and returns its virtual disk as
+// raw content together with its size. verify is called once r was read
+// completely.
+func (s qcow2Spool) spool(r io.Reader, verify func() error) (io.ReadCloser, uint64, error) {
+	f, err := os.CreateTemp(s.dir, qcow2SpoolPattern)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	remove := func() error {
+		return errors.Join(f.Close(), os.Remove(f.Name()))
+	}
+
+	if s.sizeLimit > 0 {
+		r = io.LimitReader(r, s.sizeLimit+1)
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return nil, 0, errors.Join(fmt.Errorf("failed to spool qcow2 image: %w", err), remove())
+	}
+	if s.sizeLimit > 0 && n > s.sizeLimit {
+		return nil, 0, errors.Join(permanentError(ReasonUnsupportedFormat,
+			fmt.Errorf("qcow2 image exceeds the spool size limit of %d bytes", s.sizeLimit)), remove())
+	}
+	if verify != nil {
+		if err := verify(); err != nil {
+			return nil, 0, errors.Join(err, remove())
+		}
+	}
+
+	img, err := qcow2.Open(f)
+	if err != nil {
+		return nil, 0, errors.Join(permanentError(ReasonUnsupportedFormat, fmt.Errorf("failed to open qcow2 image: %w", err)), remove())
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{img.NewReader(), closeFunc(remove)}, img.Size(), nil
+}
+
+// removeStale removes the files of images spooled by a previous process.
+func (s qcow2Spool) removeStale(log logr.Logger) error {
+	dir := s.dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	names, err := filepath.Glob(filepath.Join(dir, qcow2SpoolPattern+"*"))
+	if err != nil {
+		return fmt.Errorf("failed to list spool files: %w", err)
+	}
+
+	var errs []error
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		log.V(1).Info("Removed stale spool file", "name", name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/qcow2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("qcow2Spool", func() {
+	It("should reject images exceeding the size limit", func() {
+		dir := GinkgoT().TempDir()
+		image := append(append([]byte{}, qcow2.Magic...), make([]byte, 1020)...)
+
+		_, _, err := qcow2Spool{dir: dir, sizeLimit: 1023}.spool(bytes.NewReader(image), nil)
+		rErr, ok := classifyError(err)
+		Expect(ok).To(BeTrue())
+		Expect(rErr.permanent).To(BeTrue())
+		Expect(rErr.reason).To(Equal(ReasonUnsupportedFormat))
+		Expect(os.ReadDir(dir)).To(BeEmpty())
+	})
+
+	It("should remove stale spool files", func() {
+		dir := GinkgoT().TempDir()
+		for _, name := range []string{qcow2SpoolPattern + "123", "other"} {
+			Expect(os.WriteFile(filepath.Join(dir, name), nil, 0o600)).To(Succeed())
+		}
+
+		Expect(qcow2Spool{dir: dir}.removeStale(logr.Discard())).To(Succeed())
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(ConsistOf(HaveField("Name()", "other")))
+	})
+})
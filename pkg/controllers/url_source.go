@@ -0,0 +1,398 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxURLResumes is the number of consecutive failed reads of a download
+// that are resumed with a ranged request.
+const maxURLResumes = 3
+
+// IsURLImage reports whether ref refers to a disk image downloaded over
+// HTTP(S) rather than an onmetal image.
+func IsURLImage(ref string) bool {
+	return strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://")
+}
+
+// ParseURLImage parses a reference to a disk image downloaded over HTTP(S).
+// The checksum of the disk image is mandatory and given as fragment, e.g.
+// https://example.org/disk.raw.zst#sha256:<hex>.
+func ParseURLImage(ref string) (*api.URLSource, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	if u.Fragment == "" {
+		return nil, fmt.Errorf("must specify checksum as url fragment")
+	}
+
+	checksum, err := digest.Parse(u.Fragment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum: %w", err)
+	}
+	if algorithm := checksum.Algorithm(); algorithm != digest.SHA256 && algorithm != digest.SHA512 {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+
+	u.Fragment = ""
+	return &api.URLSource{
+		URL:      u.String(),
+		Checksum: checksum.String(),
+	}, nil
+}
+
+// errURLNotAllowed is returned for urls rejected by a URLSourcePolicy.
+var errURLNotAllowed = errors.New("url is not allowed")
+
+// URLSourcePolicy restricts the hosts disk images are downloaded from over
+// HTTP(S), as the downloads are requested by users but run from within the
+// network of the node. A nil policy or one without allowed hosts disables
+// url sources.
+type URLSourcePolicy struct {
+	hosts     []string
+	networks  []*net.IPNet
+	allowHTTP bool
+}
+
+// NewURLSourcePolicy creates a policy allowing the given hosts. Entries are
+// host names, IPs or CIDRs. A host name starting with a dot allows all of
+// its subdomains. Plain http is only allowed if allowHTTP is set.
+func NewURLSourcePolicy(allowed []string, allowHTTP bool) (*URLSourcePolicy, error) {
+	p := &URLSourcePolicy{allowHTTP: allowHTTP}
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "" || entry == ".":
+			return nil, fmt.Errorf("invalid empty host")
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", entry, err)
+			}
+			p.networks = append(p.networks, network)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			p.networks = append(p.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			p.hosts = append(p.hosts, entry)
+		}
+	}
+	return p, nil
+}
+
+// Enabled reports whether the policy allows any url source.
+func (p *URLSourcePolicy) Enabled() bool {
+	return p != nil && (len(p.hosts) > 0 || len(p.networks) > 0)
+}
+
+// Check reports whether disk images may be downloaded from rawURL. Host
+// names not allowed by name are only checked against the allowed networks
+// once they are resolved by the client of the policy.
+func (p *URLSourcePolicy) Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	return p.checkURL(u)
+}
+
+func (p *URLSourcePolicy) checkURL(u *url.URL) error {
+	if !p.Enabled() {
+		return fmt.Errorf("%w: url sources are disabled", errURLNotAllowed)
+	}
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !p.allowHTTP {
+			return fmt.Errorf("%w: plain http is not allowed", errURLNotAllowed)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported url scheme %q", errURLNotAllowed, u.Scheme)
+	}
+
+	host := u.Hostname()
+	if p.allowsHost(host) {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !p.allowsIP(ip) {
+			return fmt.Errorf("%w: ip %s is not allowed", errURLNotAllowed, ip)
+		}
+		return nil
+	}
+	if len(p.networks) == 0 {
+		return fmt.Errorf("%w: host %q is not allowed", errURLNotAllowed, host)
+	}
+	return nil
+}
+
+func (p *URLSourcePolicy) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.hosts {
+		if strings.HasPrefix(allowed, ".") {
+			if strings.HasSuffix(host, allowed) {
+				return true
+			}
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *URLSourcePolicy) allowsIP(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPClient returns a client that only connects to hosts allowed by the
+// policy, including on redirects and after resolving host names.
+func (p *URLSourcePolicy) HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect to the hosts on behalf of the client, bypassing
+	// the checks of the dialer.
+	transport.Proxy = nil
+	// Transparent decompression hides the content length, which is required
+	// to populate a snapshot, and the checksum covers the content as served.
+	transport.DisableCompression = true
+	transport.DialContext = p.dialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+}
+
+// dialContext connects to addr if its host is allowed by name or if the
+// address it resolves to is within an allowed network.
+func (p *URLSourcePolicy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !p.Enabled() || !p.allowsHost(host) {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !p.Enabled() || !p.allowsIP(net.ParseIP(ip)) {
+				return fmt.Errorf("%w: ip %s of host %q is not allowed", errURLNotAllowed, ip, host)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// urlLayer serves the content of a url source like the layer of an image.
+// Its size is known once its content was requested.
+type urlLayer struct {
+	client   *http.Client
+	url      string
+	checksum digest.Digest
+	size     int64
+}
+
+func newURLLayer(client *http.Client, src *api.URLSource) (*urlLayer, error) {
+	checksum, err := digest.Parse(src.Checksum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum: %w", err)
+	}
+	return &urlLayer{
+		client:   client,
+		url:      src.URL,
+		checksum: checksum,
+		size:     -1,
+	}, nil
+}
+
+func (l *urlLayer) Descriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		Digest: l.checksum,
+		Size:   l.size,
+	}
+}
+
+// Content downloads the content. It can be seeked if the server supports
+// ranged requests.
+func (l *urlLayer) Content(ctx context.Context) (io.ReadCloser, error) {
+	r := &urlReader{ctx: ctx, client: l.client, url: l.url}
+	resp, err := r.get(0)
+	if err != nil {
+		return nil, err
+	}
+	r.body = resp.Body
+
+	if resp.ContentLength < 0 {
+		_ = r.Close()
+		return nil, permanentError(ReasonImageResolutionFailed, fmt.Errorf("server does not report the content length of %s", l.url))
+	}
+	l.size = resp.ContentLength
+
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return r, nil
+	}
+	r.size = resp.ContentLength
+	return &rangeURLReader{urlReader: r}, nil
+}
+
+type urlReader struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	body   io.ReadCloser
+	offset int64
+	size   int64
+}
+
+func (r *urlReader) get(offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, permanentError(ReasonInvalidImageReference, fmt.Errorf("failed to create request: %w", err))
+	}
+
+	expected := http.StatusOK
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		expected = http.StatusPartialContent
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errURLNotAllowed) {
+			return nil, permanentError(ReasonInvalidImageReference, fmt.Errorf("failed to get %s: %w", r.url, err))
+		}
+		return nil, transientError(ReasonImageResolutionFailed, fmt.Errorf("failed to get %s: %w", r.url, err))
+	}
+	if resp.StatusCode != expected {
+		_ = resp.Body.Close()
+		err := fmt.Errorf("failed to get %s: unexpected status %s", r.url, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, permanentError(ReasonImageNotFound, err)
+		}
+		return nil, transientError(ReasonImageResolutionFailed, err)
+	}
+	return resp, nil
+}
+
+func (r *urlReader) Read(p []byte) (int, error) {
+	if r.body == nil {
+		resp, err := r.get(r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *urlReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// rangeURLReader is a urlReader of a server supporting ranged requests. It
+// can be seeked and resumes failed reads where they stopped.
+type rangeURLReader struct {
+	*urlReader
+	resumes int
+}
+
+func (r *rangeURLReader) Read(p []byte) (int, error) {
+	n, err := r.urlReader.Read(p)
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		r.resumes = 0
+		return n, err
+	case r.ctx.Err() != nil || r.resumes >= maxURLResumes:
+		return n, err
+	}
+	if _, ok := classifyError(err); ok {
+		// The request for the resumed range itself failed.
+		return n, err
+	}
+
+	r.resumes++
+	_ = r.Close()
+	return n, nil
+}
+
+func (r *rangeURLReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+
+	if offset != r.offset {
+		if err := r.Close(); err != nil {
+			return 0, err
+		}
+		r.offset = offset
+	}
+	return offset, nil
+}
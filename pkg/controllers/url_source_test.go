@@ -0,0 +1,146 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	. "github.com/onmetal/cephlet/pkg/controllers"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("URL images", func() {
+	checksum := "sha256:" + strings.Repeat("a", 64)
+
+	It("should tell url images from onmetal images", func() {
+		Expect(IsURLImage("https://example.org/disk.raw#" + checksum)).To(BeTrue())
+		Expect(IsURLImage("ghcr.io/onmetal/image:latest")).To(BeFalse())
+	})
+
+	It("should take the checksum from the fragment", func() {
+		Expect(ParseURLImage("https://example.org/disk.qcow2?token=foo#" + checksum)).To(Equal(&api.URLSource{
+			URL:      "https://example.org/disk.qcow2?token=foo",
+			Checksum: checksum,
+		}))
+	})
+
+	DescribeTable("should reject invalid references",
+		func(ref string) {
+			_, err := ParseURLImage(ref)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("missing checksum", "https://example.org/disk.raw"),
+		Entry("invalid checksum", "https://example.org/disk.raw#sha256:foo"),
+		Entry("unsupported algorithm", "https://example.org/disk.raw#sha384:"+strings.Repeat("a", 96)),
+		Entry("unsupported scheme", "ftp://example.org/disk.raw#"+checksum),
+	)
+})
+
+var _ = Describe("URLSourcePolicy", func() {
+	It("should disable url sources by default", func() {
+		var policy *URLSourcePolicy
+		Expect(policy.Check("https://example.org/disk.raw")).NotTo(Succeed())
+
+		policy, err := NewURLSourcePolicy(nil, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Check("https://example.org/disk.raw")).NotTo(Succeed())
+	})
+
+	It("should only allow plain http if enabled", func() {
+		policy, err := NewURLSourcePolicy([]string{"example.org"}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Check("https://example.org/disk.raw")).To(Succeed())
+		Expect(policy.Check("http://example.org/disk.raw")).NotTo(Succeed())
+
+		policy, err = NewURLSourcePolicy([]string{"example.org"}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy.Check("http://example.org/disk.raw")).To(Succeed())
+	})
+
+	DescribeTable("should match hosts",
+		func(allowed []string, rawURL string, match bool) {
+			policy, err := NewURLSourcePolicy(allowed, false)
+			Expect(err).NotTo(HaveOccurred())
+			if match {
+				Expect(policy.Check(rawURL)).To(Succeed())
+			} else {
+				Expect(policy.Check(rawURL)).NotTo(Succeed())
+			}
+		},
+		Entry("exact host", []string{"example.org"}, "https://Example.org:8443/disk.raw", true),
+		Entry("other host", []string{"example.org"}, "https://images.example.org/disk.raw", false),
+		Entry("subdomain", []string{".example.org"}, "https://images.example.org/disk.raw", true),
+		Entry("suffix without dot", []string{".example.org"}, "https://badexample.org/disk.raw", false),
+		Entry("ip in cidr", []string{"10.0.0.0/8"}, "https://10.1.2.3/disk.raw", true),
+		Entry("ip outside cidr", []string{"10.0.0.0/8"}, "https://169.254.169.254/disk.raw", false),
+		Entry("single ip", []string{"2001:db8::1"}, "https://[2001:db8::1]/disk.raw", true),
+		Entry("host name resolved on dial", []string{"10.0.0.0/8"}, "https://example.org/disk.raw", true),
+	)
+
+	DescribeTable("should reject invalid entries",
+		func(entry string) {
+			_, err := NewURLSourcePolicy([]string{entry}, false)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("empty", ""),
+		Entry("invalid cidr", "10.0.0.0/33"),
+	)
+
+	It("should download with the content length and encoding as served", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			Expect(req.Header.Get("Accept-Encoding")).To(BeEmpty())
+			_, _ = w.Write([]byte("disk"))
+		}))
+		DeferCleanup(server.Close)
+
+		policy, err := NewURLSourcePolicy([]string{"127.0.0.1"}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err := policy.HTTPClient().Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(resp.Body.Close)
+		Expect(resp.ContentLength).To(Equal(int64(4)))
+	})
+
+	It("should not connect to addresses outside the allowed networks", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			Fail("unexpected request")
+		}))
+		DeferCleanup(server.Close)
+
+		policy, err := NewURLSourcePolicy([]string{"10.0.0.0/8"}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = policy.HTTPClient().Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+		Expect(err).To(MatchError(ContainSubstring("not allowed")))
+	})
+
+	It("should not follow redirects to hosts that are not allowed", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.Redirect(w, req, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		}))
+		DeferCleanup(server.Close)
+
+		policy, err := NewURLSourcePolicy([]string{"127.0.0.1"}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = policy.HTTPClient().Get(server.URL)
+		Expect(err).To(MatchError(ContainSubstring("not allowed")))
+	})
+})
@@ -0,0 +1,134 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks string values sealed by SealFields. Values without it
+// are plaintext written before the field was sealed.
+const sealedPrefix = "sealed:v1:"
+
+// IsSealed reports whether value was sealed by SealFields.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// SealFields encrypts the string values at the given dot separated paths of the
+// JSON object data. Missing, empty and already sealed values are left as is.
+func SealFields(data []byte, enc Encryptor, paths []string) ([]byte, error) {
+	return transformFields(data, paths, func(value string) (string, error) {
+		if value == "" || IsSealed(value) {
+			return value, nil
+		}
+
+		sealed, err := enc.Encrypt([]byte(value))
+		if err != nil {
+			return "", err
+		}
+		return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+	})
+}
+
+// UnsealFields decrypts the string values at the given dot separated paths of
+// the JSON object data that were sealed by SealFields. Plaintext values are
+// left as is.
+func UnsealFields(data []byte, enc Encryptor, paths []string) ([]byte, error) {
+	return transformFields(data, paths, func(value string) (string, error) {
+		if !IsSealed(value) {
+			return value, nil
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+		if err != nil {
+			return "", fmt.Errorf("failed to decode sealed value: %w", err)
+		}
+
+		plain, err := enc.Decrypt(sealed)
+		if err != nil {
+			return "", err
+		}
+		return string(plain), nil
+	})
+}
+
+func transformFields(data []byte, paths []string, transform func(value string) (string, error)) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object: %w", err)
+	}
+
+	changed := false
+	for _, path := range paths {
+		parent, key, ok := lookupParent(obj, path)
+		if !ok {
+			continue
+		}
+
+		value, ok := parent[key].(string)
+		if !ok {
+			continue
+		}
+
+		transformed, err := transform(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", path, err)
+		}
+		if transformed != value {
+			parent[key] = transformed
+			changed = true
+		}
+	}
+
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(obj)
+}
+
+func lookupParent(obj map[string]interface{}, path string) (map[string]interface{}, string, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		obj = next
+	}
+	return obj, parts[len(parts)-1], true
+}
+
+// NeedsSealing reports whether any of the string values at the given dot
+// separated paths of the JSON object data is plaintext.
+func NeedsSealing(data []byte, paths []string) (bool, error) {
+	needsSealing := false
+	if _, err := transformFields(data, paths, func(value string) (string, error) {
+		if value != "" && !IsSealed(value) {
+			needsSealing = true
+		}
+		return value, nil
+	}); err != nil {
+		return false, err
+	}
+	return needsSealing, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/onmetal/cephlet/pkg/encryption"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fields", func() {
+	var enc encryption.Encryptor
+
+	BeforeEach(func() {
+		kekPath := filepath.Join(GinkgoT().TempDir(), "kek")
+		Expect(os.WriteFile(kekPath, []byte("abcjdkekakakakakakakkadfkkasfdks"), 0600)).To(Succeed())
+
+		var err error
+		enc, err = encryption.NewAesGcmEncryptor(kekPath)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	paths := []string{"status.access.userKey", "status.missing.field"}
+	plaintext := []byte(`{"id":"foo","size":1024,"status":{"access":{"user":"bar","userKey":"secret"}}}`)
+
+	userKey := func(data []byte) string {
+		var obj struct {
+			Status struct {
+				Access struct {
+					UserKey string `json:"userKey"`
+				} `json:"access"`
+			} `json:"status"`
+		}
+		Expect(json.Unmarshal(data, &obj)).To(Succeed())
+		return obj.Status.Access.UserKey
+	}
+
+	It("should seal and unseal fields", func() {
+		sealed, err := encryption.SealFields(plaintext, enc, paths)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encryption.IsSealed(userKey(sealed))).To(BeTrue())
+		Expect(string(sealed)).NotTo(ContainSubstring("secret"))
+		Expect(encryption.NeedsSealing(sealed, paths)).To(BeFalse())
+
+		By("not sealing sealed fields again")
+		Expect(encryption.SealFields(sealed, enc, paths)).To(Equal(sealed))
+
+		unsealed, err := encryption.UnsealFields(sealed, enc, paths)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unsealed).To(MatchJSON(plaintext))
+	})
+
+	It("should leave plaintext fields as they are when unsealing", func() {
+		Expect(encryption.NeedsSealing(plaintext, paths)).To(BeTrue())
+		Expect(encryption.UnsealFields(plaintext, enc, paths)).To(Equal(plaintext))
+	})
+})
@@ -24,7 +24,6 @@ import (
 	"github.com/onmetal/cephlet/pkg/api"
 	"github.com/onmetal/cephlet/pkg/store"
 	"k8s.io/apimachinery/pkg/util/sets"
-	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 type Handler[E api.Object] interface {
@@ -64,36 +63,43 @@ type handle[E api.Object] struct {
 
 type ListWatchSourceOptions struct {
 	ResyncDuration time.Duration
+	// PageSize is the number of objects listed at once on resync.
+	PageSize int64
 }
 
 func setListWatchSourceOptionsDefaults(o *ListWatchSourceOptions) {
 	if o.ResyncDuration == 0 {
 		o.ResyncDuration = 1 * time.Hour
 	}
+	if o.PageSize == 0 {
+		o.PageSize = store.DefaultListPageSize
+	}
 }
 
-func NewListWatchSource[E api.Object](listFunc func(ctx context.Context) ([]E, error), watchFunc func(ctx context.Context) (store.Watch[E], error), opts ListWatchSourceOptions) (*ListWatchSource[E], error) {
+func NewListWatchSource[E api.Object](listPageFunc store.ListPageFunc[E], watchFunc func(ctx context.Context) (store.Watch[E], error), opts ListWatchSourceOptions) (*ListWatchSource[E], error) {
 
 	setListWatchSourceOptionsDefaults(&opts)
 
 	return &ListWatchSource[E]{
-		listFunc:  listFunc,
-		watchFunc: watchFunc,
+		listPageFunc: listPageFunc,
+		watchFunc:    watchFunc,
 
 		handles: sets.New[*handle[E]](),
 
 		resyncDuration: opts.ResyncDuration,
+		pageSize:       opts.PageSize,
 	}, nil
 }
 
 type ListWatchSource[E api.Object] struct {
-	listFunc  func(ctx context.Context) ([]E, error)
-	watchFunc func(ctx context.Context) (store.Watch[E], error)
+	listPageFunc store.ListPageFunc[E]
+	watchFunc    func(ctx context.Context) (store.Watch[E], error)
 
 	handlesMu sync.RWMutex
 	handles   sets.Set[*handle[E]]
 
 	resyncDuration time.Duration
+	pageSize       int64
 }
 
 func (s *ListWatchSource[E]) handlers() []Handler[E] {
@@ -150,6 +156,9 @@ func (s *ListWatchSource[E]) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start watch: %w", err)
 	}
 
+	// relist is signalled if the watch overflowed and events were dropped.
+	relist := make(chan struct{}, 1)
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -159,6 +168,12 @@ func (s *ListWatchSource[E]) Start(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return
+			case <-watch.Overflow():
+				log.Info("Watch overflowed, relisting")
+				select {
+				case relist <- struct{}{}:
+				default:
+				}
 			case evt := <-watch.Events():
 				eventType, err := typeFromWatchType(evt.Type)
 				if err != nil {
@@ -174,28 +189,24 @@ func (s *ListWatchSource[E]) Start(ctx context.Context) error {
 		}
 	}()
 
-	ticker := time.NewTicker(s.resyncDuration)
-	defer ticker.Stop()
-
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		wait.UntilWithContext(ctx, func(ctx context.Context) {
-			objs, err := s.listFunc(ctx)
-			if err != nil {
-				log.Error(err, "failed to list objects")
-				return
-			}
+		ticker := time.NewTicker(s.resyncDuration)
+		defer ticker.Stop()
 
-			for _, obj := range objs {
-				s.enqueue(Event[E]{
-					Type:   TypeGeneric,
-					Object: obj,
-				})
-			}
-		}, s.resyncDuration)
+		for {
+			s.list(ctx, log)
 
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-relist:
+				ticker.Reset(s.resyncDuration)
+			}
+		}
 	}()
 
 	wg.Wait()
@@ -203,6 +214,20 @@ func (s *ListWatchSource[E]) Start(ctx context.Context) error {
 	return nil
 }
 
+func (s *ListWatchSource[E]) list(ctx context.Context, log logr.Logger) {
+	if err := store.ForEachPage(ctx, s.listPageFunc, s.pageSize, func(objs []E) error {
+		for _, obj := range objs {
+			s.enqueue(Event[E]{
+				Type:   TypeGeneric,
+				Object: obj,
+			})
+		}
+		return nil
+	}); err != nil {
+		log.Error(err, "failed to list objects")
+	}
+}
+
 func typeFromWatchType(eventType store.WatchEventType) (Type, error) {
 	switch eventType {
 	case store.WatchEventTypeCreated:
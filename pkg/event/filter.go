@@ -0,0 +1,75 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"sync"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"golang.org/x/exp/slices"
+)
+
+type observedObject struct {
+	generation int64
+	finalizers []string
+}
+
+// StatusUpdateFilter drops update events that only changed the status of an
+// object, i.e. neither its generation nor its finalizers. Controllers writing
+// their own status would otherwise requeue the object on every write.
+type StatusUpdateFilter[E api.Object] struct {
+	handler Handler[E]
+
+	mu   sync.Mutex
+	seen map[string]observedObject
+}
+
+func NewStatusUpdateFilter[E api.Object](handler Handler[E]) *StatusUpdateFilter[E] {
+	return &StatusUpdateFilter[E]{
+		handler: handler,
+		seen:    make(map[string]observedObject),
+	}
+}
+
+func (f *StatusUpdateFilter[E]) Handle(evt Event[E]) {
+	if f.observe(evt) {
+		f.handler.Handle(evt)
+	}
+}
+
+// observe records the object of evt and reports whether the event has to be
+// handled.
+func (f *StatusUpdateFilter[E]) observe(evt Event[E]) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := evt.Object.GetID()
+	if evt.Type == TypeDeleted {
+		delete(f.seen, id)
+		return true
+	}
+
+	observed := observedObject{
+		generation: evt.Object.GetGeneration(),
+		finalizers: slices.Clone(evt.Object.GetFinalizers()),
+	}
+	last, ok := f.seen[id]
+	f.seen[id] = observed
+
+	if evt.Type != TypeUpdated || !ok {
+		return true
+	}
+	return last.generation != observed.generation || !slices.Equal(last.finalizers, observed.finalizers)
+}
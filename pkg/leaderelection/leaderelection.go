@@ -0,0 +1,270 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+// ErrLeadershipLost is returned by Run if the lease could not be renewed in
+// time and another replica may have become the leader.
+var ErrLeadershipLost = errors.New("leadership lost")
+
+const (
+	DefaultLockObject = "cephlet.leader"
+	DefaultLockName   = "leader"
+
+	// lockFlagMayRenew is LIBRADOS_LOCK_FLAG_MAY_RENEW which acquires the lock
+	// or extends it if it is already held by the same client and cookie.
+	lockFlagMayRenew byte = 0x1
+)
+
+type Options struct {
+	// LockObject is the rados object the lock is taken on.
+	LockObject string
+	// LockName is the name of the lock on LockObject.
+	LockName string
+	// Identity identifies the replica holding the lock and is used as lock
+	// cookie. Defaults to the hostname with a random suffix.
+	Identity string
+
+	// LeaseDuration is the duration after which the lock expires unless renewed.
+	LeaseDuration time.Duration
+	// RenewDeadline is the duration the leader keeps trying to renew the lease
+	// before giving up leadership. It has to be less than LeaseDuration.
+	RenewDeadline time.Duration
+	// RetryPeriod is the duration between attempts to acquire or renew the lease.
+	RetryPeriod time.Duration
+}
+
+func setOptionsDefaults(o *Options) error {
+	if o.LockObject == "" {
+		o.LockObject = DefaultLockObject
+	}
+	if o.LockName == "" {
+		o.LockName = DefaultLockName
+	}
+	if o.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+		o.Identity = hostname + "_" + rand.String(5)
+	}
+	if o.LeaseDuration == 0 {
+		o.LeaseDuration = 15 * time.Second
+	}
+	if o.RenewDeadline == 0 {
+		o.RenewDeadline = 10 * time.Second
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = 2 * time.Second
+	}
+	return nil
+}
+
+// Elector elects a single leader among all replicas using the same pool by
+// holding an exclusive rados lock with a renewable lease.
+type Elector struct {
+	conn *rados.Conn
+	pool string
+
+	lockObject string
+	lockName   string
+	identity   string
+
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	leader atomic.Bool
+}
+
+func New(conn *rados.Conn, pool string, opts Options) (*Elector, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("must specify conn")
+	}
+	if pool == "" {
+		return nil, fmt.Errorf("must specify pool")
+	}
+
+	if err := setOptionsDefaults(&opts); err != nil {
+		return nil, err
+	}
+
+	if opts.RenewDeadline >= opts.LeaseDuration {
+		return nil, fmt.Errorf("renew deadline %s must be less than lease duration %s", opts.RenewDeadline, opts.LeaseDuration)
+	}
+	if opts.RetryPeriod >= opts.RenewDeadline {
+		return nil, fmt.Errorf("retry period %s must be less than renew deadline %s", opts.RetryPeriod, opts.RenewDeadline)
+	}
+
+	return &Elector{
+		conn:          conn,
+		pool:          pool,
+		lockObject:    opts.LockObject,
+		lockName:      opts.LockName,
+		identity:      opts.Identity,
+		leaseDuration: opts.LeaseDuration,
+		renewDeadline: opts.RenewDeadline,
+		retryPeriod:   opts.RetryPeriod,
+	}, nil
+}
+
+// Identity returns the identity the elector holds the lock with.
+func (e *Elector) Identity() string {
+	return e.identity
+}
+
+// IsLeader reports whether the elector currently holds the lease.
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run blocks until the lease is acquired and then calls run with a context
+// that is cancelled once leadership is lost or ctx is done. After run
+// returned, the lock is released. Run returns nil if ctx is done and
+// ErrLeadershipLost if the lease could not be renewed, in which case run may
+// not be called again as another replica may already be leading.
+func (e *Elector) Run(ctx context.Context, run func(ctx context.Context)) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("Identity", e.identity)
+
+	ioCtx, err := e.conn.OpenIOContext(e.pool)
+	if err != nil {
+		return fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	log.Info("Acquiring leader lease", "LockObject", e.lockObject)
+	renewed, err := e.acquire(ctx, ioCtx, log)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	log.Info("Acquired leader lease")
+
+	e.leader.Store(true)
+	defer e.leader.Store(false)
+	defer e.release(ioCtx, log)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		run(leaderCtx)
+	}()
+
+	err = e.renew(leaderCtx, ioCtx, log, renewed)
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// acquire tries to take the lock until it succeeds or ctx is done and returns
+// the time the lease was taken at.
+func (e *Elector) acquire(ctx context.Context, ioCtx *rados.IOContext, log logr.Logger) (time.Time, error) {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		ok, err := e.tryLock(ioCtx)
+		switch {
+		case err != nil:
+			log.Error(err, "Failed to acquire leader lease")
+		case ok:
+			return now, nil
+		default:
+			log.V(1).Info("Leader lease is held by another replica")
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// renew extends the lease until ctx is done. It returns ErrLeadershipLost
+// if the lease was not renewed within the renew deadline.
+func (e *Elector) renew(ctx context.Context, ioCtx *rados.IOContext, log logr.Logger, renewed time.Time) error {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		ok, err := e.tryLock(ioCtx)
+		switch {
+		case err != nil:
+			log.Error(err, "Failed to renew leader lease")
+		case ok:
+			renewed = now
+			continue
+		default:
+			log.Info("Leader lease was taken over by another replica")
+			return ErrLeadershipLost
+		}
+
+		if time.Since(renewed) >= e.renewDeadline {
+			log.Info("Failed to renew leader lease within deadline", "RenewDeadline", e.renewDeadline)
+			return ErrLeadershipLost
+		}
+	}
+}
+
+func (e *Elector) tryLock(ioCtx *rados.IOContext) (bool, error) {
+	flags := lockFlagMayRenew
+	res, err := ioCtx.LockExclusive(e.lockObject, e.lockName, e.identity, e.identity, e.leaseDuration, &flags)
+	if err != nil {
+		return false, err
+	}
+	switch res {
+	case 0:
+		return true, nil
+	case -int(syscall.EBUSY):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected lock result %d", res)
+	}
+}
+
+func (e *Elector) release(ioCtx *rados.IOContext, log logr.Logger) {
+	if _, err := ioCtx.Unlock(e.lockObject, e.lockName, e.identity); err != nil {
+		log.Error(err, "Failed to release leader lease")
+		return
+	}
+	log.Info("Released leader lease")
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/onmetal/cephlet/pkg/store"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Export returns all entries of the store, serialized as they are stored.
+func (s *Store[E]) Export(ctx context.Context) (map[string]json.RawMessage, error) {
+	ioCtx, err := s.openIOContext()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	var (
+		entries    = make(map[string]json.RawMessage)
+		startAfter string
+	)
+	for {
+		values, more, err := s.fetchRawBatch(ioCtx, startAfter, listBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for id, data := range values {
+			entries[id] = data
+			if id > startAfter {
+				startAfter = id
+			}
+		}
+
+		if !more || len(values) == 0 {
+			return entries, nil
+		}
+	}
+}
+
+type ImportOptions struct {
+	// Overwrite replaces existing entries instead of reporting them as
+	// conflicts.
+	Overwrite bool
+	// DryRun only reports the conflicts without writing anything.
+	DryRun bool
+}
+
+// Import writes entries serialized as returned by Export and returns the ids
+// of the entries that already exist. Unless opts.Overwrite is set, nothing is
+// written if there are any.
+func (s *Store[E]) Import(ctx context.Context, entries map[string]json.RawMessage, opts ImportOptions) ([]string, error) {
+	ids := make([]string, 0, len(entries))
+	objs := make(map[string]E, len(entries))
+	for id, data := range entries {
+		obj, err := s.decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %w", id, err)
+		}
+		if obj.GetID() != id {
+			return nil, fmt.Errorf("entry %q contains object with id %q", id, obj.GetID())
+		}
+
+		ids = append(ids, id)
+		objs[id] = obj
+	}
+	sort.Strings(ids)
+
+	ioCtx, err := s.openIOContext()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	existing, err := s.getValues(ioCtx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for existing entries: %w", err)
+	}
+
+	var conflicts []string
+	for _, id := range ids {
+		if _, ok := existing[id]; ok {
+			conflicts = append(conflicts, id)
+		}
+	}
+
+	if opts.DryRun {
+		return conflicts, nil
+	}
+	if len(conflicts) > 0 && !opts.Overwrite {
+		return conflicts, fmt.Errorf("%d entries %w", len(conflicts), store.ErrAlreadyExists)
+	}
+
+	for _, id := range ids {
+		if err := s.importEntry(ctx, ioCtx, objs[id], entries[id]); err != nil {
+			return conflicts, fmt.Errorf("failed to import entry %q: %w", id, err)
+		}
+	}
+
+	return conflicts, nil
+}
+
+func (s *Store[E]) importEntry(ctx context.Context, ioCtx *rados.IOContext, obj E, data json.RawMessage) error {
+	s.idMu.Lock(obj.GetID())
+	defer s.idMu.Unlock(obj.GetID())
+
+	keys := s.indexKeys(obj)
+
+	var (
+		existed   bool
+		staleKeys sets.Set[string]
+		replaced  []byte
+	)
+	if err := s.commit(ctx, ioCtx, obj.GetID(), func(op *rados.WriteOp, current E, found bool) error {
+		existed = found
+		if !found {
+			if err := s.addIndexKeys(ioCtx, keys, indexTag(obj)); err != nil {
+				return err
+			}
+			op.SetOmap(map[string][]byte{obj.GetID(): data})
+			return nil
+		}
+
+		// The exported resource version is usually older than the stored
+		// one, so watchers would drop the update as stale.
+		staleKeys, replaced = s.indexKeys(current).Difference(keys), indexTag(current)
+		obj.SetResourceVersion(current.GetResourceVersion() + 1)
+		if err := s.addIndexKeys(ioCtx, keys, indexTag(obj)); err != nil {
+			return err
+		}
+		return s.set(op, obj)
+	}); err != nil {
+		return err
+	}
+
+	if err := s.removeIndexKeys(ctx, ioCtx, staleKeys, replaced); err != nil {
+		return err
+	}
+
+	typ := store.WatchEventTypeCreated
+	if existed {
+		typ = store.WatchEventTypeUpdated
+	}
+	s.emit(ctx, store.WatchEvent[E]{
+		Type:   typ,
+		Object: obj,
+	})
+	return nil
+}
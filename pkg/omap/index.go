@@ -0,0 +1,408 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Index keys have the form <kind><sep><name><sep><value><sep><id>, with kind
+// being indexKindLabel or indexKindField. The separator can neither appear in
+// label keys and values nor in object ids.
+//
+// The index lives in other RADOS objects than the entries, so it cannot be
+// written atomically with them. Instead, it maintains the invariant that it
+// contains the keys of every stored object; it may contain more, which are
+// filtered out on lookup:
+//   - Keys are added before the object is written.
+//   - Each key carries the tag of the object version that added it last (see
+//     indexTag). Keys that became stale with a write are only removed if
+//     their tag is not newer than the replaced version, asserting the version
+//     of the index object. A key re-added by a concurrent writer of a newer
+//     version, possibly of another process, is kept that way.
+const (
+	indexSeparator = "\x1f"
+
+	indexKindLabel = "label"
+	indexKindField = "field"
+
+	// indexBuiltKey marks an index object as complete for the indexed fields
+	// stored as its value.
+	indexBuiltKey = "built"
+)
+
+// indexName returns the name of the head index object. It holds the index
+// entries of unsharded stores and the marker of the index state.
+func (s *Store[E]) indexName() string {
+	return s.omapName + ".index"
+}
+
+// indexObjectName returns the name of the object holding the index entries of
+// the object with the given id. The index of sharded stores is sharded the
+// same way as the entries, so no single object receives all index writes.
+func (s *Store[E]) indexObjectName(id string) string {
+	if s.shards == 0 {
+		return s.indexName()
+	}
+	return s.indexShardName(s.shardOf(id))
+}
+
+func (s *Store[E]) indexShardName(shard int) string {
+	return fmt.Sprintf("%s.index.shard-%d", s.omapName, shard)
+}
+
+// indexObjects returns the names of all objects holding index entries.
+func (s *Store[E]) indexObjects() []string {
+	if s.shards == 0 {
+		return []string{s.indexName()}
+	}
+
+	oids := make([]string, 0, s.shards)
+	for shard := 0; shard < s.shards; shard++ {
+		oids = append(oids, s.indexShardName(shard))
+	}
+	return oids
+}
+
+// groupIndexKeys groups keys by the object holding them.
+func (s *Store[E]) groupIndexKeys(keys sets.Set[string]) map[string][]string {
+	groups := make(map[string][]string)
+	for key := range keys {
+		oid := s.indexObjectName(key[strings.LastIndex(key, indexSeparator)+1:])
+		groups[oid] = append(groups[oid], key)
+	}
+	return groups
+}
+
+func indexPrefix(kind, name string) string {
+	return kind + indexSeparator + name + indexSeparator
+}
+
+func indexValuePrefix(kind, name, value string) string {
+	return indexPrefix(kind, name) + value + indexSeparator
+}
+
+// indexKeys returns the index keys of obj.
+func (s *Store[E]) indexKeys(obj E) sets.Set[string] {
+	keys := sets.New[string]()
+	for key, value := range obj.GetLabels() {
+		keys.Insert(indexValuePrefix(indexKindLabel, key, value) + obj.GetID())
+	}
+	for field, indexFunc := range s.indexers {
+		for _, value := range indexFunc(obj) {
+			keys.Insert(indexValuePrefix(indexKindField, field, value) + obj.GetID())
+		}
+	}
+	return keys
+}
+
+// indexTag returns the tag of the version of obj, ordered by creation time and
+// resource version, so a recreated object has newer tags than a deleted one.
+func indexTag(obj api.Object) []byte {
+	var createdAt int64
+	if t := obj.GetCreatedAt(); !t.IsZero() && t.UnixNano() > 0 {
+		createdAt = t.UnixNano()
+	}
+	return []byte(fmt.Sprintf("%020d.%020d", createdAt, obj.GetResourceVersion()))
+}
+
+// isIndexTag reports whether value is a tag. Keys of versions before tags were
+// introduced hold the id instead.
+func isIndexTag(value []byte) bool {
+	return len(value) == 41 && value[20] == '.'
+}
+
+// indexedFields returns the value of indexBuiltKey for the configured indexers
+// and number of shards.
+func (s *Store[E]) indexedFields() string {
+	fields := make([]string, 0, len(s.indexers))
+	for field := range s.indexers {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	value := strings.Join(fields, ",")
+	if s.shards > 0 {
+		value += ";shards=" + strconv.Itoa(s.shards)
+	}
+	return value
+}
+
+// addIndexKeys adds keys tagged with tag to the index. It has to be called
+// before the object is written, so the index always covers the stored objects.
+// Entries of objects that are not written in the end are filtered out on
+// lookup.
+func (s *Store[E]) addIndexKeys(ioCtx *rados.IOContext, keys sets.Set[string], tag []byte) error {
+	entries := make(map[string][]byte, keys.Len())
+	for key := range keys {
+		entries[key] = tag
+	}
+	return s.setIndexEntries(ioCtx, entries)
+}
+
+// setIndexEntries adds index keys with their tags to the index.
+func (s *Store[E]) setIndexEntries(ioCtx *rados.IOContext, entries map[string][]byte) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	keys := sets.KeySet(entries)
+	for oid, group := range s.groupIndexKeys(keys) {
+		pairs := make(map[string][]byte, len(group))
+		for _, key := range group {
+			pairs[key] = entries[key]
+		}
+
+		if err := ioCtx.SetOmap(oid, pairs); err != nil {
+			return fmt.Errorf("failed to add index keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeIndexKeys removes keys that became stale after the object was written
+// over the version with tag replaced. Keys re-added with a newer tag in the
+// meantime are kept.
+func (s *Store[E]) removeIndexKeys(ctx context.Context, ioCtx *rados.IOContext, keys sets.Set[string], replaced []byte) error {
+	if keys.Len() == 0 {
+		return nil
+	}
+
+	for oid, group := range s.groupIndexKeys(keys) {
+		if err := s.removeIndexGroup(ctx, ioCtx, oid, group, replaced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store[E]) removeIndexGroup(ctx context.Context, ioCtx *rados.IOContext, oid string, keys []string, replaced []byte) error {
+	backoff := commitBackoff
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		if attempt > 0 {
+			if err := waitBackoff(ctx, &backoff); err != nil {
+				return err
+			}
+		}
+
+		values, version, err := getOmapValuesByKeys(ioCtx, oid, keys)
+		if err != nil {
+			return fmt.Errorf("failed to read index keys: %w", err)
+		}
+
+		var stale []string
+		for key, value := range values {
+			if !isIndexTag(value) || bytes.Compare(value, replaced) <= 0 {
+				stale = append(stale, key)
+			}
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+
+		if err := s.tryCommit(ioCtx, oid, version, func(op *rados.WriteOp) error {
+			op.RmOmapKeys(stale)
+			return nil
+		}); err != nil {
+			if errors.Is(err, errOmapChanged) {
+				continue
+			}
+			return fmt.Errorf("failed to remove index keys: %w", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("index keys could not be removed after %d attempts: %w", maxCommitAttempts, ErrContended)
+}
+
+// ensureIndex (re)builds the index from the stored objects, if it was not built
+// for the configured indexers yet, e.g. because the store was written by a
+// version without indexes.
+func (s *Store[E]) ensureIndex(ioCtx *rados.IOContext) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	if s.indexBuilt {
+		return nil
+	}
+
+	fields := s.indexedFields()
+	built, _, err := getOmapValuesByKeys(ioCtx, s.indexName(), []string{indexBuiltKey})
+	if err != nil {
+		return fmt.Errorf("failed to get index state: %w", err)
+	}
+	if value, ok := built[indexBuiltKey]; ok && string(value) == fields {
+		s.indexBuilt = true
+		return nil
+	}
+
+	if s.shards > 0 {
+		// Drop the entries of the head index object, which were written
+		// before the store was sharded.
+		if err := ioCtx.Delete(s.indexName()); err != nil && !errors.Is(err, rados.ErrNotFound) {
+			return fmt.Errorf("failed to remove unsharded index: %w", err)
+		}
+	}
+
+	objs, err := s.list(ioCtx)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string][]byte)
+	for _, obj := range objs {
+		tag := indexTag(obj)
+		for key := range s.indexKeys(obj) {
+			entries[key] = tag
+		}
+	}
+	if err := s.setIndexEntries(ioCtx, entries); err != nil {
+		return err
+	}
+
+	if err := ioCtx.SetOmap(s.indexName(), map[string][]byte{indexBuiltKey: []byte(fields)}); err != nil {
+		return fmt.Errorf("failed to mark index as built: %w", err)
+	}
+
+	s.indexBuilt = true
+	return nil
+}
+
+// lookupIndex returns the ids of the objects that may match o. If o contains no
+// requirement that can be answered by the index, ok is false and all objects
+// have to be considered.
+func (s *Store[E]) lookupIndex(ioCtx *rados.IOContext, o *store.ListOptions) (ids sets.Set[string], ok bool, err error) {
+	intersect := func(candidates sets.Set[string]) {
+		if !ok {
+			ids, ok = candidates, true
+			return
+		}
+		ids = ids.Intersection(candidates)
+	}
+
+	if o.LabelSelector != nil {
+		requirements, _ := o.LabelSelector.Requirements()
+		for _, requirement := range requirements {
+			var prefixes []string
+			switch requirement.Operator() {
+			case selection.Equals, selection.DoubleEquals, selection.In:
+				for value := range requirement.Values() {
+					prefixes = append(prefixes, indexValuePrefix(indexKindLabel, requirement.Key(), value))
+				}
+			case selection.Exists:
+				prefixes = append(prefixes, indexPrefix(indexKindLabel, requirement.Key()))
+			default:
+				continue
+			}
+
+			candidates, err := s.lookupIndexPrefixes(ioCtx, prefixes)
+			if err != nil {
+				return nil, false, err
+			}
+			intersect(candidates)
+		}
+	}
+
+	for field, value := range o.FieldSelector {
+		candidates, err := s.lookupIndexPrefixes(ioCtx, []string{indexValuePrefix(indexKindField, field, value)})
+		if err != nil {
+			return nil, false, err
+		}
+		intersect(candidates)
+	}
+
+	return ids, ok, nil
+}
+
+func (s *Store[E]) lookupIndexPrefixes(ioCtx *rados.IOContext, prefixes []string) (sets.Set[string], error) {
+	ids := sets.New[string]()
+	for _, oid := range s.indexObjects() {
+		for _, prefix := range prefixes {
+			entries, err := ioCtx.GetAllOmapValues(oid, "", prefix, 100)
+			if err != nil {
+				if errors.Is(err, rados.ErrNotFound) {
+					continue
+				}
+				return nil, fmt.Errorf("failed to read index: %w", err)
+			}
+
+			for key := range entries {
+				ids.Insert(key[strings.LastIndex(key, indexSeparator)+1:])
+			}
+		}
+	}
+	return ids, nil
+}
+
+// getMany returns the stored objects with the given ids ordered by id, skipping
+// missing ones.
+func (s *Store[E]) getMany(ioCtx *rados.IOContext, ids []string) ([]E, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	omap, err := s.getValues(ioCtx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch omap values: %w", err)
+	}
+
+	return s.unmarshalAll(omap)
+}
+
+// getOmapValuesByKeys returns the values of the given keys of an omap object
+// and the version of the object they were read at. A missing omap object is
+// treated like an empty one with version 0.
+func getOmapValuesByKeys(ioCtx *rados.IOContext, oid string, keys []string) (map[string][]byte, uint64, error) {
+	op := rados.CreateReadOp()
+	defer op.Release()
+
+	step := op.GetOmapValuesByKeys(keys)
+	if err := op.Operate(ioCtx, oid, rados.OperationNoFlag); err != nil {
+		if operationErrorCode(err) == -int(syscall.ENOENT) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	version, err := ioCtx.GetLastVersion()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get omap version: %w", err)
+	}
+
+	values := make(map[string][]byte, len(keys))
+	for {
+		kv, err := step.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if kv == nil {
+			return values, version, nil
+		}
+		values[kv.Key] = kv.Value
+	}
+}
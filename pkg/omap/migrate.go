@@ -0,0 +1,128 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
+)
+
+// Migrate rewrites all objects written with an older schema version with the
+// latest one, as well as objects with plaintext sensitive fields, and returns
+// the ids of the migrated objects. If dryRun is set,
+// the objects are only reported. Migrate is meant to be run while no other
+// process writes to the store, as migrated objects are not announced to
+// watches.
+func (s *Store[E]) Migrate(ctx context.Context, dryRun bool) ([]string, error) {
+	if s.schema == nil && len(s.sensitiveFields) == 0 {
+		return nil, fmt.Errorf("store %q has neither schema nor sensitive fields", s.omapName)
+	}
+
+	log := logr.FromContextOrDiscard(ctx).WithValues("omap", s.omapName)
+
+	ioCtx, err := s.openIOContext()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	var migrated []string
+	for _, oid := range s.dataObjects() {
+		var startAfter string
+		for {
+			omap, err := ioCtx.GetOmapValues(oid, startAfter, "", listBatchSize)
+			if err != nil {
+				if errors.Is(err, rados.ErrNotFound) {
+					break
+				}
+				return migrated, fmt.Errorf("failed to read omap: %w", err)
+			}
+
+			ids := make([]string, 0, len(omap))
+			for id := range omap {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+
+			for _, id := range ids {
+				needsMigration, err := s.needsMigration(omap[id])
+				if err != nil {
+					return migrated, fmt.Errorf("failed to check object %q: %w", id, err)
+				}
+				if !needsMigration {
+					continue
+				}
+
+				if !dryRun {
+					log.V(1).Info("Migrating object", "id", id)
+					if err := s.migrate(ctx, ioCtx, id); err != nil {
+						return migrated, fmt.Errorf("failed to migrate object %q: %w", id, err)
+					}
+				}
+				migrated = append(migrated, id)
+			}
+
+			if len(omap) < listBatchSize {
+				break
+			}
+			startAfter = ids[len(ids)-1]
+		}
+	}
+
+	if len(migrated) > 0 && !dryRun {
+		// Converters may have changed labels or indexed fields, so the index
+		// is rebuilt on its next use.
+		if err := ioCtx.RmOmapKeys(s.indexName(), []string{indexBuiltKey}); err != nil && !errors.Is(err, rados.ErrNotFound) {
+			return migrated, fmt.Errorf("failed to invalidate index: %w", err)
+		}
+
+		s.indexMu.Lock()
+		s.indexBuilt = false
+		s.indexMu.Unlock()
+	}
+
+	return migrated, nil
+}
+
+func (s *Store[E]) needsMigration(data []byte) (bool, error) {
+	if s.schema != nil {
+		needsConversion, err := s.schema.NeedsConversion(data)
+		if err != nil || needsConversion {
+			return needsConversion, err
+		}
+	}
+
+	return s.needsSealing(data)
+}
+
+func (s *Store[E]) migrate(ctx context.Context, ioCtx *rados.IOContext, id string) error {
+	s.idMu.Lock(id)
+	defer s.idMu.Unlock(id)
+
+	return s.commit(ctx, ioCtx, id, func(op *rados.WriteOp, current E, found bool) error {
+		if !found {
+			return nil
+		}
+
+		// current was converted on read, so writing it back persists it
+		// with the latest schema version and sealed sensitive fields.
+		return s.set(op, current)
+	})
+}
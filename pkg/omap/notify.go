@@ -0,0 +1,337 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/store"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// maxPendingNotifications bounds the notifications queued while watchers of
+// other processes are slow to acknowledge. Beyond it, the queued
+// notifications are replaced by a single overflow notification.
+const maxPendingNotifications = 1000
+
+// notification is sent on the omap object after every mutation, so stores of
+// other processes watching the same omap object can forward it to their watches.
+// An overflow notification tells them that notifications were dropped, so
+// their watches have to relist.
+type notification struct {
+	Source   string               `json:"source"`
+	Type     store.WatchEventType `json:"type,omitempty"`
+	Object   json.RawMessage      `json:"object,omitempty"`
+	Overflow bool                 `json:"overflow,omitempty"`
+}
+
+// emit delivers evt to the watches of this store and queues a notification
+// for the watches of all other stores on the same omap object. The mutation
+// has already been persisted at this point, so a failing notification is
+// only logged.
+func (s *Store[E]) emit(ctx context.Context, evt store.WatchEvent[E]) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("omap", s.omapName, "id", evt.Object.GetID())
+
+	object, err := json.Marshal(evt.Object)
+	if err != nil {
+		log.Error(err, "failed to marshal object")
+		return
+	}
+
+	// Watches get their own copy, so they never observe changes callers make
+	// to their objects afterwards.
+	obj := s.newFunc()
+	if err := json.Unmarshal(object, obj); err != nil {
+		log.Error(err, "failed to unmarshal object")
+		return
+	}
+	s.enqueue(store.WatchEvent[E]{
+		Type:   evt.Type,
+		Object: obj,
+	})
+
+	// Other processes receive the object the same way it is stored.
+	if object, err = s.seal(object); err != nil {
+		log.Error(err, "failed to seal object")
+		return
+	}
+	data, err := json.Marshal(notification{
+		Source: s.instanceID,
+		Type:   evt.Type,
+		Object: object,
+	})
+	if err != nil {
+		log.Error(err, "failed to marshal notification")
+		return
+	}
+	s.notifier.queue(pendingNotification{log: log, data: data})
+}
+
+type pendingNotification struct {
+	log  logr.Logger
+	data []byte
+}
+
+// notifier sends notifications in order from its own goroutine, so writers
+// never wait for the watchers of other processes to acknowledge them while
+// holding the lock of an object. A watcher of a dead process may take until
+// its watch expires to time out.
+type notifier struct {
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	// overflow is the notification replacing dropped ones.
+	overflow []byte
+
+	mu      sync.Mutex
+	pending []pendingNotification
+	stopped bool
+}
+
+func (s *Store[E]) startNotifier() {
+	s.notifier.wake = make(chan struct{}, 1)
+	s.notifier.stop = make(chan struct{})
+	s.notifier.done = make(chan struct{})
+	s.notifier.overflow, _ = json.Marshal(notification{
+		Source:   s.instanceID,
+		Overflow: true,
+	})
+	go s.runNotifier()
+}
+
+// stopNotifier stops the notifier once the notification being sent is done.
+// Notifications still pending are replaced by an overflow notification.
+func (s *Store[E]) stopNotifier() {
+	s.notifier.mu.Lock()
+	stopped := s.notifier.stopped
+	s.notifier.stopped = true
+	s.notifier.mu.Unlock()
+
+	if !stopped {
+		close(s.notifier.stop)
+	}
+	<-s.notifier.done
+}
+
+func (n *notifier) queue(p pendingNotification) {
+	n.mu.Lock()
+	switch {
+	case n.stopped:
+	case len(n.pending) >= maxPendingNotifications:
+		p.log.Info("Dropping notifications, watchers of other processes are too slow", "Pending", len(n.pending))
+		n.pending = []pendingNotification{{log: p.log, data: n.overflow}}
+	default:
+		n.pending = append(n.pending, p)
+	}
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) take() []pendingNotification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	pending := n.pending
+	n.pending = nil
+	return pending
+}
+
+func (s *Store[E]) runNotifier() {
+	var ioCtx *rados.IOContext
+	defer func() {
+		if ioCtx != nil {
+			ioCtx.Destroy()
+		}
+		close(s.notifier.done)
+	}()
+
+	send := func(p pendingNotification) {
+		if ioCtx == nil {
+			var err error
+			if ioCtx, err = s.conn.OpenIOContext(s.pool); err != nil {
+				p.log.Error(err, "failed to notify watchers, unable to get io context")
+				return
+			}
+		}
+
+		if err := s.notify(ioCtx, p.data); err != nil {
+			p.log.Error(err, "failed to notify watchers")
+		}
+	}
+
+	for {
+		var stopping bool
+		select {
+		case <-s.notifier.stop:
+			stopping = true
+		case <-s.notifier.wake:
+		}
+
+		for _, p := range s.notifier.take() {
+			select {
+			case <-s.notifier.stop:
+				stopping = true
+			default:
+			}
+
+			if stopping {
+				// Watchers relist instead of waiting for the remaining
+				// notifications.
+				send(pendingNotification{log: p.log, data: s.notifier.overflow})
+				return
+			}
+			send(p)
+		}
+
+		if stopping {
+			return
+		}
+	}
+}
+
+func (s *Store[E]) notify(ioCtx *rados.IOContext, data []byte) error {
+	_, timeouts, err := ioCtx.NotifyWithTimeout(s.omapName, data, s.notifyTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+	if len(timeouts) > 0 {
+		return fmt.Errorf("%d watchers did not acknowledge the notification in time", len(timeouts))
+	}
+
+	return nil
+}
+
+// startRadosWatch registers a RADOS watch on the omap object and forwards
+// notifications of other processes to the watches of this store until the
+// returned function is called.
+func (s *Store[E]) startRadosWatch(log logr.Logger) (context.CancelFunc, error) {
+	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get io context: %w", err)
+	}
+
+	watcher, err := s.watchOmap(ioCtx)
+	if err != nil {
+		ioCtx.Destroy()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.runRadosWatch(ctx, log.WithValues("omap", s.omapName), ioCtx, watcher)
+
+	return cancel, nil
+}
+
+func (s *Store[E]) watchOmap(ioCtx *rados.IOContext) (*rados.Watcher, error) {
+	// A watch requires the omap object to exist, which is not the case for a
+	// store nothing has been written to yet.
+	if err := ioCtx.Create(s.omapName, rados.CreateIdempotent); err != nil {
+		return nil, fmt.Errorf("failed to create omap object: %w", err)
+	}
+
+	watcher, err := ioCtx.Watch(s.omapName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch omap object: %w", err)
+	}
+
+	return watcher, nil
+}
+
+func (s *Store[E]) runRadosWatch(ctx context.Context, log logr.Logger, ioCtx *rados.IOContext, watcher *rados.Watcher) {
+	defer func() {
+		if watcher != nil {
+			if err := watcher.Delete(); err != nil {
+				log.Error(err, "failed to delete rados watch")
+			}
+		}
+		ioCtx.Destroy()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt := <-watcher.Events():
+			if err := evt.Ack(nil); err != nil {
+				log.Error(err, "failed to acknowledge notification")
+			}
+
+			if err := s.handleNotification(evt.Data); err != nil {
+				log.Error(err, "failed to handle notification")
+			}
+		case err := <-watcher.Errors():
+			log.Error(err, "rados watch failed, re-establishing")
+			if err := watcher.Delete(); err != nil {
+				log.Error(err, "failed to delete rados watch")
+			}
+			watcher = nil
+
+			_ = wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+				w, err := s.watchOmap(ioCtx)
+				if err != nil {
+					log.Error(err, "failed to re-establish rados watch")
+					return false, nil
+				}
+				watcher = w
+				return true, nil
+			})
+			if watcher == nil {
+				return
+			}
+
+			// Notifications sent while the watch was down are lost, so
+			// consumers have to relist.
+			s.signalOverflow()
+		}
+	}
+}
+
+func (s *Store[E]) handleNotification(data []byte) error {
+	var n notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("failed to unmarshal notification: %w", err)
+	}
+
+	if n.Source == s.instanceID {
+		return nil
+	}
+
+	if n.Overflow {
+		s.signalOverflow()
+		return nil
+	}
+
+	obj, err := s.decode(n.Object)
+	if err != nil {
+		return err
+	}
+
+	s.enqueue(store.WatchEvent[E]{
+		Type:   n.Type,
+		Object: obj,
+	})
+	return nil
+}
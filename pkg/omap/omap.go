@@ -19,25 +19,89 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
 	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/encryption"
+	"github.com/onmetal/cephlet/pkg/schema"
 	"github.com/onmetal/cephlet/pkg/store"
 	utilssync "github.com/onmetal/cephlet/pkg/sync"
 	"github.com/onmetal/cephlet/pkg/utils"
+	"github.com/onmetal/onmetal-api/broker/common/idgen"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
-type CreateStrategy[E api.Object] interface {
-	PrepareForCreate(obj E)
+// maxCommitAttempts bounds how often a write is retried because unrelated keys
+// of the same omap object were modified concurrently.
+const maxCommitAttempts = 10
+
+// commitBackoff spaces the attempts of a write. The jitter keeps writers that
+// failed on the same concurrent modification from colliding again.
+var commitBackoff = wait.Backoff{
+	Duration: 5 * time.Millisecond,
+	Factor:   2,
+	Jitter:   1,
+	Steps:    maxCommitAttempts,
+	Cap:      500 * time.Millisecond,
 }
 
+// ErrContended is returned if a write could not be committed within
+// maxCommitAttempts because other entries of the same omap object were
+// modified concurrently. Unlike store.ErrConflict, the object itself did not
+// change, so there is nothing to re-read; the write should be retried later.
+var ErrContended = errors.New("omap object contended")
+
+// listBatchSize is the number of omap entries read at once when listing.
+const listBatchSize = 100
+
 type Options[E api.Object] struct {
 	OmapName       string
 	NewFunc        func() E
-	CreateStrategy CreateStrategy[E]
+	CreateStrategy store.CreateStrategy[E]
+	UpdateStrategy store.UpdateStrategy[E]
+
+	// Shards is the number of objects the omap entries are spread over by a
+	// hash of their id. With zero shards, all entries are kept in the omap of
+	// the object named OmapName. All processes using a store have to be
+	// configured with the same number of shards. See Reshard for switching an
+	// existing store to shards.
+	Shards int
+
+	// Schema converts objects written with an older schema version on read.
+	// Objects are always written with its latest version.
+	Schema *schema.Registry
+
+	// Indexers are the fields that can be used in field selectors. Labels are
+	// always indexed.
+	Indexers store.Indexers[E]
+
+	// SensitiveFields are the dot separated JSON paths of string fields that
+	// are sealed with Encryptor before being written.
+	SensitiveFields []string
+	Encryptor       encryption.Encryptor
+
+	// NotifyTimeout is how long a mutation waits for watchers of other
+	// processes to acknowledge its notification.
+	NotifyTimeout time.Duration
+
+	// WatchQueueSize is the number of events buffered per watch before the
+	// watch overflows.
+	WatchQueueSize int
+}
+
+func setOptionsDefaults[E api.Object](o *Options[E]) {
+	if o.NotifyTimeout == 0 {
+		o.NotifyTimeout = 5 * time.Second
+	}
+	if o.WatchQueueSize == 0 {
+		o.WatchQueueSize = store.DefaultWatchQueueSize
+	}
 }
 
 func New[E api.Object](conn *rados.Conn, pool string, opts Options[E]) (*Store[E], error) {
@@ -57,18 +121,41 @@ func New[E api.Object](conn *rados.Conn, pool string, opts Options[E]) (*Store[E
 		return nil, fmt.Errorf("must specify opts.NewFunc")
 	}
 
-	return &Store[E]{
+	if opts.Shards < 0 {
+		return nil, fmt.Errorf("opts.Shards must not be negative")
+	}
+
+	if len(opts.SensitiveFields) > 0 && opts.Encryptor == nil {
+		return nil, fmt.Errorf("must specify opts.Encryptor to seal sensitive fields")
+	}
+
+	setOptionsDefaults(&opts)
+
+	s := &Store[E]{
 		idMu: utilssync.NewMutexMap[string](),
 
 		conn:     conn,
 		pool:     pool,
 		omapName: opts.OmapName,
+		shards:   opts.Shards,
 
-		watches: sets.New[*watch[E]](),
+		instanceID:    idgen.Default.Generate(),
+		notifyTimeout: opts.NotifyTimeout,
+
+		watches:        sets.New[*watch[E]](),
+		watchQueueSize: opts.WatchQueueSize,
 
 		newFunc:        opts.NewFunc,
 		createStrategy: opts.CreateStrategy,
-	}, nil
+		updateStrategy: opts.UpdateStrategy,
+		indexers:       opts.Indexers,
+		schema:         opts.Schema,
+
+		sensitiveFields: opts.SensitiveFields,
+		encryptor:       opts.Encryptor,
+	}
+	s.startNotifier()
+	return s, nil
 }
 
 type Store[E api.Object] struct {
@@ -77,18 +164,64 @@ type Store[E api.Object] struct {
 	conn     *rados.Conn
 	pool     string
 	omapName string
+	shards   int
+
+	layoutMu      sync.Mutex
+	layoutChecked bool
 
 	newFunc        func() E
-	createStrategy CreateStrategy[E]
+	createStrategy store.CreateStrategy[E]
+	updateStrategy store.UpdateStrategy[E]
+	schema         *schema.Registry
+
+	sensitiveFields []string
+	encryptor       encryption.Encryptor
+
+	indexers   store.Indexers[E]
+	indexMu    sync.Mutex
+	indexBuilt bool
+
+	instanceID    string
+	notifyTimeout time.Duration
+	notifier      notifier
+
+	watchesMu      sync.RWMutex
+	watches        sets.Set[*watch[E]]
+	watchQueueSize int
+	stopRadosWatch context.CancelFunc
+}
+
+// Close stops sending notifications to the watchers of other processes and
+// releases the resources of the store. The store must not be used afterwards.
+func (s *Store[E]) Close() {
+	s.stopNotifier()
 
-	watchesMu sync.RWMutex
-	watches   sets.Set[*watch[E]]
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+	if s.stopRadosWatch != nil {
+		s.stopRadosWatch()
+		s.stopRadosWatch = nil
+	}
 }
 
 func (s *Store[E]) enqueue(evt store.WatchEvent[E]) {
 	for _, handler := range s.watchHandlers() {
 		select {
 		case handler.events <- evt:
+		default:
+			select {
+			case handler.overflow <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// signalOverflow signals all watches that they missed events.
+func (s *Store[E]) signalOverflow() {
+	for _, handler := range s.watchHandlers() {
+		select {
+		case handler.overflow <- struct{}{}:
 		default:
 		}
 	}
@@ -101,69 +234,37 @@ func (s *Store[E]) watchHandlers() []*watch[E] {
 	return s.watches.UnsortedList()
 }
 
-func (s *Store[E]) getSingleOmapValue(ioCtx *rados.IOContext, omapName, key string) ([]byte, error) {
-	omap, err := ioCtx.GetAllOmapValues(omapName, "", key, 10)
-	if err != nil {
-		return nil, err
-	}
-
-	value, ok := omap[key]
-	if !ok {
-		return nil, rados.ErrNotFound
-	}
-
-	return value, nil
-}
-
-func (s *Store[E]) deleteOmapValue(ioCtx *rados.IOContext, omapName, key string) error {
-	if err := ioCtx.RmOmapKeys(omapName, []string{key}); err != nil {
-		return fmt.Errorf("unable to delete mapping omap value: %w", err)
-	}
-
-	return nil
-}
-
-func (s *Store[E]) setOmapValue(ioCtx *rados.IOContext, omapName, key string, value []byte) error {
-	if err := ioCtx.SetOmap(omapName, map[string][]byte{
-		key: value,
-	}); err != nil {
-		return fmt.Errorf("unable to set omap values: %w", err)
-	}
-
-	return nil
-}
-
 func (s *Store[E]) Create(ctx context.Context, obj E) (E, error) {
 	s.idMu.Lock(obj.GetID())
 	defer s.idMu.Unlock(obj.GetID())
 
-	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	ioCtx, err := s.openIOContext()
 	if err != nil {
 		return utils.Zero[E](), fmt.Errorf("unable to get io context: %w", err)
 	}
 	defer ioCtx.Destroy()
 
-	_, err = s.get(ioCtx, obj.GetID())
-	switch {
-	case err == nil:
-		return utils.Zero[E](), fmt.Errorf("object with id %q %w", obj.GetID(), store.ErrAlreadyExists)
-	case errors.Is(err, store.ErrNotFound):
-	default:
-		return utils.Zero[E](), fmt.Errorf("failed to get object with id %q %w", obj.GetID(), err)
-	}
-
 	if s.createStrategy != nil {
 		s.createStrategy.PrepareForCreate(obj)
 	}
 
 	obj.SetCreatedAt(time.Now())
+	obj.SetResourceVersion(1)
 
-	obj, err = s.set(ioCtx, obj)
-	if err != nil {
+	if err := s.addIndexKeys(ioCtx, s.indexKeys(obj), indexTag(obj)); err != nil {
+		return utils.Zero[E](), err
+	}
+
+	if err := s.commit(ctx, ioCtx, obj.GetID(), func(op *rados.WriteOp, _ E, found bool) error {
+		if found {
+			return fmt.Errorf("object with id %q %w", obj.GetID(), store.ErrAlreadyExists)
+		}
+		return s.set(op, obj)
+	}); err != nil {
 		return utils.Zero[E](), err
 	}
 
-	s.enqueue(store.WatchEvent[E]{
+	s.emit(ctx, store.WatchEvent[E]{
 		Type:   store.WatchEventTypeCreated,
 		Object: obj,
 	})
@@ -175,83 +276,138 @@ func (s *Store[E]) Delete(ctx context.Context, id string) error {
 	s.idMu.Lock(id)
 	defer s.idMu.Unlock(id)
 
-	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	ioCtx, err := s.openIOContext()
 	if err != nil {
 		return fmt.Errorf("unable to get io context: %w", err)
 	}
 	defer ioCtx.Destroy()
 
-	obj, err := s.get(ioCtx, id)
-	if err != nil {
-		return err
-	}
+	var (
+		deleted   E
+		staleKeys sets.Set[string]
+		replaced  []byte
+	)
+	if err := s.commit(ctx, ioCtx, id, func(op *rados.WriteOp, current E, found bool) error {
+		if !found {
+			return fmt.Errorf("object with id %q %w", id, store.ErrNotFound)
+		}
 
-	if len(obj.GetFinalizers()) == 0 {
-		return s.delete(ioCtx, id)
-	}
+		deleted = current
+		if len(current.GetFinalizers()) == 0 {
+			staleKeys, replaced = s.indexKeys(current), indexTag(current)
+			op.RmOmapKeys([]string{id})
+			return nil
+		}
 
-	now := time.Now()
-	obj.SetDeletedAt(&now)
+		now := time.Now()
+		current.SetDeletedAt(&now)
+		current.SetResourceVersion(current.GetResourceVersion() + 1)
+		return s.set(op, current)
+	}); err != nil {
+		return err
+	}
 
-	if _, err := s.set(ioCtx, obj); err != nil {
-		return fmt.Errorf("failed to set object metadata: %w", err)
+	if err := s.removeIndexKeys(ctx, ioCtx, staleKeys, replaced); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "failed to clean up index", "omap", s.omapName, "id", id)
 	}
 
-	s.enqueue(store.WatchEvent[E]{
+	s.emit(ctx, store.WatchEvent[E]{
 		Type:   store.WatchEventTypeDeleted,
-		Object: obj,
+		Object: deleted,
 	})
 
 	return nil
 }
 
-func (s *Store[E]) delete(ioCtx *rados.IOContext, id string) error {
-	if err := s.deleteOmapValue(ioCtx, s.omapName, id); err != nil {
-		return fmt.Errorf("failed to delete object from omap: %w", err)
-	}
-	return nil
-}
-
 func (s *Store[E]) Get(ctx context.Context, id string) (E, error) {
-	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	ioCtx, err := s.openIOContext()
 	if err != nil {
 		return utils.Zero[E](), fmt.Errorf("unable to get io context: %w", err)
 	}
 	defer ioCtx.Destroy()
 
-	return s.get(ioCtx, id)
+	obj, found, err := s.lookup(ioCtx, id)
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+	if !found {
+		return utils.Zero[E](), fmt.Errorf("object with id %q %w", id, store.ErrNotFound)
+	}
+
+	return obj, nil
 }
 
+// Update writes obj if its resource version still matches the stored one and
+// returns store.ErrConflict otherwise. On success, the resource version of obj
+// is advanced in place, so obj can be used for subsequent updates.
 func (s *Store[E]) Update(ctx context.Context, obj E) (E, error) {
 	s.idMu.Lock(obj.GetID())
 	defer s.idMu.Unlock(obj.GetID())
 
-	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	ioCtx, err := s.openIOContext()
 	if err != nil {
 		return utils.Zero[E](), fmt.Errorf("unable to get io context: %w", err)
 	}
 	defer ioCtx.Destroy()
 
-	_, err = s.get(ioCtx, obj.GetID())
-	if err != nil {
-		return utils.Zero[E](), err
+	resourceVersion := obj.GetResourceVersion()
+	generation := obj.GetGeneration()
+	shouldDelete := obj.GetDeletedAt() != nil && len(obj.GetFinalizers()) == 0
+
+	keys := sets.New[string]()
+	if !shouldDelete {
+		keys = s.indexKeys(obj)
 	}
 
-	if obj.GetDeletedAt() != nil && len(obj.GetFinalizers()) == 0 {
-		if err := s.delete(ioCtx, obj.GetID()); err != nil {
-			return utils.Zero[E](), fmt.Errorf("failed to delete object metadata: %w", err)
+	var (
+		staleKeys sets.Set[string]
+		replaced  []byte
+	)
+	if err := s.commit(ctx, ioCtx, obj.GetID(), func(op *rados.WriteOp, current E, found bool) error {
+		if !found {
+			return fmt.Errorf("object with id %q %w", obj.GetID(), store.ErrNotFound)
 		}
-		return obj, nil
-	}
 
-	//Todo: update version
-	obj, err = s.set(ioCtx, obj)
-	if err != nil {
+		if current.GetResourceVersion() != resourceVersion {
+			return fmt.Errorf("object with id %q has resource version %d, expected %d: %w",
+				obj.GetID(), current.GetResourceVersion(), resourceVersion, store.ErrConflict)
+		}
+
+		staleKeys, replaced = s.indexKeys(current).Difference(keys), indexTag(current)
+
+		if shouldDelete {
+			op.RmOmapKeys([]string{obj.GetID()})
+			return nil
+		}
+
+		if s.updateStrategy != nil {
+			obj.SetGeneration(generation)
+			s.updateStrategy.PrepareForUpdate(obj, current)
+		}
+
+		// The creation time is immutable, as the index tags rely on it.
+		obj.SetCreatedAt(current.GetCreatedAt())
+		obj.SetResourceVersion(resourceVersion + 1)
+		if err := s.addIndexKeys(ioCtx, keys, indexTag(obj)); err != nil {
+			return err
+		}
+		return s.set(op, obj)
+	}); err != nil {
+		obj.SetResourceVersion(resourceVersion)
+		obj.SetGeneration(generation)
 		return utils.Zero[E](), err
 	}
 
-	s.enqueue(store.WatchEvent[E]{
-		Type:   store.WatchEventTypeUpdated,
+	if err := s.removeIndexKeys(ctx, ioCtx, staleKeys, replaced); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "failed to clean up index", "omap", s.omapName, "id", obj.GetID())
+	}
+
+	eventType := store.WatchEventTypeUpdated
+	if shouldDelete {
+		eventType = store.WatchEventTypeDeleted
+	}
+	s.emit(ctx, store.WatchEvent[E]{
+		Type:   eventType,
 		Object: obj,
 	})
 
@@ -261,7 +417,8 @@ func (s *Store[E]) Update(ctx context.Context, obj E) (E, error) {
 type watch[E api.Object] struct {
 	store *Store[E]
 
-	events chan store.WatchEvent[E]
+	events   chan store.WatchEvent[E]
+	overflow chan struct{}
 }
 
 func (w *watch[E]) Stop() {
@@ -269,19 +426,36 @@ func (w *watch[E]) Stop() {
 	defer w.store.watchesMu.Unlock()
 
 	w.store.watches.Delete(w)
+	if w.store.watches.Len() == 0 && w.store.stopRadosWatch != nil {
+		w.store.stopRadosWatch()
+		w.store.stopRadosWatch = nil
+	}
 }
 
 func (w *watch[E]) Events() <-chan store.WatchEvent[E] {
 	return w.events
 }
 
+func (w *watch[E]) Overflow() <-chan struct{} {
+	return w.overflow
+}
+
 func (s *Store[E]) Watch(ctx context.Context) (store.Watch[E], error) {
 	s.watchesMu.Lock()
 	defer s.watchesMu.Unlock()
 
+	if s.stopRadosWatch == nil {
+		stop, err := s.startRadosWatch(logr.FromContextOrDiscard(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch omap object: %w", err)
+		}
+		s.stopRadosWatch = stop
+	}
+
 	w := &watch[E]{
-		store:  s,
-		events: make(chan store.WatchEvent[E]),
+		store:    s,
+		events:   make(chan store.WatchEvent[E], s.watchQueueSize),
+		overflow: make(chan struct{}, 1),
 	}
 
 	s.watches.Insert(w)
@@ -289,26 +463,209 @@ func (s *Store[E]) Watch(ctx context.Context) (store.Watch[E], error) {
 	return w, nil
 }
 
-func (s *Store[E]) List(ctx context.Context) ([]E, error) {
-	ioCtx, err := s.conn.OpenIOContext(s.pool)
+// List returns all stored objects matching opts. See ListPage.
+func (s *Store[E]) List(ctx context.Context, opts ...store.ListOption) ([]E, error) {
+	o := store.ApplyListOptions(opts)
+	o.Limit, o.Continue = 0, ""
+
+	objs, _, err := s.listPage(o)
+	return objs, err
+}
+
+// ListPage returns a page of the stored objects matching opts. Label and field
+// selectors are resolved through the index omap, falling back to reading all
+// objects if no requirement of the selectors can be answered by it. Pages are
+// read in batches starting after the last id of the previous page, so only the
+// objects of the page have to be held in memory.
+func (s *Store[E]) ListPage(ctx context.Context, opts ...store.ListOption) ([]E, string, error) {
+	return s.listPage(store.ApplyListOptions(opts))
+}
+
+func (s *Store[E]) listPage(o *store.ListOptions) ([]E, string, error) {
+	if err := store.ValidateListOptions(o, s.indexers); err != nil {
+		return nil, "", err
+	}
+
+	var startAfter string
+	if o.Continue != "" {
+		var err error
+		if startAfter, err = store.DecodeContinueToken(o.Continue); err != nil {
+			return nil, "", err
+		}
+	}
+
+	ioCtx, err := s.openIOContext()
 	if err != nil {
-		return nil, fmt.Errorf("unable to get io context: %w", err)
+		return nil, "", fmt.Errorf("unable to get io context: %w", err)
 	}
 	defer ioCtx.Destroy()
 
-	omap, err := ioCtx.GetAllOmapValues(s.omapName, "", "", 10)
+	fetch := s.fetchBatch
+	if o.LabelSelector != nil || len(o.FieldSelector) > 0 {
+		if err := s.ensureIndex(ioCtx); err != nil {
+			return nil, "", err
+		}
+
+		ids, ok, err := s.lookupIndex(ioCtx, o)
+		if err != nil {
+			return nil, "", err
+		}
+		if ok {
+			fetch = s.fetchIndexedBatch(sets.List(ids))
+		}
+	}
+
+	var res []E
+	for {
+		max := int64(listBatchSize)
+		if o.Limit > 0 {
+			max = o.Limit - int64(len(res))
+		}
+
+		objs, more, err := fetch(ioCtx, startAfter, max)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for i, obj := range objs {
+			startAfter = obj.GetID()
+			if !store.Matches(obj, o, s.indexers) {
+				continue
+			}
+
+			res = append(res, obj)
+			if o.Limit > 0 && int64(len(res)) == o.Limit {
+				if i < len(objs)-1 || more {
+					return res, store.EncodeContinueToken(startAfter), nil
+				}
+				return res, "", nil
+			}
+		}
+
+		if !more {
+			return res, "", nil
+		}
+	}
+}
+
+// fetchBatch returns up to max objects following startAfter, ordered by id,
+// and whether there may be more. The objects are merged from all objects
+// holding entries of the store.
+func (s *Store[E]) fetchBatch(ioCtx *rados.IOContext, startAfter string, max int64) ([]E, bool, error) {
+	values, more, err := s.fetchRawBatch(ioCtx, startAfter, max)
+	if err != nil {
+		return nil, false, err
+	}
+
+	objs, err := s.unmarshalAll(values)
 	if err != nil {
-		if errors.Is(err, rados.ErrNotFound) {
-			return nil, nil
+		return nil, false, err
+	}
+	return objs, more, nil
+}
+
+// fetchRawBatch is like fetchBatch, but returns the serialized objects.
+func (s *Store[E]) fetchRawBatch(ioCtx *rados.IOContext, startAfter string, max int64) (map[string][]byte, bool, error) {
+	var (
+		values = make(map[string][]byte)
+		more   bool
+	)
+	for _, oid := range s.dataObjects() {
+		omap, err := ioCtx.GetOmapValues(oid, startAfter, "", max)
+		if err != nil {
+			if errors.Is(err, rados.ErrNotFound) {
+				continue
+			}
+			return nil, false, err
+		}
+
+		for id, data := range omap {
+			values[id] = data
+		}
+		if int64(len(omap)) == max {
+			more = true
+		}
+	}
+
+	if int64(len(values)) > max {
+		ids := make([]string, 0, len(values))
+		for id := range values {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids[max:] {
+			delete(values, id)
+		}
+		more = true
+	}
+	return values, more, nil
+}
+
+// fetchIndexedBatch is like fetchBatch, but only considers the given sorted ids.
+// Ids of objects that no longer exist are skipped.
+func (s *Store[E]) fetchIndexedBatch(ids []string) func(ioCtx *rados.IOContext, startAfter string, max int64) ([]E, bool, error) {
+	return func(ioCtx *rados.IOContext, startAfter string, max int64) ([]E, bool, error) {
+		start := sort.SearchStrings(ids, startAfter)
+		if start < len(ids) && ids[start] == startAfter {
+			start++
+		}
+		end := start + int(max)
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		for start < end {
+			objs, err := s.getMany(ioCtx, ids[start:end])
+			if err != nil {
+				return nil, false, err
+			}
+			if len(objs) > 0 {
+				return objs, end < len(ids), nil
+			}
+
+			// All objects of the batch are gone, continue with the next one.
+			start, end = end, end+int(max)
+			if end > len(ids) {
+				end = len(ids)
+			}
+		}
+		return nil, false, nil
+	}
+}
+
+func (s *Store[E]) list(ioCtx *rados.IOContext) ([]E, error) {
+	var (
+		objs       []E
+		startAfter string
+	)
+	for {
+		batch, more, err := s.fetchBatch(ioCtx, startAfter, listBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, batch...)
+		if !more || len(batch) == 0 {
+			return objs, nil
 		}
-		return nil, err
+		startAfter = batch[len(batch)-1].GetID()
 	}
+}
+
+// unmarshalAll returns the objects of omap ordered by id.
+func (s *Store[E]) unmarshalAll(omap map[string][]byte) ([]E, error) {
+	ids := make([]string, 0, len(omap))
+	for id := range omap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
 
-	var objs []E
-	for _, v := range omap {
-		obj := s.newFunc()
-		if err := json.Unmarshal(v, &obj); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal object: %w", err)
+	objs := make([]E, 0, len(ids))
+	for _, id := range ids {
+		obj, err := s.decode(omap[id])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object %q: %w", id, err)
 		}
 
 		objs = append(objs, obj)
@@ -317,27 +674,182 @@ func (s *Store[E]) List(ctx context.Context) ([]E, error) {
 	return objs, nil
 }
 
-func (s *Store[E]) set(ioCtx *rados.IOContext, obj E) (E, error) {
+// errOmapChanged signals that the omap object was modified between reading
+// and writing it.
+var errOmapChanged = errors.New("omap object changed concurrently")
+
+// commit reads the object with the given id together with the version of the
+// omap object and lets mutate stage changes on a write op. The write op asserts
+// that the omap object is still at the read version, so a write from any other
+// writer in between makes it fail instead of being overwritten. As the version
+// covers the whole omap object, mutate is retried with backoff on the fresh
+// state until the write goes through, failing with ErrContended after
+// maxCommitAttempts.
+//
+// go-ceph does not expose rados_write_op_omap_cmp, which would allow comparing
+// the single key instead.
+func (s *Store[E]) commit(ctx context.Context, ioCtx *rados.IOContext, id string, mutate func(op *rados.WriteOp, current E, found bool) error) error {
+	oid := s.objectName(id)
+	backoff := commitBackoff
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		if attempt > 0 {
+			if err := waitBackoff(ctx, &backoff); err != nil {
+				return err
+			}
+		}
+
+		current, found, version, err := s.get(ioCtx, oid, id)
+		if err != nil {
+			return err
+		}
+
+		if !found && s.shards > 0 {
+			moved, err := s.moveFromHead(ctx, ioCtx, id)
+			if err != nil {
+				return err
+			}
+			if moved {
+				continue
+			}
+		}
+
+		if err := s.tryCommit(ioCtx, oid, version, func(op *rados.WriteOp) error {
+			return mutate(op, current, found)
+		}); err != nil {
+			if errors.Is(err, errOmapChanged) {
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("object with id %q could not be written after %d attempts: %w", id, maxCommitAttempts, ErrContended)
+}
+
+// waitBackoff waits for the next step of backoff unless ctx is done first.
+func waitBackoff(ctx context.Context, backoff *wait.Backoff) error {
+	timer := time.NewTimer(backoff.Step())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *Store[E]) tryCommit(ioCtx *rados.IOContext, oid string, version uint64, mutate func(op *rados.WriteOp) error) error {
+	op := rados.CreateWriteOp()
+	defer op.Release()
+
+	if version == 0 {
+		op.Create(rados.CreateExclusive)
+	} else {
+		op.AssertVersion(version)
+	}
+
+	if err := mutate(op); err != nil {
+		return err
+	}
+
+	if err := op.Operate(ioCtx, oid, rados.OperationNoFlag); err != nil {
+		switch operationErrorCode(err) {
+		case -int(syscall.ERANGE), -int(syscall.EOVERFLOW), -int(syscall.EEXIST), -int(syscall.ENOENT):
+			return errOmapChanged
+		default:
+			return fmt.Errorf("failed to write omap: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store[E]) set(op *rados.WriteOp, obj E) error {
+	if s.schema != nil {
+		obj.SetSchemaVersion(s.schema.LatestVersion())
+	}
+
 	data, err := json.Marshal(obj)
 	if err != nil {
-		return utils.Zero[E](), fmt.Errorf("failed to marshal obj: %w", err)
+		return fmt.Errorf("failed to marshal obj: %w", err)
 	}
 
-	if err := s.setOmapValue(ioCtx, s.omapName, obj.GetID(), data); err != nil {
-		return utils.Zero[E](), fmt.Errorf("failed to put os object mapping: %w", err)
+	if data, err = s.seal(data); err != nil {
+		return err
 	}
 
-	return obj, nil
+	op.SetOmap(map[string][]byte{
+		obj.GetID(): data,
+	})
+	return nil
 }
 
-func (s *Store[E]) get(ioCtx *rados.IOContext, id string) (E, error) {
-	data, err := s.getSingleOmapValue(ioCtx, s.omapName, id)
+// get returns the object with the given id from the omap of the object oid
+// and the version of that object it was read at. A version of 0 means the
+// object does not exist yet.
+func (s *Store[E]) get(ioCtx *rados.IOContext, oid, id string) (E, bool, uint64, error) {
+	data, found, version, err := getRaw(ioCtx, oid, id)
+	if err != nil || !found {
+		return utils.Zero[E](), false, version, err
+	}
+
+	obj, err := s.decode(data)
 	if err != nil {
-		if !errors.Is(err, rados.ErrNotFound) {
-			return utils.Zero[E](), fmt.Errorf("failed to fetch omap value: %w", err)
+		return utils.Zero[E](), false, 0, err
+	}
+
+	return obj, true, version, nil
+}
+
+// getRaw is like get, but returns the serialized object.
+func getRaw(ioCtx *rados.IOContext, oid, id string) ([]byte, bool, uint64, error) {
+	op := rados.CreateReadOp()
+	defer op.Release()
+
+	step := op.GetOmapValuesByKeys([]string{id})
+	if err := op.Operate(ioCtx, oid, rados.OperationNoFlag); err != nil {
+		if operationErrorCode(err) == -int(syscall.ENOENT) {
+			return nil, false, 0, nil
 		}
+		return nil, false, 0, fmt.Errorf("failed to fetch omap value: %w", err)
+	}
 
-		return utils.Zero[E](), fmt.Errorf("object with id %q %w", id, store.ErrNotFound)
+	version, err := ioCtx.GetLastVersion()
+	if err != nil {
+		return nil, false, 0, fmt.Errorf("failed to get omap version: %w", err)
+	}
+
+	var data []byte
+	for {
+		kv, err := step.Next()
+		if err != nil {
+			return nil, false, 0, fmt.Errorf("failed to read omap value: %w", err)
+		}
+		if kv == nil {
+			break
+		}
+		if kv.Key == id {
+			data = kv.Value
+		}
+	}
+
+	return data, data != nil, version, nil
+}
+
+// decode converts data to the latest schema version and unmarshals it.
+func (s *Store[E]) decode(data []byte) (E, error) {
+	data, err := s.unseal(data)
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+
+	if s.schema != nil {
+		if data, err = s.schema.Convert(data); err != nil {
+			return utils.Zero[E](), fmt.Errorf("failed to convert object: %w", err)
+		}
 	}
 
 	obj := s.newFunc()
@@ -347,3 +859,17 @@ func (s *Store[E]) get(ioCtx *rados.IOContext, id string) (E, error) {
 
 	return obj, nil
 }
+
+func operationErrorCode(err error) int {
+	var opErr rados.OperationError
+	if !errors.As(err, &opErr) {
+		return 0
+	}
+
+	var coded interface{ ErrorCode() int }
+	if !errors.As(opErr.OpError, &coded) {
+		return 0
+	}
+
+	return coded.ErrorCode()
+}
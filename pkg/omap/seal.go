@@ -0,0 +1,57 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omap
+
+import (
+	"fmt"
+
+	"github.com/onmetal/cephlet/pkg/encryption"
+)
+
+// seal encrypts the sensitive fields of the serialized object data.
+func (s *Store[E]) seal(data []byte) ([]byte, error) {
+	if len(s.sensitiveFields) == 0 {
+		return data, nil
+	}
+
+	sealed, err := encryption.SealFields(data, s.encryptor, s.sensitiveFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal sensitive fields: %w", err)
+	}
+	return sealed, nil
+}
+
+// unseal decrypts the sensitive fields of the serialized object data. Fields
+// written before they were sealed are returned as they are and sealed on the
+// next write of their object.
+func (s *Store[E]) unseal(data []byte) ([]byte, error) {
+	if len(s.sensitiveFields) == 0 {
+		return data, nil
+	}
+
+	unsealed, err := encryption.UnsealFields(data, s.encryptor, s.sensitiveFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal sensitive fields: %w", err)
+	}
+	return unsealed, nil
+}
+
+func (s *Store[E]) needsSealing(data []byte) (bool, error) {
+	if len(s.sensitiveFields) == 0 {
+		return false, nil
+	}
+
+	return encryption.NeedsSealing(data, s.sensitiveFields)
+}
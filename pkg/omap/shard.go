@@ -0,0 +1,308 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package omap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/go-logr/logr"
+)
+
+// shardsXattr is the extended attribute of the head object, the object named
+// after the omap, recording the number of shards of a store.
+const shardsXattr = "cephlet.shards"
+
+// objectName returns the name of the object holding the entry with the given id.
+func (s *Store[E]) objectName(id string) string {
+	if s.shards == 0 {
+		return s.omapName
+	}
+	return s.shardName(s.shardOf(id))
+}
+
+func (s *Store[E]) shardOf(id string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % uint32(s.shards))
+}
+
+func (s *Store[E]) shardName(shard int) string {
+	return fmt.Sprintf("%s.shard-%d", s.omapName, shard)
+}
+
+// dataObjects returns the names of all objects that may hold entries. Sharded
+// stores include the head object, as it holds the entries written before the
+// store was sharded until they are moved.
+func (s *Store[E]) dataObjects() []string {
+	oids := []string{s.omapName}
+	for shard := 0; shard < s.shards; shard++ {
+		oids = append(oids, s.shardName(shard))
+	}
+	return oids
+}
+
+// openIOContext opens an io context and ensures the configured number of
+// shards matches the one of the stored data.
+func (s *Store[E]) openIOContext() (*rados.IOContext, error) {
+	ioCtx, err := s.conn.OpenIOContext(s.pool)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkLayout(ioCtx); err != nil {
+		ioCtx.Destroy()
+		return nil, err
+	}
+
+	return ioCtx, nil
+}
+
+func (s *Store[E]) checkLayout(ioCtx *rados.IOContext) error {
+	s.layoutMu.Lock()
+	defer s.layoutMu.Unlock()
+
+	if s.layoutChecked {
+		return nil
+	}
+
+	shards, err := s.readShards(ioCtx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case shards == s.shards:
+	case shards == 0:
+		// The store is switched to shards. Entries of the head object are
+		// moved to their shards on their next write or by Reshard.
+		if err := ioCtx.Create(s.omapName, rados.CreateIdempotent); err != nil {
+			return fmt.Errorf("failed to create omap object: %w", err)
+		}
+		if err := ioCtx.SetXattr(s.omapName, shardsXattr, []byte(strconv.Itoa(s.shards))); err != nil {
+			return fmt.Errorf("failed to record number of shards: %w", err)
+		}
+	default:
+		return fmt.Errorf("omap %q is stored in %d shards, but %d shards are configured", s.omapName, shards, s.shards)
+	}
+
+	s.layoutChecked = true
+	return nil
+}
+
+func (s *Store[E]) readShards(ioCtx *rados.IOContext) (int, error) {
+	data := make([]byte, 16)
+	n, err := ioCtx.GetXattr(s.omapName, shardsXattr, data)
+	if err != nil {
+		if code := radosErrorCode(err); code == -int(syscall.ENOENT) || code == -int(syscall.ENODATA) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read number of shards: %w", err)
+	}
+
+	shards, err := strconv.Atoi(string(data[:n]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid number of shards %q: %w", data[:n], err)
+	}
+	return shards, nil
+}
+
+// lookup returns the object with the given id from the object holding it.
+func (s *Store[E]) lookup(ioCtx *rados.IOContext, id string) (E, bool, error) {
+	if s.shards == 0 {
+		obj, found, _, err := s.get(ioCtx, s.omapName, id)
+		return obj, found, err
+	}
+
+	// The head object is read first: An entry moved in between is found in its
+	// shard afterwards, whose entry takes precedence.
+	headObj, headFound, _, err := s.get(ioCtx, s.omapName, id)
+	if err != nil {
+		return headObj, false, err
+	}
+
+	obj, found, _, err := s.get(ioCtx, s.objectName(id), id)
+	if err != nil || found {
+		return obj, found, err
+	}
+	return headObj, headFound, nil
+}
+
+// getValues returns the serialized objects with the given ids, skipping
+// missing ones.
+func (s *Store[E]) getValues(ioCtx *rados.IOContext, ids []string) (map[string][]byte, error) {
+	if s.shards == 0 {
+		values, _, err := getOmapValuesByKeys(ioCtx, s.omapName, ids)
+		return values, err
+	}
+
+	// As in lookup, the head object is read first.
+	values, _, err := getOmapValuesByKeys(ioCtx, s.omapName, ids)
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string][]byte, len(ids))
+	}
+
+	idsByShard := make(map[string][]string)
+	for _, id := range ids {
+		oid := s.objectName(id)
+		idsByShard[oid] = append(idsByShard[oid], id)
+	}
+
+	for oid, shardIDs := range idsByShard {
+		shardValues, _, err := getOmapValuesByKeys(ioCtx, oid, shardIDs)
+		if err != nil {
+			return nil, err
+		}
+		for id, data := range shardValues {
+			values[id] = data
+		}
+	}
+
+	return values, nil
+}
+
+// moveFromHead moves the entry with the given id from the head object to its
+// shard. It reports whether the entry is in its shard afterwards, in which
+// case the caller has to read it again.
+//
+// The shard is read before the head object and the entry is only written if
+// the shard did not change in between. Otherwise, an entry moved and deleted
+// by another writer in between could be brought back.
+func (s *Store[E]) moveFromHead(ctx context.Context, ioCtx *rados.IOContext, id string) (bool, error) {
+	oid := s.objectName(id)
+	backoff := commitBackoff
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		if attempt > 0 {
+			if err := waitBackoff(ctx, &backoff); err != nil {
+				return false, err
+			}
+		}
+
+		_, shardFound, version, err := getRaw(ioCtx, oid, id)
+		if err != nil {
+			return false, err
+		}
+
+		data, headFound, _, err := getRaw(ioCtx, s.omapName, id)
+		if err != nil {
+			return false, err
+		}
+
+		if !headFound {
+			if shardFound {
+				return true, nil
+			}
+
+			// The entry may have been moved after the shard was read.
+			_, shardFound, _, err := getRaw(ioCtx, oid, id)
+			return shardFound, err
+		}
+
+		if !shardFound {
+			if err := s.tryCommit(ioCtx, oid, version, func(op *rados.WriteOp) error {
+				op.SetOmap(map[string][]byte{id: data})
+				return nil
+			}); err != nil {
+				if errors.Is(err, errOmapChanged) {
+					continue
+				}
+				return false, err
+			}
+		}
+
+		if err := ioCtx.RmOmapKeys(s.omapName, []string{id}); err != nil && !errors.Is(err, rados.ErrNotFound) {
+			return false, fmt.Errorf("failed to remove moved entry from omap: %w", err)
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("object with id %q could not be moved after %d attempts: %w", id, maxCommitAttempts, ErrContended)
+}
+
+// Reshard moves all entries written before the store was configured with
+// shards from the head object to their shards and returns the number of moved
+// entries. It can be run while the store is in use, as entries are read from
+// the head object until they are moved.
+func (s *Store[E]) Reshard(ctx context.Context) (int, error) {
+	if s.shards == 0 {
+		return 0, fmt.Errorf("store %q has no shards", s.omapName)
+	}
+
+	log := logr.FromContextOrDiscard(ctx).WithValues("omap", s.omapName)
+
+	ioCtx, err := s.openIOContext()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get io context: %w", err)
+	}
+	defer ioCtx.Destroy()
+
+	moved := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+
+		omap, err := ioCtx.GetOmapValues(s.omapName, "", "", listBatchSize)
+		if err != nil {
+			if errors.Is(err, rados.ErrNotFound) {
+				return moved, nil
+			}
+			return moved, fmt.Errorf("failed to read omap: %w", err)
+		}
+		if len(omap) == 0 {
+			return moved, nil
+		}
+
+		ids := make([]string, 0, len(omap))
+		for id := range omap {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			if err := s.moveToShard(ctx, ioCtx, id); err != nil {
+				return moved, fmt.Errorf("failed to move object %q: %w", id, err)
+			}
+			moved++
+		}
+
+		log.V(1).Info("Moved entries to shards", "Moved", moved)
+	}
+}
+
+func (s *Store[E]) moveToShard(ctx context.Context, ioCtx *rados.IOContext, id string) error {
+	s.idMu.Lock(id)
+	defer s.idMu.Unlock(id)
+
+	_, err := s.moveFromHead(ctx, ioCtx, id)
+	return err
+}
+
+func radosErrorCode(err error) int {
+	var coded interface{ ErrorCode() int }
+	if !errors.As(err, &coded) {
+		return 0
+	}
+	return coded.ErrorCode()
+}
@@ -0,0 +1,331 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package qcow2 reads the virtual disk of qcow2 images as raw content.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic are the first bytes of every qcow2 image.
+var Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+var (
+	// ErrBackingFile is returned for images that only hold the changes to a
+	// backing file.
+	ErrBackingFile = errors.New("qcow2 images with a backing file are not supported")
+	// ErrUnsupported is returned for images using features that cannot be
+	// read.
+	ErrUnsupported = errors.New("unsupported qcow2 image")
+)
+
+const (
+	headerSize   = 72
+	headerSizeV3 = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// maxL1Size is the maximum size of the l1 table in bytes, as in qemu.
+	maxL1Size = 32 * 1024 * 1024
+
+	// offsetMask masks the host offset of standard l1 and l2 entries.
+	offsetMask = 0x00fffffffffffe00
+
+	l2Compressed = 1 << 62
+	l2Zero       = 1 << 0
+)
+
+// Incompatible features of version 3 images.
+const (
+	incompatibleDirty           = 1 << 0
+	incompatibleCorrupt         = 1 << 1
+	incompatibleExternalData    = 1 << 2
+	incompatibleCompressionType = 1 << 3
+	incompatibleExtendedL2      = 1 << 4
+)
+
+const (
+	compressionDeflate = 0
+	compressionZstd    = 1
+)
+
+// IsQcow2 reports whether data starts with the qcow2 magic.
+func IsQcow2(data []byte) bool {
+	return bytes.HasPrefix(data, Magic)
+}
+
+// Image is an opened qcow2 image.
+type Image struct {
+	r           io.ReaderAt
+	size        uint64
+	clusterBits uint
+	compression byte
+	l1          []uint64
+}
+
+// Open parses the header and the l1 table of the qcow2 image in r.
+func Open(r io.ReaderAt) (*Image, error) {
+	header := make([]byte, headerSizeV3+1)
+	n, err := r.ReadAt(header, 0)
+	if n < headerSize {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	header = header[:n]
+
+	if !IsQcow2(header) {
+		return nil, fmt.Errorf("invalid magic %x", header[:len(Magic)])
+	}
+
+	be := binary.BigEndian
+	img := &Image{
+		r:           r,
+		size:        be.Uint64(header[24:]),
+		clusterBits: uint(be.Uint32(header[20:])),
+	}
+
+	version := be.Uint32(header[4:])
+	switch version {
+	case 2:
+	case 3:
+		if n < headerSizeV3 {
+			return nil, fmt.Errorf("failed to read version 3 header: %w", io.ErrUnexpectedEOF)
+		}
+		if err := img.checkFeatures(be.Uint64(header[72:]), header); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupported, version)
+	}
+
+	if be.Uint64(header[8:]) != 0 {
+		return nil, ErrBackingFile
+	}
+	if cryptMethod := be.Uint32(header[32:]); cryptMethod != 0 {
+		return nil, fmt.Errorf("%w: encryption method %d", ErrUnsupported, cryptMethod)
+	}
+	if img.clusterBits < minClusterBits || img.clusterBits > maxClusterBits {
+		return nil, fmt.Errorf("invalid cluster bits %d", img.clusterBits)
+	}
+
+	if img.size > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid size %d", img.size)
+	}
+	l1Size := uint64(be.Uint32(header[36:]))
+	if l1Size*8 > maxL1Size {
+		return nil, fmt.Errorf("l1 table of %d entries exceeds %d bytes", l1Size, maxL1Size)
+	}
+	if needed := img.l1Entries(); l1Size < needed {
+		return nil, fmt.Errorf("l1 table of %d entries is too small for %d bytes", l1Size, img.size)
+	}
+	table := make([]byte, l1Size*8)
+	if _, err := r.ReadAt(table, int64(be.Uint64(header[40:]))); err != nil {
+		return nil, fmt.Errorf("failed to read l1 table: %w", err)
+	}
+	img.l1 = make([]uint64, l1Size)
+	for i := range img.l1 {
+		img.l1[i] = be.Uint64(table[i*8:])
+	}
+	return img, nil
+}
+
+func (img *Image) checkFeatures(incompatible uint64, header []byte) error {
+	// Dirty images may only have stale refcounts, which are not needed to
+	// read them.
+	incompatible &^= incompatibleDirty
+
+	if incompatible&incompatibleCompressionType != 0 {
+		incompatible &^= incompatibleCompressionType
+		if headerLength := binary.BigEndian.Uint32(header[100:]); headerLength <= headerSizeV3 || len(header) <= headerSizeV3 {
+			return fmt.Errorf("header of %d bytes lacks the compression type", headerLength)
+		}
+		img.compression = header[headerSizeV3]
+		if img.compression != compressionDeflate && img.compression != compressionZstd {
+			return fmt.Errorf("%w: compression type %d", ErrUnsupported, img.compression)
+		}
+	}
+
+	for _, feature := range []struct {
+		bit  uint64
+		name string
+	}{
+		{incompatibleCorrupt, "corrupt"},
+		{incompatibleExternalData, "external data file"},
+		{incompatibleExtendedL2, "extended l2 entries"},
+	} {
+		if incompatible&feature.bit != 0 {
+			return fmt.Errorf("%w: %s", ErrUnsupported, feature.name)
+		}
+	}
+	if incompatible != 0 {
+		return fmt.Errorf("%w: incompatible features %#x", ErrUnsupported, incompatible)
+	}
+	return nil
+}
+
+// Size returns the size of the virtual disk in bytes.
+func (img *Image) Size() uint64 {
+	return img.size
+}
+
+func (img *Image) clusterSize() uint64 {
+	return 1 << img.clusterBits
+}
+
+func (img *Image) l2Entries() uint64 {
+	return img.clusterSize() / 8
+}
+
+func (img *Image) l1Entries() uint64 {
+	perL1 := img.clusterSize() * img.l2Entries()
+	entries := img.size / perL1
+	if img.size%perL1 != 0 {
+		entries++
+	}
+	return entries
+}
+
+// NewReader returns a reader of the virtual disk of img. Unallocated and
+// zero clusters are read as zeros without accessing the image.
+func (img *Image) NewReader() io.Reader {
+	return &reader{img: img, l2Index: -1, clusterIndex: -1}
+}
+
+type reader struct {
+	img *Image
+	pos uint64
+
+	l2Index int64
+	l2      []uint64
+
+	// cluster caches the last decompressed cluster.
+	clusterIndex int64
+	cluster      []byte
+	zstd         *zstd.Decoder
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	img := r.img
+	if r.pos >= img.size {
+		return 0, io.EOF
+	}
+
+	clusterSize := img.clusterSize()
+	within := r.pos & (clusterSize - 1)
+	n := min(uint64(len(p)), clusterSize-within, img.size-r.pos)
+	p = p[:n]
+
+	entry, err := r.l2Entry(r.pos >> img.clusterBits)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case entry&l2Compressed != 0:
+		cluster, err := r.decompressCluster(int64(r.pos>>img.clusterBits), entry)
+		if err != nil {
+			return 0, err
+		}
+		copy(p, cluster[within:])
+	case entry&l2Zero != 0 || entry&offsetMask == 0:
+		clear(p)
+	default:
+		if _, err := img.r.ReadAt(p, int64(entry&offsetMask+within)); err != nil {
+			return 0, fmt.Errorf("failed to read cluster at %d: %w", r.pos, err)
+		}
+	}
+
+	r.pos += n
+	return int(n), nil
+}
+
+// l2Entry returns the l2 entry of the cluster with the given index, or zero
+// if it is unallocated.
+func (r *reader) l2Entry(cluster uint64) (uint64, error) {
+	img := r.img
+	l1Index := cluster / img.l2Entries()
+	if int64(l1Index) != r.l2Index {
+		l2Offset := img.l1[l1Index] & offsetMask
+		if l2Offset == 0 {
+			return 0, nil
+		}
+
+		table := make([]byte, img.clusterSize())
+		if _, err := img.r.ReadAt(table, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("failed to read l2 table at %d: %w", l2Offset, err)
+		}
+		r.l2 = make([]uint64, img.l2Entries())
+		for i := range r.l2 {
+			r.l2[i] = binary.BigEndian.Uint64(table[i*8:])
+		}
+		r.l2Index = int64(l1Index)
+	}
+	return r.l2[cluster%img.l2Entries()], nil
+}
+
+func (r *reader) decompressCluster(index int64, entry uint64) ([]byte, error) {
+	if index == r.clusterIndex {
+		return r.cluster, nil
+	}
+
+	img := r.img
+	offsetBits := 62 - (img.clusterBits - 8)
+	offset := entry & (1<<offsetBits - 1)
+	sectors := (entry >> offsetBits) & (1<<(img.clusterBits-8) - 1)
+	compressed := make([]byte, (sectors+1)*512-offset&511)
+
+	// The compressed data of the last cluster may end before the sector.
+	n, err := img.r.ReadAt(compressed, int64(offset))
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return nil, fmt.Errorf("failed to read compressed cluster at %d: %w", offset, err)
+	}
+
+	var decompressor io.Reader
+	switch img.compression {
+	case compressionDeflate:
+		decompressor = flate.NewReader(bytes.NewReader(compressed[:n]))
+	case compressionZstd:
+		if r.zstd == nil {
+			if r.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+				return nil, fmt.Errorf("failed to initialize zstd decoder: %w", err)
+			}
+		}
+		if err := r.zstd.Reset(bytes.NewReader(compressed[:n])); err != nil {
+			return nil, fmt.Errorf("failed to reset zstd decoder: %w", err)
+		}
+		decompressor = r.zstd
+	}
+
+	if r.cluster == nil {
+		r.cluster = make([]byte, img.clusterSize())
+	}
+	r.clusterIndex = -1
+	if _, err := io.ReadFull(decompressor, r.cluster); err != nil {
+		return nil, fmt.Errorf("failed to decompress cluster at %d: %w", offset, err)
+	}
+	r.clusterIndex = index
+	return r.cluster, nil
+}
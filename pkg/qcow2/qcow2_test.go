@@ -0,0 +1,139 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qcow2_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math"
+
+	. "github.com/onmetal/cephlet/pkg/qcow2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+const clusterSize = 512
+
+// newImage returns a version 3 image with 512 byte clusters. The header is
+// in cluster 0, the l1 table in cluster 1, the l2 table in cluster 2 and the
+// clusters of the virtual disk after that.
+func newImage(l2 []uint64, clusters ...[]byte) []byte {
+	image := make([]byte, (3+len(clusters))*clusterSize)
+	be := binary.BigEndian
+
+	copy(image, Magic)
+	be.PutUint32(image[4:], 3)
+	be.PutUint32(image[20:], 9)
+	be.PutUint64(image[24:], uint64(len(l2))*clusterSize)
+	be.PutUint32(image[36:], 1)
+	be.PutUint64(image[40:], 1*clusterSize)
+	be.PutUint32(image[100:], 104)
+
+	be.PutUint64(image[1*clusterSize:], 2*clusterSize)
+	for i, entry := range l2 {
+		be.PutUint64(image[2*clusterSize+i*8:], entry)
+	}
+	for i, cluster := range clusters {
+		copy(image[(3+i)*clusterSize:], cluster)
+	}
+	return image
+}
+
+var _ = Describe("Image", func() {
+	data := bytes.Repeat([]byte{0xab}, clusterSize)
+
+	It("should read the virtual disk as raw content", func() {
+		var compressed bytes.Buffer
+		w, err := flate.NewWriter(&compressed, flate.BestCompression)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write(bytes.Repeat([]byte{0xcd}, clusterSize))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		Expect(compressed.Len()).To(BeNumerically("<", clusterSize))
+
+		image := newImage([]uint64{
+			1<<63 | 3*clusterSize, // allocated
+			0,                     // unallocated
+			1,                     // zero
+			1<<62 | 4*clusterSize, // compressed into one sector
+		}, data, compressed.Bytes())
+
+		img, err := Open(bytes.NewReader(image))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.Size()).To(BeEquivalentTo(4 * clusterSize))
+
+		raw, err := io.ReadAll(img.NewReader())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(raw).To(Equal(bytes.Join([][]byte{
+			data,
+			make([]byte, 2*clusterSize),
+			bytes.Repeat([]byte{0xcd}, clusterSize),
+		}, nil)))
+	})
+
+	It("should reject images with a backing file", func() {
+		image := newImage([]uint64{0})
+		binary.BigEndian.PutUint64(image[8:], 3*clusterSize)
+
+		_, err := Open(bytes.NewReader(image))
+		Expect(err).To(MatchError(ErrBackingFile))
+	})
+
+	It("should reject images with extended l2 entries", func() {
+		image := newImage([]uint64{0})
+		binary.BigEndian.PutUint64(image[72:], 1<<4)
+
+		_, err := Open(bytes.NewReader(image))
+		Expect(err).To(MatchError(ErrUnsupported))
+	})
+
+	DescribeTable("should reject malformed headers",
+		func(modify func(image []byte) []byte, expected string) {
+			image := modify(newImage([]uint64{1<<63 | 3*clusterSize}, data))
+
+			_, err := Open(bytes.NewReader(image))
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		},
+		Entry("truncated header", func(image []byte) []byte {
+			return image[:64]
+		}, "failed to read header"),
+		Entry("invalid magic", func(image []byte) []byte {
+			image[0] = 'X'
+			return image
+		}, "invalid magic"),
+		Entry("invalid cluster bits", func(image []byte) []byte {
+			binary.BigEndian.PutUint32(image[20:], 64)
+			return image
+		}, "invalid cluster bits"),
+		Entry("size overflowing the l1 entries", func(image []byte) []byte {
+			binary.BigEndian.PutUint64(image[24:], math.MaxUint64)
+			return image
+		}, "invalid size"),
+		Entry("size beyond the l1 table", func(image []byte) []byte {
+			binary.BigEndian.PutUint64(image[24:], math.MaxInt64)
+			return image
+		}, "too small"),
+		Entry("l1 table exceeding the maximum size", func(image []byte) []byte {
+			binary.BigEndian.PutUint32(image[36:], math.MaxUint32)
+			return image
+		}, "exceeds"),
+		Entry("l1 table beyond the end of the image", func(image []byte) []byte {
+			binary.BigEndian.PutUint64(image[40:], 1<<40)
+			return image
+		}, "failed to read l1 table"),
+	)
+})
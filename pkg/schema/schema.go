@@ -0,0 +1,121 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema converts persisted objects written with an older layout to
+// the current one.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Converter converts a serialized object from one schema version to the next.
+// Numbers are decoded as json.Number, so they keep their precision.
+type Converter func(obj map[string]interface{}) error
+
+// NoConversion is the Converter for versions that changed nothing that needs
+// to be converted.
+func NoConversion(map[string]interface{}) error {
+	return nil
+}
+
+// Registry holds the converters of an object type.
+type Registry struct {
+	converters []Converter
+}
+
+// NewRegistry returns a Registry where converters[i] converts objects of
+// version i to version i+1. Objects without version are of version 0, so the
+// latest version is len(converters).
+func NewRegistry(converters ...Converter) *Registry {
+	return &Registry{
+		converters: converters,
+	}
+}
+
+// LatestVersion is the version objects are written with.
+func (r *Registry) LatestVersion() int {
+	return len(r.converters)
+}
+
+type versioned struct {
+	Metadata struct {
+		SchemaVersion int `json:"schemaVersion"`
+	} `json:"metadata"`
+}
+
+// Version returns the schema version of the serialized object data.
+func Version(data []byte) (int, error) {
+	var v versioned
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal schema version: %w", err)
+	}
+	return v.Metadata.SchemaVersion, nil
+}
+
+// NeedsConversion reports whether the serialized object data is of an older
+// version than the latest one.
+func (r *Registry) NeedsConversion(data []byte) (bool, error) {
+	version, err := Version(data)
+	if err != nil {
+		return false, err
+	}
+	return version < r.LatestVersion(), nil
+}
+
+// Convert converts the serialized object data to the latest version. Data
+// already at the latest version is returned as is.
+func (r *Registry) Convert(data []byte) ([]byte, error) {
+	version, err := Version(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case version == r.LatestVersion():
+		return data, nil
+	case version > r.LatestVersion():
+		return nil, fmt.Errorf("schema version %d is newer than the latest supported version %d", version, r.LatestVersion())
+	case version < 0:
+		return nil, fmt.Errorf("invalid schema version %d", version)
+	}
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("failed to decode object: %w", err)
+	}
+
+	for ; version < r.LatestVersion(); version++ {
+		if err := r.converters[version](obj); err != nil {
+			return nil, fmt.Errorf("failed to convert from schema version %d: %w", version, err)
+		}
+	}
+
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+		obj["metadata"] = metadata
+	}
+	metadata["schemaVersion"] = version
+
+	converted, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode object: %w", err)
+	}
+	return converted, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema_test
+
+import (
+	"encoding/json"
+	"errors"
+
+	. "github.com/onmetal/cephlet/pkg/schema"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	renameSize := func(obj map[string]interface{}) error {
+		spec := obj["spec"].(map[string]interface{})
+		spec["sizeBytes"] = spec["size"]
+		delete(spec, "size")
+		return nil
+	}
+
+	registry := NewRegistry(NoConversion, renameSize)
+
+	It("should convert unversioned objects to the latest version", func() {
+		data, err := registry.Convert([]byte(`{"metadata":{"id":"foo"},"spec":{"size":18446744073709551615}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"metadata":{"id":"foo","schemaVersion":2},"spec":{"sizeBytes":18446744073709551615}}`))
+	})
+
+	It("should only apply the converters of newer versions", func() {
+		data, err := registry.Convert([]byte(`{"metadata":{"schemaVersion":1},"spec":{"size":1}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"metadata":{"schemaVersion":2},"spec":{"sizeBytes":1}}`))
+	})
+
+	It("should return objects of the latest version as they are", func() {
+		in := []byte(`{"metadata":{"schemaVersion":2},"spec":{"size":1}}`)
+		Expect(registry.Convert(in)).To(Equal(in))
+
+		needsConversion, err := registry.NeedsConversion(in)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(needsConversion).To(BeFalse())
+	})
+
+	It("should reject objects of a newer version", func() {
+		_, err := registry.Convert([]byte(`{"metadata":{"schemaVersion":3}}`))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report the version of objects", func() {
+		Expect(Version([]byte(`{}`))).To(Equal(0))
+		Expect(Version([]byte(`{"metadata":{"schemaVersion":2}}`))).To(Equal(2))
+		_, err := Version([]byte(`{`))
+		var syntaxErr *json.SyntaxError
+		Expect(errors.As(err, &syntaxErr)).To(BeTrue())
+	})
+})
@@ -0,0 +1,437 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Options[E api.Object] struct {
+	// Name identifies the cache in its metrics.
+	Name    string
+	NewFunc func() E
+
+	// Indexers are the fields that can be used in field selectors. They have
+	// to match the ones of the backend.
+	Indexers store.Indexers[E]
+
+	// ResyncPeriod is the interval in which the cache is relisted from the
+	// backend to recover from lost events.
+	ResyncPeriod time.Duration
+	// ListPageSize is the number of objects listed from the backend at once.
+	ListPageSize int64
+}
+
+func setOptionsDefaults[E api.Object](o *Options[E]) {
+	if o.ResyncPeriod == 0 {
+		o.ResyncPeriod = 1 * time.Hour
+	}
+	if o.ListPageSize == 0 {
+		o.ListPageSize = store.DefaultListPageSize
+	}
+}
+
+// A failed relist is retried with exponential backoff between these bounds,
+// so the cache does not stay unsynced until the next resync.
+const (
+	minRelistBackoff = 1 * time.Second
+	maxRelistBackoff = 1 * time.Minute
+)
+
+var (
+	requestsDesc = prometheus.NewDesc(
+		"cephlet_store_cache_requests_total",
+		"Number of reads served by the store cache, partitioned by whether they were served from memory.",
+		[]string{"store", "result"}, nil,
+	)
+	stalenessDesc = prometheus.NewDesc(
+		"cephlet_store_cache_staleness_seconds",
+		"Seconds since the store cache was last known to be in sync with the backend. Zero while it is in sync.",
+		[]string{"store"}, nil,
+	)
+	objectsDesc = prometheus.NewDesc(
+		"cephlet_store_cache_objects",
+		"Number of objects held by the store cache.",
+		[]string{"store"}, nil,
+	)
+)
+
+// New returns a store.Store serving reads from memory once Start listed the
+// backend, keeping itself current through the backend's watch. Writes pass
+// through to the backend. Objects written through other stores only become
+// visible once their watch event arrived.
+func New[E api.Object](backend store.Store[E], opts Options[E]) (*Store[E], error) {
+	if backend == nil {
+		return nil, fmt.Errorf("must specify backend")
+	}
+	if opts.Name == "" {
+		return nil, fmt.Errorf("must specify opts.Name")
+	}
+	if opts.NewFunc == nil {
+		return nil, fmt.Errorf("must specify opts.NewFunc")
+	}
+
+	setOptionsDefaults(&opts)
+
+	s := &Store[E]{
+		backend: backend,
+
+		name:         opts.Name,
+		newFunc:      opts.NewFunc,
+		indexers:     opts.Indexers,
+		resyncPeriod: opts.ResyncPeriod,
+		listPageSize: opts.ListPageSize,
+
+		objects: make(map[string]entry),
+	}
+	s.outOfSyncSince.Store(time.Now().UnixNano())
+
+	return s, nil
+}
+
+type entry struct {
+	resourceVersion uint64
+	data            []byte
+}
+
+type Store[E api.Object] struct {
+	backend store.Store[E]
+
+	name         string
+	newFunc      func() E
+	indexers     store.Indexers[E]
+	resyncPeriod time.Duration
+	listPageSize int64
+
+	mu      sync.RWMutex
+	objects map[string]entry
+	synced  bool
+
+	// outOfSyncSince is the time in unix nanoseconds the cache stopped being
+	// in sync with the backend, zero while it is in sync.
+	outOfSyncSince atomic.Int64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// HasSynced reports whether the backend was listed and reads are served from
+// memory.
+func (s *Store[E]) HasSynced() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.synced
+}
+
+// Start lists the backend and applies its watch events to the cache until ctx
+// is done. The backend is relisted if the watch overflowed and every resync
+// period. Failed relists are retried with backoff.
+func (s *Store[E]) Start(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("Cache", s.name)
+
+	watch, err := s.backend.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start watch: %w", err)
+	}
+	defer watch.Stop()
+
+	ticker := time.NewTicker(s.resyncPeriod)
+	defer ticker.Stop()
+
+	retry := time.NewTimer(0)
+	<-retry.C
+	defer retry.Stop()
+	var backoff time.Duration
+
+	relist := func() {
+		if err := s.relist(ctx); err != nil {
+			backoff = min(max(2*backoff, minRelistBackoff), maxRelistBackoff)
+			log.Error(err, "failed to list backend, retrying", "Backoff", backoff)
+			retry.Reset(backoff)
+			return
+		}
+		if backoff > 0 && !retry.Stop() {
+			select {
+			case <-retry.C:
+			default:
+			}
+		}
+		backoff = 0
+		ticker.Reset(s.resyncPeriod)
+	}
+	relist()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watch.Overflow():
+			log.Info("Watch overflowed, relisting")
+			s.outOfSyncSince.CompareAndSwap(0, time.Now().UnixNano())
+			relist()
+		case <-ticker.C:
+			relist()
+		case <-retry.C:
+			relist()
+		case evt := <-watch.Events():
+			if err := s.apply(evt.Type, evt.Object); err != nil {
+				log.Error(err, "failed to apply watch event", "ID", evt.Object.GetID())
+			}
+		}
+	}
+}
+
+func (s *Store[E]) relist(ctx context.Context) error {
+	objects := make(map[string]entry)
+	if err := store.ForEachPage(ctx, s.backend.ListPage, s.listPageSize, func(objs []E) error {
+		for _, obj := range objs {
+			e, err := newEntry(obj)
+			if err != nil {
+				return err
+			}
+			objects[obj.GetID()] = e
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Entries written through the cache while listing are newer than the
+	// listed ones. Entries missing from the list are added back by the watch
+	// events still queued for them.
+	for id, e := range s.objects {
+		if listed, ok := objects[id]; ok && listed.resourceVersion < e.resourceVersion {
+			objects[id] = e
+		}
+	}
+
+	s.objects = objects
+	s.synced = true
+	s.outOfSyncSince.Store(0)
+	return nil
+}
+
+// apply updates the cache with an object of the given event type. Objects of
+// deletion events without finalizers were removed from the backend.
+func (s *Store[E]) apply(typ store.WatchEventType, obj E) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if typ == store.WatchEventTypeDeleted && len(obj.GetFinalizers()) == 0 {
+		delete(s.objects, obj.GetID())
+		return nil
+	}
+
+	if current, ok := s.objects[obj.GetID()]; ok && current.resourceVersion >= obj.GetResourceVersion() {
+		return nil
+	}
+
+	e, err := newEntry(obj)
+	if err != nil {
+		return err
+	}
+	s.objects[obj.GetID()] = e
+	return nil
+}
+
+func newEntry[E api.Object](obj E) (entry, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return entry{}, fmt.Errorf("failed to marshal object: %w", err)
+	}
+	return entry{resourceVersion: obj.GetResourceVersion(), data: data}, nil
+}
+
+func (s *Store[E]) Create(ctx context.Context, obj E) (E, error) {
+	obj, err := s.backend.Create(ctx, obj)
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+
+	if err := s.apply(store.WatchEventTypeCreated, obj); err != nil {
+		return utils.Zero[E](), err
+	}
+	return obj, nil
+}
+
+func (s *Store[E]) Update(ctx context.Context, obj E) (E, error) {
+	eventType := store.WatchEventTypeUpdated
+	if obj.GetDeletedAt() != nil && len(obj.GetFinalizers()) == 0 {
+		eventType = store.WatchEventTypeDeleted
+	}
+
+	obj, err := s.backend.Update(ctx, obj)
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+
+	if err := s.apply(eventType, obj); err != nil {
+		return utils.Zero[E](), err
+	}
+	return obj, nil
+}
+
+// Delete deletes the object from the backend and rereads it to learn whether
+// it was removed or only marked as deleted.
+func (s *Store[E]) Delete(ctx context.Context, id string) error {
+	if err := s.backend.Delete(ctx, id); err != nil {
+		return err
+	}
+
+	obj, err := s.backend.Get(ctx, id)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("failed to get deleted object: %w", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.objects, id)
+		return nil
+	}
+
+	return s.apply(store.WatchEventTypeDeleted, obj)
+}
+
+func (s *Store[E]) Watch(ctx context.Context) (store.Watch[E], error) {
+	return s.backend.Watch(ctx)
+}
+
+func (s *Store[E]) Get(ctx context.Context, id string) (E, error) {
+	s.mu.RLock()
+	if !s.synced {
+		s.mu.RUnlock()
+		s.misses.Add(1)
+		return s.backend.Get(ctx, id)
+	}
+	defer s.mu.RUnlock()
+
+	s.hits.Add(1)
+	e, ok := s.objects[id]
+	if !ok {
+		return utils.Zero[E](), fmt.Errorf("object with id %q %w", id, store.ErrNotFound)
+	}
+	return s.unmarshal(e.data)
+}
+
+func (s *Store[E]) List(ctx context.Context, opts ...store.ListOption) ([]E, error) {
+	o := store.ApplyListOptions(opts)
+	o.Limit, o.Continue = 0, ""
+
+	objs, _, err := s.listPage(ctx, o)
+	return objs, err
+}
+
+func (s *Store[E]) ListPage(ctx context.Context, opts ...store.ListOption) ([]E, string, error) {
+	return s.listPage(ctx, store.ApplyListOptions(opts))
+}
+
+func (s *Store[E]) listPage(ctx context.Context, o *store.ListOptions) ([]E, string, error) {
+	if err := store.ValidateListOptions(o, s.indexers); err != nil {
+		return nil, "", err
+	}
+
+	var startAfter string
+	if o.Continue != "" {
+		var err error
+		if startAfter, err = store.DecodeContinueToken(o.Continue); err != nil {
+			return nil, "", err
+		}
+	}
+
+	s.mu.RLock()
+	if !s.synced {
+		s.mu.RUnlock()
+		s.misses.Add(1)
+		return s.backend.ListPage(ctx, o)
+	}
+	defer s.mu.RUnlock()
+
+	s.hits.Add(1)
+	ids := make([]string, 0, len(s.objects))
+	for id := range s.objects {
+		if id > startAfter {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var objs []E
+	for i, id := range ids {
+		obj, err := s.unmarshal(s.objects[id].data)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if !store.Matches(obj, o, s.indexers) {
+			continue
+		}
+
+		objs = append(objs, obj)
+		if o.Limit > 0 && int64(len(objs)) == o.Limit && i < len(ids)-1 {
+			return objs, store.EncodeContinueToken(id), nil
+		}
+	}
+
+	return objs, "", nil
+}
+
+func (s *Store[E]) unmarshal(data []byte) (E, error) {
+	obj := s.newFunc()
+	if err := json.Unmarshal(data, obj); err != nil {
+		return utils.Zero[E](), fmt.Errorf("failed to unmarshal object: %w", err)
+	}
+
+	return obj, nil
+}
+
+func (s *Store[E]) Describe(ch chan<- *prometheus.Desc) {
+	ch <- requestsDesc
+	ch <- stalenessDesc
+	ch <- objectsDesc
+}
+
+func (s *Store[E]) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(s.hits.Load()), s.name, "hit")
+	ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(s.misses.Load()), s.name, "miss")
+
+	var staleness time.Duration
+	if since := s.outOfSyncSince.Load(); since != 0 {
+		staleness = time.Since(time.Unix(0, since))
+	}
+	ch <- prometheus.MustNewConstMetric(stalenessDesc, prometheus.GaugeValue, staleness.Seconds(), s.name)
+
+	s.mu.RLock()
+	objects := len(s.objects)
+	s.mu.RUnlock()
+	ch <- prometheus.MustNewConstMetric(objectsDesc, prometheus.GaugeValue, float64(objects), s.name)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/store/cache"
+	"github.com/onmetal/cephlet/pkg/store/memory"
+	"github.com/onmetal/cephlet/pkg/store/storetest"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newBackend() *memory.Store[*api.Image] {
+	backend, err := memory.New(memory.Options[*api.Image]{
+		NewFunc:        storetest.NewFunc,
+		CreateStrategy: storetest.Strategy,
+		UpdateStrategy: storetest.Strategy,
+		Indexers:       storetest.Indexers,
+		WatchQueueSize: storetest.WatchQueueSize,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return backend
+}
+
+func startCache(backend store.Store[*api.Image]) *cache.Store[*api.Image] {
+	c, err := cache.New[*api.Image](backend, cache.Options[*api.Image]{
+		Name:     "images",
+		NewFunc:  storetest.NewFunc,
+		Indexers: storetest.Indexers,
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	DeferCleanup(cancel)
+	go func() {
+		defer GinkgoRecover()
+		Expect(c.Start(ctx)).To(Succeed())
+	}()
+	Eventually(c.HasSynced).WithTimeout(5 * time.Second).Should(BeTrue())
+
+	return c
+}
+
+// flakyBackend fails the given number of list calls.
+type flakyBackend struct {
+	*memory.Store[*api.Image]
+	failures atomic.Int32
+}
+
+func (b *flakyBackend) ListPage(ctx context.Context, opts ...store.ListOption) ([]*api.Image, string, error) {
+	if b.failures.Add(-1) >= 0 {
+		return nil, "", errors.New("unavailable")
+	}
+	return b.Store.ListPage(ctx, opts...)
+}
+
+var _ = storetest.DescribeStore("Cache store", func(ctx context.Context) store.Store[*api.Image] {
+	return startCache(newBackend())
+})
+
+var _ = Describe("Cache store", func() {
+	var (
+		backend *memory.Store[*api.Image]
+		c       *cache.Store[*api.Image]
+	)
+
+	BeforeEach(func() {
+		backend = newBackend()
+		_, err := backend.Create(context.Background(), &api.Image{Metadata: api.Metadata{ID: "foo"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		c = startCache(backend)
+	})
+
+	It("should serve objects listed on start", func(ctx SpecContext) {
+		Expect(c.Get(ctx, "foo")).To(HaveField("ID", "foo"))
+	})
+
+	It("should pick up objects written to the backend directly", func(ctx SpecContext) {
+		obj, err := backend.Create(ctx, &api.Image{Metadata: api.Metadata{ID: "bar"}})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(c.Get).WithArguments(ctx, "bar").Should(HaveField("ResourceVersion", obj.ResourceVersion))
+
+		obj.Spec.Size = 2048
+		_, err = backend.Update(ctx, obj)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(c.Get).WithArguments(ctx, "bar").Should(HaveField("Spec.Size", BeEquivalentTo(2048)))
+
+		Expect(backend.Delete(ctx, "bar")).To(Succeed())
+		Eventually(func() error {
+			_, err := c.Get(ctx, "bar")
+			return err
+		}).Should(MatchError(store.ErrNotFound))
+	})
+
+	It("should retry a failed initial list", func(ctx SpecContext) {
+		flaky := &flakyBackend{Store: backend}
+		flaky.failures.Store(2)
+
+		Expect(startCache(flaky).Get(ctx, "foo")).To(HaveField("ID", "foo"))
+		Expect(flaky.failures.Load()).To(BeNumerically("<", 0))
+	}, SpecTimeout(10*time.Second))
+
+	It("should expose its hit rate, staleness and size as metrics", func(ctx SpecContext) {
+		_, err := c.Get(ctx, "foo")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP cephlet_store_cache_requests_total Number of reads served by the store cache, partitioned by whether they were served from memory.
+# TYPE cephlet_store_cache_requests_total counter
+cephlet_store_cache_requests_total{result="hit",store="images"} 1
+cephlet_store_cache_requests_total{result="miss",store="images"} 0
+# HELP cephlet_store_cache_objects Number of objects held by the store cache.
+# TYPE cephlet_store_cache_objects gauge
+cephlet_store_cache_objects{store="images"} 1
+# HELP cephlet_store_cache_staleness_seconds Seconds since the store cache was last known to be in sync with the backend. Zero while it is in sync.
+# TYPE cephlet_store_cache_staleness_seconds gauge
+cephlet_store_cache_staleness_seconds{store="images"} 0
+`))).To(Succeed())
+	})
+})
@@ -0,0 +1,344 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+type Options[E api.Object] struct {
+	NewFunc        func() E
+	CreateStrategy store.CreateStrategy[E]
+	UpdateStrategy store.UpdateStrategy[E]
+
+	// Indexers are the fields that can be used in field selectors.
+	Indexers store.Indexers[E]
+
+	// WatchQueueSize is the number of events buffered per watch before the
+	// watch overflows.
+	WatchQueueSize int
+}
+
+func setOptionsDefaults[E api.Object](o *Options[E]) {
+	if o.WatchQueueSize == 0 {
+		o.WatchQueueSize = store.DefaultWatchQueueSize
+	}
+}
+
+// New returns a store.Store that keeps its objects in memory. Objects are kept
+// in their serialized form, so callers never share state with the store, the
+// same way they don't with the omap store.
+func New[E api.Object](opts Options[E]) (*Store[E], error) {
+	if opts.NewFunc == nil {
+		return nil, fmt.Errorf("must specify opts.NewFunc")
+	}
+
+	setOptionsDefaults(&opts)
+
+	return &Store[E]{
+		objects: make(map[string][]byte),
+
+		watches:        sets.New[*watch[E]](),
+		watchQueueSize: opts.WatchQueueSize,
+
+		newFunc:        opts.NewFunc,
+		createStrategy: opts.CreateStrategy,
+		updateStrategy: opts.UpdateStrategy,
+		indexers:       opts.Indexers,
+	}, nil
+}
+
+type Store[E api.Object] struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+
+	newFunc        func() E
+	createStrategy store.CreateStrategy[E]
+	updateStrategy store.UpdateStrategy[E]
+	indexers       store.Indexers[E]
+
+	watchesMu      sync.RWMutex
+	watches        sets.Set[*watch[E]]
+	watchQueueSize int
+}
+
+func (s *Store[E]) enqueue(evt store.WatchEvent[E]) {
+	for _, handler := range s.watchHandlers() {
+		select {
+		case handler.events <- evt:
+		default:
+			select {
+			case handler.overflow <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// emit enqueues an event carrying a copy of the stored object, so watches
+// never observe changes callers make to their objects afterwards.
+func (s *Store[E]) emit(typ store.WatchEventType, id string) {
+	obj, err := s.get(id)
+	if err != nil {
+		return
+	}
+
+	s.enqueue(store.WatchEvent[E]{
+		Type:   typ,
+		Object: obj,
+	})
+}
+
+func (s *Store[E]) watchHandlers() []*watch[E] {
+	s.watchesMu.RLock()
+	defer s.watchesMu.RUnlock()
+
+	return s.watches.UnsortedList()
+}
+
+func (s *Store[E]) Create(ctx context.Context, obj E) (E, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[obj.GetID()]; ok {
+		return utils.Zero[E](), fmt.Errorf("object with id %q %w", obj.GetID(), store.ErrAlreadyExists)
+	}
+
+	if s.createStrategy != nil {
+		s.createStrategy.PrepareForCreate(obj)
+	}
+
+	obj.SetCreatedAt(time.Now())
+	obj.SetResourceVersion(1)
+
+	if err := s.set(obj); err != nil {
+		return utils.Zero[E](), err
+	}
+
+	s.emit(store.WatchEventTypeCreated, obj.GetID())
+
+	return obj, nil
+}
+
+func (s *Store[E]) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, err := s.get(id)
+	if err != nil {
+		return err
+	}
+
+	if len(obj.GetFinalizers()) == 0 {
+		delete(s.objects, id)
+		s.enqueue(store.WatchEvent[E]{
+			Type:   store.WatchEventTypeDeleted,
+			Object: obj,
+		})
+		return nil
+	}
+
+	now := time.Now()
+	obj.SetDeletedAt(&now)
+	obj.SetResourceVersion(obj.GetResourceVersion() + 1)
+
+	if err := s.set(obj); err != nil {
+		return fmt.Errorf("failed to set object metadata: %w", err)
+	}
+
+	s.emit(store.WatchEventTypeDeleted, id)
+
+	return nil
+}
+
+func (s *Store[E]) Get(ctx context.Context, id string) (E, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.get(id)
+}
+
+func (s *Store[E]) Update(ctx context.Context, obj E) (E, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.get(obj.GetID())
+	if err != nil {
+		return utils.Zero[E](), err
+	}
+
+	if current.GetResourceVersion() != obj.GetResourceVersion() {
+		return utils.Zero[E](), fmt.Errorf("object with id %q has resource version %d, expected %d: %w",
+			obj.GetID(), current.GetResourceVersion(), obj.GetResourceVersion(), store.ErrConflict)
+	}
+
+	if obj.GetDeletedAt() != nil && len(obj.GetFinalizers()) == 0 {
+		// The event carries obj rather than the stored object, like the one
+		// of the omap store, so watchers see the finalizers removed.
+		if err := s.set(obj); err != nil {
+			return utils.Zero[E](), err
+		}
+		s.emit(store.WatchEventTypeDeleted, obj.GetID())
+		delete(s.objects, obj.GetID())
+		return obj, nil
+	}
+
+	generation := obj.GetGeneration()
+	if s.updateStrategy != nil {
+		s.updateStrategy.PrepareForUpdate(obj, current)
+	}
+
+	obj.SetResourceVersion(obj.GetResourceVersion() + 1)
+	if err := s.set(obj); err != nil {
+		obj.SetResourceVersion(current.GetResourceVersion())
+		obj.SetGeneration(generation)
+		return utils.Zero[E](), err
+	}
+
+	s.emit(store.WatchEventTypeUpdated, obj.GetID())
+
+	return obj, nil
+}
+
+type watch[E api.Object] struct {
+	store *Store[E]
+
+	events   chan store.WatchEvent[E]
+	overflow chan struct{}
+}
+
+func (w *watch[E]) Stop() {
+	w.store.watchesMu.Lock()
+	defer w.store.watchesMu.Unlock()
+
+	w.store.watches.Delete(w)
+}
+
+func (w *watch[E]) Events() <-chan store.WatchEvent[E] {
+	return w.events
+}
+
+func (w *watch[E]) Overflow() <-chan struct{} {
+	return w.overflow
+}
+
+func (s *Store[E]) Watch(ctx context.Context) (store.Watch[E], error) {
+	s.watchesMu.Lock()
+	defer s.watchesMu.Unlock()
+
+	w := &watch[E]{
+		store:    s,
+		events:   make(chan store.WatchEvent[E], s.watchQueueSize),
+		overflow: make(chan struct{}, 1),
+	}
+
+	s.watches.Insert(w)
+
+	return w, nil
+}
+
+func (s *Store[E]) List(ctx context.Context, opts ...store.ListOption) ([]E, error) {
+	o := store.ApplyListOptions(opts)
+	o.Limit, o.Continue = 0, ""
+
+	objs, _, err := s.listPage(o)
+	return objs, err
+}
+
+func (s *Store[E]) ListPage(ctx context.Context, opts ...store.ListOption) ([]E, string, error) {
+	return s.listPage(store.ApplyListOptions(opts))
+}
+
+func (s *Store[E]) listPage(o *store.ListOptions) ([]E, string, error) {
+	if err := store.ValidateListOptions(o, s.indexers); err != nil {
+		return nil, "", err
+	}
+
+	var startAfter string
+	if o.Continue != "" {
+		var err error
+		if startAfter, err = store.DecodeContinueToken(o.Continue); err != nil {
+			return nil, "", err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.objects))
+	for id := range s.objects {
+		if id > startAfter {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var objs []E
+	for i, id := range ids {
+		obj, err := s.unmarshal(s.objects[id])
+		if err != nil {
+			return nil, "", err
+		}
+
+		if !store.Matches(obj, o, s.indexers) {
+			continue
+		}
+
+		objs = append(objs, obj)
+		if o.Limit > 0 && int64(len(objs)) == o.Limit && i < len(ids)-1 {
+			return objs, store.EncodeContinueToken(id), nil
+		}
+	}
+
+	return objs, "", nil
+}
+
+func (s *Store[E]) set(obj E) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal obj: %w", err)
+	}
+
+	s.objects[obj.GetID()] = data
+	return nil
+}
+
+func (s *Store[E]) get(id string) (E, error) {
+	data, ok := s.objects[id]
+	if !ok {
+		return utils.Zero[E](), fmt.Errorf("object with id %q %w", id, store.ErrNotFound)
+	}
+
+	return s.unmarshal(data)
+}
+
+func (s *Store[E]) unmarshal(data []byte) (E, error) {
+	obj := s.newFunc()
+	if err := json.Unmarshal(data, obj); err != nil {
+		return utils.Zero[E](), fmt.Errorf("failed to unmarshal object: %w", err)
+	}
+
+	return obj, nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory_test
+
+import (
+	"context"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	"github.com/onmetal/cephlet/pkg/store/memory"
+	"github.com/onmetal/cephlet/pkg/store/storetest"
+	. "github.com/onsi/gomega"
+)
+
+var _ = storetest.DescribeStore("Memory store", func(ctx context.Context) store.Store[*api.Image] {
+	s, err := memory.New(memory.Options[*api.Image]{
+		NewFunc:        storetest.NewFunc,
+		CreateStrategy: storetest.Strategy,
+		UpdateStrategy: storetest.Strategy,
+		Indexers:       storetest.Indexers,
+		WatchQueueSize: storetest.WatchQueueSize,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return s
+})
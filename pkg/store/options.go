@@ -0,0 +1,176 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// IndexFunc returns the values an object is indexed under for a field.
+type IndexFunc[E api.Object] func(obj E) []string
+
+// Indexers maps field names that can be used in field selectors to the
+// functions computing their values.
+type Indexers[E api.Object] map[string]IndexFunc[E]
+
+type ListOptions struct {
+	// LabelSelector restricts the list to objects with matching labels.
+	LabelSelector labels.Selector
+	// FieldSelector restricts the list to objects having the given value in
+	// every indexed field.
+	FieldSelector map[string]string
+
+	// Limit is the maximum number of objects returned by ListPage. Zero means
+	// no limit.
+	Limit int64
+	// Continue is the token returned by a previous ListPage call. ListPage
+	// then returns the objects following the ones of that call.
+	Continue string
+}
+
+type ListOption interface {
+	ApplyToList(o *ListOptions)
+}
+
+// ApplyToList copies the options set in o to lo, so already applied options
+// can be passed on to another store.
+func (o *ListOptions) ApplyToList(lo *ListOptions) {
+	if o.LabelSelector != nil {
+		lo.LabelSelector = o.LabelSelector
+	}
+	if o.FieldSelector != nil {
+		lo.FieldSelector = o.FieldSelector
+	}
+	if o.Limit != 0 {
+		lo.Limit = o.Limit
+	}
+	if o.Continue != "" {
+		lo.Continue = o.Continue
+	}
+}
+
+func ApplyListOptions(opts []ListOption) *ListOptions {
+	o := &ListOptions{}
+	for _, opt := range opts {
+		opt.ApplyToList(o)
+	}
+	return o
+}
+
+type MatchingLabels map[string]string
+
+func (m MatchingLabels) ApplyToList(o *ListOptions) {
+	o.LabelSelector = labels.SelectorFromSet(labels.Set(m))
+}
+
+type MatchingLabelSelector struct {
+	labels.Selector
+}
+
+func (m MatchingLabelSelector) ApplyToList(o *ListOptions) {
+	o.LabelSelector = m.Selector
+}
+
+type MatchingFields map[string]string
+
+func (m MatchingFields) ApplyToList(o *ListOptions) {
+	o.FieldSelector = m
+}
+
+type Limit int64
+
+func (l Limit) ApplyToList(o *ListOptions) {
+	o.Limit = int64(l)
+}
+
+type Continue string
+
+func (c Continue) ApplyToList(o *ListOptions) {
+	o.Continue = string(c)
+}
+
+// EncodeContinueToken returns the continue token for a page ending with the
+// object with the given id.
+func EncodeContinueToken(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// DecodeContinueToken returns the id of the last object of the page token was
+// returned for.
+func DecodeContinueToken(token string) (string, error) {
+	id, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid continue token: %w", err)
+	}
+	return string(id), nil
+}
+
+type ListPageFunc[E api.Object] func(ctx context.Context, opts ...ListOption) ([]E, string, error)
+
+// ForEachPage calls f with every page listPage returns for opts, until there
+// are no more objects or f returns an error.
+func ForEachPage[E api.Object](ctx context.Context, listPage ListPageFunc[E], limit int64, f func(objs []E) error, opts ...ListOption) error {
+	var token string
+	for {
+		objs, next, err := listPage(ctx, append(opts, Limit(limit), Continue(token))...)
+		if err != nil {
+			return err
+		}
+
+		if err := f(objs); err != nil {
+			return err
+		}
+
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
+
+// ValidateListOptions checks that all fields of the field selector are indexed.
+func ValidateListOptions[E api.Object](o *ListOptions, indexers Indexers[E]) error {
+	if o.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	for field := range o.FieldSelector {
+		if _, ok := indexers[field]; !ok {
+			return fmt.Errorf("field %q is not indexed", field)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether obj is selected by o.
+func Matches[E api.Object](obj E, o *ListOptions, indexers Indexers[E]) bool {
+	if o.LabelSelector != nil && !o.LabelSelector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+
+	for field, value := range o.FieldSelector {
+		indexFunc, ok := indexers[field]
+		if !ok || !slices.Contains(indexFunc(obj), value) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -24,6 +24,7 @@ import (
 var (
 	ErrNotFound      = errors.New("not found")
 	ErrAlreadyExists = errors.New("already exists")
+	ErrConflict      = errors.New("conflict")
 )
 
 func IgnoreErrNotFound(err error) error {
@@ -42,11 +43,26 @@ func IgnoreAlreadyExists(err error) error {
 	return err
 }
 
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
 type Watch[E api.Object] interface {
 	Stop()
 	Events() <-chan WatchEvent[E]
+	// Overflow receives a value if events had to be dropped because the
+	// watch did not keep up with them. Consumers have to relist to catch up.
+	Overflow() <-chan struct{}
 }
 
+// DefaultWatchQueueSize is the number of events a watch buffers unless the
+// store is configured otherwise.
+const DefaultWatchQueueSize = 1024
+
+// DefaultListPageSize is the number of objects consumers paging through a
+// store request at once unless configured otherwise.
+const DefaultListPageSize = 500
+
 type WatchEvent[E api.Object] struct {
 	Type   WatchEventType
 	Object E
@@ -57,15 +73,34 @@ type WatchEventType string
 const (
 	WatchEventTypeCreated WatchEventType = "Created"
 	WatchEventTypeUpdated WatchEventType = "Updated"
+	// WatchEventTypeDeleted is delivered both when an object is marked as
+	// deleted and when it is finally removed from the store.
 	WatchEventTypeDeleted WatchEventType = "Deleted"
 )
 
+type CreateStrategy[E api.Object] interface {
+	PrepareForCreate(obj E)
+}
+
+// UpdateStrategy prepares an object for being updated. PrepareForUpdate is
+// called with the currently stored object once the update is known to not
+// conflict, so it may carry over or bump fields like the generation.
+type UpdateStrategy[E api.Object] interface {
+	PrepareForUpdate(obj, old E)
+}
+
 type Store[E api.Object] interface {
 	Create(ctx context.Context, obj E) (E, error)
 	Get(ctx context.Context, id string) (E, error)
 	Update(ctx context.Context, obj E) (E, error)
 	Delete(ctx context.Context, id string) error
-	List(ctx context.Context) ([]E, error)
+	// List returns all objects matching opts, ignoring their Limit and
+	// Continue.
+	List(ctx context.Context, opts ...ListOption) ([]E, error)
+	// ListPage returns at most opts.Limit objects matching opts, ordered by id
+	// and following the page opts.Continue was returned for. It returns the
+	// token to list the next page, which is empty if there are no more objects.
+	ListPage(ctx context.Context, opts ...ListOption) ([]E, string, error)
 
 	Watch(ctx context.Context) (Watch[E], error)
 }
@@ -0,0 +1,480 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storetest contains a conformance suite every store.Store
+// implementation has to pass.
+package storetest
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+)
+
+// Strategy is the store.CreateStrategy and store.UpdateStrategy the store
+// under test has to be configured with.
+var Strategy = strategy{}
+
+type strategy struct{}
+
+func (strategy) PrepareForCreate(obj *api.Image) {
+	obj.Generation = 1
+	obj.Status = api.ImageStatus{State: api.ImageStatePending}
+}
+
+func (strategy) PrepareForUpdate(obj, old *api.Image) {
+	obj.Generation = old.Generation
+	if !reflect.DeepEqual(obj.Spec, old.Spec) {
+		obj.Generation++
+	}
+}
+
+// WatchQueueSize is the watch queue size the store under test has to be
+// configured with.
+const WatchQueueSize = 8
+
+// SnapshotRefField is the field Indexers index images by their snapshot ref.
+const SnapshotRefField = "spec.snapshotRef"
+
+// Indexers are the indexers the store under test has to be configured with.
+var Indexers = store.Indexers[*api.Image]{
+	SnapshotRefField: func(obj *api.Image) []string {
+		if obj.Spec.SnapshotRef == nil {
+			return nil
+		}
+		return []string{*obj.Spec.SnapshotRef}
+	},
+}
+
+// NewFunc is the NewFunc the store under test has to be configured with.
+func NewFunc() *api.Image {
+	return &api.Image{}
+}
+
+// DescribeStore registers the conformance specs for the store returned by
+// newStore. newStore is called for every spec and has to return an empty store
+// configured with NewFunc, Strategy, Indexers and WatchQueueSize.
+func DescribeStore(name string, newStore func(ctx context.Context) store.Store[*api.Image], args ...interface{}) bool {
+	return Describe(name+" conformance", append(args, func() {
+		var s store.Store[*api.Image]
+
+		BeforeEach(func(ctx SpecContext) {
+			s = newStore(ctx)
+		})
+
+		newImage := func(id string) *api.Image {
+			return &api.Image{
+				Metadata: api.Metadata{
+					ID:     id,
+					Labels: map[string]string{"foo": "bar"},
+				},
+				Spec: api.ImageSpec{
+					Size: 1024,
+				},
+			}
+		}
+
+		Context("Create", func() {
+			It("should create an object and apply the create strategy", func(ctx SpecContext) {
+				created, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(created.CreatedAt).NotTo(BeZero())
+				Expect(created.ResourceVersion).To(BeEquivalentTo(1))
+				Expect(created.Generation).To(BeEquivalentTo(1))
+				Expect(created.Status.State).To(Equal(api.ImageStatePending))
+
+				obj, err := s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Spec.Size).To(BeEquivalentTo(1024))
+				Expect(obj.Labels).To(Equal(map[string]string{"foo": "bar"}))
+				Expect(obj.ResourceVersion).To(Equal(created.ResourceVersion))
+				Expect(obj.Status.State).To(Equal(api.ImageStatePending))
+			})
+
+			It("should fail to create an object twice", func(ctx SpecContext) {
+				_, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = s.Create(ctx, newImage("foo"))
+				Expect(err).To(MatchError(store.ErrAlreadyExists))
+			})
+		})
+
+		Context("Get", func() {
+			It("should return not found for a missing object", func(ctx SpecContext) {
+				_, err := s.Get(ctx, "foo")
+				Expect(err).To(MatchError(store.ErrNotFound))
+			})
+
+			It("should not share state with the caller", func(ctx SpecContext) {
+				created, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+				created.Spec.Size = 2048
+
+				obj, err := s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Spec.Size).To(BeEquivalentTo(1024))
+			})
+		})
+
+		Context("Update", func() {
+			It("should update an object and advance its resource version", func(ctx SpecContext) {
+				obj, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				obj.Spec.Size = 2048
+				updated, err := s.Update(ctx, obj)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(updated.ResourceVersion).To(BeEquivalentTo(2))
+
+				obj, err = s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Spec.Size).To(BeEquivalentTo(2048))
+				Expect(obj.ResourceVersion).To(BeEquivalentTo(2))
+			})
+
+			It("should apply the update strategy", func(ctx SpecContext) {
+				obj, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				By("updating the status only")
+				obj.Status.State = api.ImageStateAvailable
+				obj, err = s.Update(ctx, obj)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Generation).To(BeEquivalentTo(1))
+
+				By("updating the spec")
+				obj.Spec.Size = 2048
+				obj.Generation = 42
+				obj, err = s.Update(ctx, obj)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Generation).To(BeEquivalentTo(2))
+
+				obj, err = s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Generation).To(BeEquivalentTo(2))
+			})
+
+			It("should reject an update with a stale resource version", func(ctx SpecContext) {
+				_, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				first, err := s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				second, err := s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+
+				first.Spec.Size = 2048
+				_, err = s.Update(ctx, first)
+				Expect(err).NotTo(HaveOccurred())
+
+				second.Spec.Size = 4096
+				_, err = s.Update(ctx, second)
+				Expect(err).To(MatchError(store.ErrConflict))
+				Expect(second.ResourceVersion).To(BeEquivalentTo(1))
+
+				obj, err := s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.Spec.Size).To(BeEquivalentTo(2048))
+			})
+
+			It("should return not found for a missing object", func(ctx SpecContext) {
+				_, err := s.Update(ctx, newImage("foo"))
+				Expect(err).To(MatchError(store.ErrNotFound))
+			})
+		})
+
+		Context("Delete", func() {
+			It("should delete an object without finalizers", func(ctx SpecContext) {
+				_, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(s.Delete(ctx, "foo")).To(Succeed())
+
+				_, err = s.Get(ctx, "foo")
+				Expect(err).To(MatchError(store.ErrNotFound))
+			})
+
+			It("should only mark an object with finalizers as deleted", func(ctx SpecContext) {
+				img := newImage("foo")
+				img.Finalizers = []string{"test"}
+				_, err := s.Create(ctx, img)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(s.Delete(ctx, "foo")).To(Succeed())
+
+				obj, err := s.Get(ctx, "foo")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.DeletedAt).NotTo(BeNil())
+
+				w, err := s.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(w.Stop)
+
+				By("removing the finalizer")
+				obj.Finalizers = nil
+				_, err = s.Update(ctx, obj)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = s.Get(ctx, "foo")
+				Expect(err).To(MatchError(store.ErrNotFound))
+
+				Eventually(w.Events()).Should(Receive(SatisfyAll(
+					HaveField("Type", store.WatchEventTypeDeleted),
+					HaveField("Object.ID", "foo"),
+					HaveField("Object.Finalizers", BeEmpty()),
+				)))
+			})
+
+			It("should return not found for a missing object", func(ctx SpecContext) {
+				Expect(s.Delete(ctx, "foo")).To(MatchError(store.ErrNotFound))
+			})
+		})
+
+		Context("List", func() {
+			It("should list all objects", func(ctx SpecContext) {
+				for i := 0; i < 3; i++ {
+					_, err := s.Create(ctx, newImage(strconv.Itoa(i)))
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				objs, err := s.List(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(objs).To(ConsistOf(
+					HaveField("ID", "0"),
+					HaveField("ID", "1"),
+					HaveField("ID", "2"),
+				))
+			})
+
+			It("should list objects in pages", func(ctx SpecContext) {
+				for i := 0; i < 5; i++ {
+					_, err := s.Create(ctx, newImage(strconv.Itoa(i)))
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				objs, token, err := s.ListPage(ctx, store.Limit(2))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(objs).To(HaveExactElements(HaveField("ID", "0"), HaveField("ID", "1")))
+				Expect(token).NotTo(BeEmpty())
+
+				objs, token, err = s.ListPage(ctx, store.Limit(2), store.Continue(token))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(objs).To(HaveExactElements(HaveField("ID", "2"), HaveField("ID", "3")))
+				Expect(token).NotTo(BeEmpty())
+
+				By("deleting an object of the next page")
+				Expect(s.Delete(ctx, "4")).To(Succeed())
+
+				objs, token, err = s.ListPage(ctx, store.Limit(2), store.Continue(token))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(objs).To(BeEmpty())
+				Expect(token).To(BeEmpty())
+			})
+
+			It("should return the last page without a continue token", func(ctx SpecContext) {
+				for i := 0; i < 4; i++ {
+					_, err := s.Create(ctx, newImage(strconv.Itoa(i)))
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				var pages [][]*api.Image
+				Expect(store.ForEachPage(ctx, s.ListPage, 3, func(objs []*api.Image) error {
+					pages = append(pages, objs)
+					return nil
+				})).To(Succeed())
+				Expect(pages).To(HaveExactElements(HaveLen(3), HaveLen(1)))
+			})
+
+			It("should reject an invalid continue token", func(ctx SpecContext) {
+				_, _, err := s.ListPage(ctx, store.Limit(2), store.Continue("!"))
+				Expect(err).To(HaveOccurred())
+			})
+
+			Context("with selectors", func() {
+				BeforeEach(func(ctx SpecContext) {
+					for id, tier := range map[string]string{"0": "gold", "1": "silver", "2": "bronze"} {
+						img := newImage(id)
+						img.Labels["tier"] = tier
+						img.Spec.SnapshotRef = ptr.To("snap-" + tier)
+						_, err := s.Create(ctx, img)
+						Expect(err).NotTo(HaveOccurred())
+					}
+					_, err := s.Create(ctx, newImage("3"))
+					Expect(err).NotTo(HaveOccurred())
+				})
+
+				It("should list objects matching labels", func(ctx SpecContext) {
+					objs, err := s.List(ctx, store.MatchingLabels{"tier": "silver"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(ConsistOf(HaveField("ID", "1")))
+				})
+
+				It("should list objects matching a set-based label selector", func(ctx SpecContext) {
+					sel, err := labels.Parse("tier in (gold,bronze)")
+					Expect(err).NotTo(HaveOccurred())
+					objs, err := s.List(ctx, store.MatchingLabelSelector{Selector: sel})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(ConsistOf(HaveField("ID", "0"), HaveField("ID", "2")))
+
+					sel, err = labels.Parse("foo=bar,tier,tier!=gold")
+					Expect(err).NotTo(HaveOccurred())
+					objs, err = s.List(ctx, store.MatchingLabelSelector{Selector: sel})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(ConsistOf(HaveField("ID", "1"), HaveField("ID", "2")))
+
+					sel, err = labels.Parse("!tier")
+					Expect(err).NotTo(HaveOccurred())
+					objs, err = s.List(ctx, store.MatchingLabelSelector{Selector: sel})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(ConsistOf(HaveField("ID", "3")))
+				})
+
+				It("should list objects matching fields", func(ctx SpecContext) {
+					objs, err := s.List(ctx, store.MatchingFields{SnapshotRefField: "snap-gold"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(ConsistOf(HaveField("ID", "0")))
+
+					objs, err = s.List(ctx,
+						store.MatchingLabels{"tier": "gold"},
+						store.MatchingFields{SnapshotRefField: "snap-silver"},
+					)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(BeEmpty())
+				})
+
+				It("should reflect updates and deletions", func(ctx SpecContext) {
+					obj, err := s.Get(ctx, "0")
+					Expect(err).NotTo(HaveOccurred())
+					obj.Labels["tier"] = "silver"
+					obj.Spec.SnapshotRef = nil
+					_, err = s.Update(ctx, obj)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(s.Delete(ctx, "1")).To(Succeed())
+
+					objs, err := s.List(ctx, store.MatchingLabels{"tier": "silver"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(ConsistOf(HaveField("ID", "0")))
+
+					objs, err = s.List(ctx, store.MatchingFields{SnapshotRefField: "snap-gold"})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(BeEmpty())
+				})
+
+				It("should list matching objects in pages", func(ctx SpecContext) {
+					sel, err := labels.Parse("tier")
+					Expect(err).NotTo(HaveOccurred())
+
+					objs, token, err := s.ListPage(ctx, store.MatchingLabelSelector{Selector: sel}, store.Limit(2))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(HaveExactElements(HaveField("ID", "0"), HaveField("ID", "1")))
+
+					objs, token, err = s.ListPage(ctx, store.MatchingLabelSelector{Selector: sel}, store.Limit(2), store.Continue(token))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(objs).To(HaveExactElements(HaveField("ID", "2")))
+					Expect(token).To(BeEmpty())
+				})
+
+				It("should reject fields that are not indexed", func(ctx SpecContext) {
+					_, err := s.List(ctx, store.MatchingFields{"spec.size": "1024"})
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+
+		Context("Watch", func() {
+			It("should deliver create, update and delete events", func(ctx SpecContext) {
+				w, err := s.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(w.Stop)
+
+				img := newImage("foo")
+				img.Finalizers = []string{"test"}
+				_, err = s.Create(ctx, img)
+				Expect(err).NotTo(HaveOccurred())
+
+				img.Spec.Size = 2048
+				_, err = s.Update(ctx, img)
+				Expect(err).NotTo(HaveOccurred())
+
+				img.Spec.Size = 4096
+				Expect(s.Delete(ctx, "foo")).To(Succeed())
+
+				Eventually(w.Events()).Should(Receive(SatisfyAll(
+					HaveField("Type", store.WatchEventTypeCreated),
+					HaveField("Object.ID", "foo"),
+					HaveField("Object.Spec.Size", BeEquivalentTo(1024)),
+				)))
+				Eventually(w.Events()).Should(Receive(SatisfyAll(
+					HaveField("Type", store.WatchEventTypeUpdated),
+					HaveField("Object.Spec.Size", BeEquivalentTo(2048)),
+				)))
+				Eventually(w.Events()).Should(Receive(SatisfyAll(
+					HaveField("Type", store.WatchEventTypeDeleted),
+					HaveField("Object.DeletedAt", Not(BeNil())),
+				)))
+				Consistently(w.Overflow()).ShouldNot(Receive())
+			})
+
+			It("should deliver a delete event when an object is removed", func(ctx SpecContext) {
+				_, err := s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				w, err := s.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(w.Stop)
+
+				Expect(s.Delete(ctx, "foo")).To(Succeed())
+
+				Eventually(w.Events()).Should(Receive(SatisfyAll(
+					HaveField("Type", store.WatchEventTypeDeleted),
+					HaveField("Object.ID", "foo"),
+				)))
+			})
+
+			It("should signal an overflow if events are not consumed", func(ctx SpecContext) {
+				w, err := s.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				DeferCleanup(w.Stop)
+
+				for i := 0; i < WatchQueueSize+1; i++ {
+					_, err := s.Create(ctx, newImage(strconv.Itoa(i)))
+					Expect(err).NotTo(HaveOccurred())
+				}
+
+				Eventually(w.Overflow()).Should(Receive())
+				Expect(w.Events()).To(HaveLen(WatchQueueSize))
+			})
+
+			It("should not deliver events after the watch was stopped", func(ctx SpecContext) {
+				w, err := s.Watch(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				w.Stop()
+
+				_, err = s.Create(ctx, newImage("foo"))
+				Expect(err).NotTo(HaveOccurred())
+
+				Consistently(w.Events()).ShouldNot(Receive())
+			})
+		})
+	})...)
+}
@@ -0,0 +1,32 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/onmetal/cephlet/pkg/api"
+	"github.com/onmetal/cephlet/pkg/store"
+)
+
+// ImageSnapshotRefField indexes images by the snapshot they are created from.
+const ImageSnapshotRefField = "spec.snapshotRef"
+
+var ImageIndexers = store.Indexers[*api.Image]{
+	ImageSnapshotRefField: func(obj *api.Image) []string {
+		if obj.Spec.SnapshotRef == nil {
+			return nil
+		}
+		return []string{*obj.Spec.SnapshotRef}
+	},
+}
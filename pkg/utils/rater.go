@@ -17,6 +17,7 @@ package utils
 import (
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -26,18 +27,27 @@ func NewRater(r io.Reader) *Rater {
 	}
 }
 
+// Rater counts the bytes read from a reader. Its rate may be queried
+// concurrently to reading.
 type Rater struct {
-	r          io.Reader
+	r io.Reader
+
+	mu         sync.Mutex
 	count      int64
 	start, end time.Time
 }
 
 func (r *Rater) Read(b []byte) (n int, err error) {
+	r.mu.Lock()
 	if r.start.IsZero() {
 		r.start = time.Now()
 	}
+	r.mu.Unlock()
 
 	n, err = r.r.Read(b)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.count += int64(n)
 	if err == io.EOF {
 		r.end = time.Now()
@@ -47,6 +57,9 @@ func (r *Rater) Read(b []byte) (n int, err error) {
 }
 
 func (r *Rater) Rate() (n int64, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	start := r.start
 	end := r.end
 	if end.IsZero() {
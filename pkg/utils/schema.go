@@ -0,0 +1,31 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/onmetal/cephlet/pkg/schema"
+)
+
+// ImageSchema converts stored images to the current schema version.
+var ImageSchema = schema.NewRegistry(
+	// 0 -> 1: objects carry their schema version.
+	schema.NoConversion,
+)
+
+// SnapshotSchema converts stored snapshots to the current schema version.
+var SnapshotSchema = schema.NewRegistry(
+	// 0 -> 1: objects carry their schema version.
+	schema.NoConversion,
+)
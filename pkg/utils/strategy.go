@@ -19,6 +19,7 @@ import (
 
 	"github.com/onmetal/cephlet/pkg/api"
 	"github.com/onmetal/onmetal-api/broker/common/idgen"
+	"k8s.io/apimachinery/pkg/api/equality"
 )
 
 var SnapshotStrategy = snapshotStrategy{}
@@ -26,9 +27,20 @@ var SnapshotStrategy = snapshotStrategy{}
 type snapshotStrategy struct{}
 
 func (snapshotStrategy) PrepareForCreate(obj *api.Snapshot) {
+	obj.Generation = 1
 	obj.Status = api.SnapshotStatus{State: api.SnapshotStatePending}
 }
 
+// PrepareForUpdate bumps the generation if the source of the snapshot changed.
+// Nil and empty maps and slices are considered equal, as they are not told
+// apart once stored.
+func (snapshotStrategy) PrepareForUpdate(obj, old *api.Snapshot) {
+	obj.Generation = old.Generation
+	if !equality.Semantic.DeepEqual(obj.Source, old.Source) {
+		obj.Generation++
+	}
+}
+
 var ImageStrategy = imageStrategy{
 	WWNGen: idgen.NewIDGen(rand.Reader, 16),
 }
@@ -38,6 +50,17 @@ type imageStrategy struct {
 }
 
 func (i imageStrategy) PrepareForCreate(obj *api.Image) {
+	obj.Generation = 1
 	obj.Spec.WWN = i.WWNGen.Generate()
 	obj.Status = api.ImageStatus{State: api.ImageStatePending}
 }
+
+// PrepareForUpdate bumps the generation if the spec of the image changed.
+// Nil and empty maps and slices are considered equal, as they are not told
+// apart once stored.
+func (imageStrategy) PrepareForUpdate(obj, old *api.Image) {
+	obj.Generation = old.Generation
+	if !equality.Semantic.DeepEqual(obj.Spec, old.Spec) {
+		obj.Generation++
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 OnMetal authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils_test
+
+import (
+	"github.com/onmetal/cephlet/pkg/api"
+	. "github.com/onmetal/cephlet/pkg/utils"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SnapshotStrategy", func() {
+	newSnapshot := func(source api.SnapshotSource) *api.Snapshot {
+		snapshot := &api.Snapshot{Source: source}
+		SnapshotStrategy.PrepareForCreate(snapshot)
+		return snapshot
+	}
+
+	It("should keep the generation of a url source that did not change", func() {
+		old := newSnapshot(api.SnapshotSource{URL: &api.URLSource{URL: "https://example.org/disk.raw", Checksum: "sha256:foo"}})
+
+		updated := newSnapshot(api.SnapshotSource{URL: &api.URLSource{URL: "https://example.org/disk.raw", Checksum: "sha256:foo"}})
+		updated.Status.State = api.SnapshotStatePopulated
+		SnapshotStrategy.PrepareForUpdate(updated, old)
+		Expect(updated.Generation).To(Equal(old.Generation))
+	})
+
+	It("should bump the generation if the url source changed", func() {
+		old := newSnapshot(api.SnapshotSource{URL: &api.URLSource{URL: "https://example.org/disk.raw", Checksum: "sha256:foo"}})
+
+		updated := newSnapshot(api.SnapshotSource{URL: &api.URLSource{URL: "https://example.org/disk.raw", Checksum: "sha256:bar"}})
+		SnapshotStrategy.PrepareForUpdate(updated, old)
+		Expect(updated.Generation).To(Equal(old.Generation + 1))
+	})
+
+	It("should bump the generation if the onmetal image changed", func() {
+		old := newSnapshot(api.SnapshotSource{OnmetalImage: "example.org/foo:v1"})
+
+		updated := newSnapshot(api.SnapshotSource{OnmetalImage: "example.org/foo:v1"})
+		SnapshotStrategy.PrepareForUpdate(updated, old)
+		Expect(updated.Generation).To(Equal(old.Generation))
+
+		updated.Source.OnmetalImage = "example.org/foo:v2"
+		SnapshotStrategy.PrepareForUpdate(updated, old)
+		Expect(updated.Generation).To(Equal(old.Generation + 1))
+	})
+})
+
+var _ = Describe("ImageStrategy", func() {
+	It("should keep the generation if the spec only differs in empty fields", func() {
+		old := &api.Image{Spec: api.ImageSpec{Size: 1024}}
+		ImageStrategy.PrepareForCreate(old)
+
+		updated := &api.Image{Spec: old.Spec}
+		updated.Spec.Limits = api.Limits{}
+		updated.Spec.Encryption.EncryptedPassphrase = []byte{}
+		ImageStrategy.PrepareForUpdate(updated, old)
+		Expect(updated.Generation).To(Equal(old.Generation))
+
+		updated.Spec.Size = 2048
+		ImageStrategy.PrepareForUpdate(updated, old)
+		Expect(updated.Generation).To(Equal(old.Generation + 1))
+	})
+})